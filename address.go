@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	stdmail "net/mail"
+	"strings"
+)
+
+// Address is an email address and its optional display name.
+type Address struct {
+	// Name is the display name, it is encoded when the address is written.
+	Name string
+	// LocalPart is the part of the address before the @, without the quotes
+	// of a quoted local part.
+	LocalPart string
+	// Domain is the part of the address after the @: a domain name, possibly
+	// internationalized, or an address literal like "[192.0.2.1]".
+	Domain string
+}
+
+// ParseAddress parses an RFC 5322 address, with or without display name, for
+// example "Señor From <from@example.com>" or "from@example.com". Unlike
+// net/mail, it also checks the limits of RFC 5321: the local part is at most
+// 64 octets long and the domain must be a valid host name or address literal.
+func ParseAddress(s string) (Address, error) {
+	addr, err := stdmail.ParseAddress(s)
+	if err != nil {
+		return Address{}, fmt.Errorf("gomail: invalid address %q: %w", s, err)
+	}
+	i := strings.LastIndexByte(addr.Address, '@')
+	a := Address{Name: addr.Name, LocalPart: addr.Address[:i], Domain: addr.Address[i+1:]}
+	if err := a.Validate(); err != nil {
+		return Address{}, err
+	}
+	return a, nil
+}
+
+// Validate checks the syntax of the local part and the domain of a.
+func (a Address) Validate() error {
+	if a.LocalPart == "" || a.Domain == "" {
+		return fmt.Errorf("gomail: invalid address %q: missing local part or domain", a.Addr())
+	}
+	if len(a.LocalPart) > 64 {
+		return fmt.Errorf("gomail: invalid address %q: local part longer than 64 octets", a.Addr())
+	}
+	for _, c := range a.LocalPart {
+		if c < ' ' || c == 0x7f {
+			return fmt.Errorf("gomail: invalid address %q: control character in local part", a.Addr())
+		}
+	}
+	if !isDomain(a.Domain) {
+		return fmt.Errorf("gomail: invalid address %q: invalid domain", a.Addr())
+	}
+	return nil
+}
+
+// Addr returns the address without display name, quoting the local part when
+// it is not a dot-atom.
+func (a Address) Addr() string {
+	if isDotAtom(a.LocalPart) {
+		return a.LocalPart + "@" + a.Domain
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(a.LocalPart); i++ {
+		if c := a.LocalPart[i]; c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(a.LocalPart[i])
+	}
+	b.WriteString(`"@`)
+	b.WriteString(a.Domain)
+	return b.String()
+}
+
+// String returns the address formatted like Message.FormatAddress does with
+// the default settings of a message, the display name being encoded in UTF-8
+// when needed.
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Addr()
+	}
+	var buf bytes.Buffer
+	writeDisplayName(&buf, qEncoding, "UTF-8", a.Name)
+	buf.WriteString(" <")
+	buf.WriteString(a.Addr())
+	buf.WriteByte('>')
+	return buf.String()
+}
+
+// SetAddresses sets the given addresses to an address header field like From,
+// To or Cc, replacing any previous value. The addresses are validated first
+// and the field is left unchanged if one of them is invalid.
+func (m *Message) SetAddresses(field string, addresses ...Address) error {
+	values := make([]string, len(addresses))
+	for i, a := range addresses {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+		values[i] = m.FormatAddress(a.Addr(), a.Name)
+	}
+	m.SetRawHeader(field, values...)
+	return nil
+}
+
+// isDotAtom reports whether s is a dot-atom as defined in RFC 5322, allowing
+// the UTF-8 characters of RFC 6532.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c >= 0x80:
+		case strings.ContainsRune("!#$%&'*+-/=?^_`{|}~.", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isDomain reports whether s is a host name made of labels of letters, digits
+// and hyphens, or of UTF-8 characters for an internationalized domain name,
+// or an address literal as defined in RFC 5321, section 4.1.3.
+func isDomain(s string) bool {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		lit := s[1 : len(s)-1]
+		if ip, ok := strings.CutPrefix(lit, "IPv6:"); ok {
+			return strings.Contains(ip, ":") && net.ParseIP(ip) != nil
+		}
+		ip := net.ParseIP(lit)
+		return ip != nil && ip.To4() != nil && !strings.Contains(lit, ":")
+	}
+	if len(s) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		ascii := true
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			case c >= 0x80:
+				ascii = false
+			default:
+				return false
+			}
+		}
+		if ascii && len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Address
+		addr string
+	}{
+		{"from@example.com", Address{LocalPart: "from", Domain: "example.com"}, "from@example.com"},
+		{"Señor From <from@example.com>", Address{Name: "Señor From", LocalPart: "from", Domain: "example.com"}, "from@example.com"},
+		{`"john doe"@example.com`, Address{LocalPart: "john doe", Domain: "example.com"}, `"john doe"@example.com`},
+		{`"a\"b"@example.com`, Address{LocalPart: `a"b`, Domain: "example.com"}, `"a\"b"@example.com`},
+		{"jöhn@bücher.example", Address{LocalPart: "jöhn", Domain: "bücher.example"}, "jöhn@bücher.example"},
+		{"user@[192.0.2.1]", Address{LocalPart: "user", Domain: "[192.0.2.1]"}, "user@[192.0.2.1]"},
+		{"user@[IPv6:2001:db8::1]", Address{LocalPart: "user", Domain: "[IPv6:2001:db8::1]"}, "user@[IPv6:2001:db8::1]"},
+	}
+	for _, test := range tests {
+		a, err := ParseAddress(test.in)
+		if err != nil {
+			t.Errorf("ParseAddress(%q): %v", test.in, err)
+			continue
+		}
+		if a != test.want {
+			t.Errorf("ParseAddress(%q) = %#v, want %#v", test.in, a, test.want)
+		}
+		if got := a.Addr(); got != test.addr {
+			t.Errorf("invalid address of %q, got %q, want %q", test.in, got, test.addr)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"example.com",
+		"john doe@example.com",
+		"user@",
+		"@example.com",
+		"a..b@example.com",
+		"user@-example.com",
+		"user@exa_mple.com",
+		"user@example..com",
+		"user@" + strings.Repeat("a", 64) + ".com",
+		strings.Repeat("a", 65) + "@example.com",
+		"user@[300.0.2.1]",
+		"user@[2001:db8::1]",
+	} {
+		if a, err := ParseAddress(in); err == nil {
+			t.Errorf("ParseAddress(%q) should fail, got %#v", in, a)
+		}
+	}
+}
+
+func TestSetAddresses(t *testing.T) {
+	m := NewMessage()
+	from, err := ParseAddress("Señor From <from@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAddresses("From", from); err != nil {
+		t.Fatal(err)
+	}
+	to := Address{Name: "Doe, John", LocalPart: "john", Domain: "example.com"}
+	if err := m.SetAddresses("To", to, Address{LocalPart: "to", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	m.SetBody("text/plain", "Test")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"john@example.com", "to@example.com"},
+		content: "From: =?UTF-8?q?Se=C3=B1or_From?= <from@example.com>\r\n" +
+			`To: "Doe, John" <john@example.com>, to@example.com` + "\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test",
+	}
+	testMessage(t, m, 0, want)
+
+	if err := m.SetAddresses("Cc", Address{LocalPart: "cc", Domain: "exa mple.com"}); err == nil {
+		t.Error("expected an error with an invalid domain")
+	}
+	if got := m.GetHeader("Cc"); len(got) != 0 {
+		t.Errorf("the field should not be set with an invalid address, got %q", got)
+	}
+	quoted := Address{Name: "Doe, John", LocalPart: "john doe", Domain: "example.com"}
+	if got := quoted.String(); got != `"Doe, John" <"john doe"@example.com>` {
+		t.Errorf("invalid String, got %q", got)
+	}
+	for _, a := range []Address{from, to, {LocalPart: "to", Domain: "example.com"}, {Name: "Jöhn (Doe)", LocalPart: "j", Domain: "example.com"}} {
+		if got, want := a.String(), NewMessage().FormatAddress(a.Addr(), a.Name); got != want {
+			t.Errorf("String should format like FormatAddress, got %q, want %q", got, want)
+		}
+	}
+	if err := m.SetFrom("from@exa_mple.com"); err == nil {
+		t.Error("SetFrom should validate the domain")
+	}
+}
@@ -0,0 +1,329 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARCSigner is a HeaderSigner adding an ARC set to messages, as defined in
+// RFC 8617, so the authentication results of an intermediary forwarding them
+// are preserved. The ARC-Authentication-Results, ARC-Message-Signature and
+// ARC-Seal header fields are prepended to the message with the next instance
+// number of the chain.
+//
+// The signatures use the rsa-sha256 algorithm and the relaxed
+// canonicalization, the ARC-Message-Signature and ARC-Seal header fields must
+// not be modified afterwards, other than by folding whitespace.
+type ARCSigner struct {
+	// Domain is the signing domain (d=).
+	Domain string
+	// Selector is the selector (s=) of the public key in the DNS of Domain.
+	Selector string
+	// PrivateKey is an RSA private key.
+	PrivateKey crypto.Signer
+	// AuthenticationResults is the value of the ARC-Authentication-Results
+	// header field after its instance tag: the authserv-id of the
+	// intermediary followed by the results of the authentication of the
+	// message as received, like in an Authentication-Results header field
+	// defined in RFC 8601, for example
+	// "mx.example.org; spf=pass smtp.mailfrom=example.com".
+	AuthenticationResults string
+	// ChainValidation is the result of the validation of the ARC sets
+	// already in the message, "pass" or "fail". It is required when the
+	// message already has ARC sets and ignored otherwise.
+	ChainValidation string
+	// Headers are the names of the header fields signed by the
+	// ARC-Message-Signature. Defaults to the fields of DefaultARCHeaders
+	// present in the message. The From field is always signed.
+	Headers []string
+}
+
+// DefaultARCHeaders are the header fields signed by ARCSigner by default.
+var DefaultARCHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+// maxARCInstance is the maximum number of ARC sets of a message.
+const maxARCInstance = 50
+
+// NewARCSigner returns an ARCSigner signing with the given key, published with
+// selector in the DNS of domain, and adding the given authentication results.
+func NewARCSigner(domain, selector string, key crypto.Signer, authResults string) *ARCSigner {
+	return &ARCSigner{
+		Domain:                domain,
+		Selector:              selector,
+		PrivateKey:            key,
+		AuthenticationResults: authResults,
+	}
+}
+
+// SignHeader implements HeaderSigner. The t= tags are set to the current
+// time, or to the time of the clock of the message set with SetClock when the
+// ARCSigner is used with SetHeaderSigners.
+func (s *ARCSigner) SignHeader(message []byte) ([]byte, error) {
+	return s.signHeaderAt(message, now())
+}
+
+func (s *ARCSigner) signHeaderAt(message []byte, at time.Time) ([]byte, error) {
+	if s.PrivateKey == nil || s.Domain == "" || s.Selector == "" {
+		return nil, errors.New("gomail: ARCSigner requires a private key, a domain and a selector")
+	}
+	if _, ok := s.PrivateKey.Public().(*rsa.PublicKey); !ok {
+		return nil, errors.New("gomail: ARCSigner only supports RSA keys")
+	}
+
+	fields, body := splitMessage(message)
+	sets, err := arcSets(fields)
+	if err != nil {
+		return nil, err
+	}
+	i := len(sets) + 1
+	if i > maxARCInstance {
+		return nil, fmt.Errorf("gomail: the message already has %d ARC sets", len(sets))
+	}
+	cv := "none"
+	if i > 1 {
+		switch cv = s.ChainValidation; cv {
+		case "pass", "fail":
+		default:
+			return nil, fmt.Errorf("gomail: invalid ARC chain validation result %q", cv)
+		}
+	}
+
+	aar := "ARC-Authentication-Results: i=" + strconv.Itoa(i) + "; " + s.AuthenticationResults + "\r\n"
+
+	names, err := s.signedHeaders(fields)
+	if err != nil {
+		return nil, err
+	}
+	bh := sha256.Sum256(relaxedBody(body))
+	t := strconv.FormatInt(at.Unix(), 10)
+	ams := "ARC-Message-Signature: i=" + strconv.Itoa(i) + "; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+		" d=" + s.Domain + "; s=" + s.Selector + "; t=" + t + ";\r\n" +
+		" h=" + strings.Join(names, ":") + ";\r\n" +
+		" bh=" + base64.StdEncoding.EncodeToString(bh[:]) + ";\r\n" +
+		" b="
+	var h bytes.Buffer
+	for _, f := range selectHeaders(fields, names) {
+		h.WriteString(relaxedHeader(f))
+	}
+	if ams, err = s.sign(&h, ams); err != nil {
+		return nil, err
+	}
+
+	seal := "ARC-Seal: i=" + strconv.Itoa(i) + "; a=rsa-sha256; t=" + t + "; cv=" + cv + ";\r\n" +
+		" d=" + s.Domain + "; s=" + s.Selector + ";\r\n" +
+		" b="
+	h.Reset()
+	for _, set := range append(sets, arcSet{aar, ams, ""}) {
+		h.WriteString(relaxedHeader(set.results))
+		h.WriteString(relaxedHeader(set.signature))
+		if set.seal != "" {
+			h.WriteString(relaxedHeader(set.seal))
+		}
+	}
+	if seal, err = s.sign(&h, seal); err != nil {
+		return nil, err
+	}
+
+	return []byte(seal + ams + aar), nil
+}
+
+// sign completes the header field f, whose value ends with an empty b= tag,
+// with the signature of the canonicalized header fields in h followed by f.
+func (s *ARCSigner) sign(h *bytes.Buffer, f string) (string, error) {
+	h.WriteString(strings.TrimSuffix(relaxedHeader(f), "\r\n"))
+	digest := sha256.Sum256(h.Bytes())
+	sig, err := s.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("gomail: ARC signature failed: %w", err)
+	}
+	return f + base64.StdEncoding.EncodeToString(sig) + "\r\n", nil
+}
+
+// signedHeaders returns the lowercased names of the header fields signed by
+// the ARC-Message-Signature, once for each instance of the field.
+func (s *ARCSigner) signedHeaders(fields []string) ([]string, error) {
+	list := s.Headers
+	if list == nil {
+		list = DefaultARCHeaders
+	}
+	var names []string
+	hasFrom := false
+	for _, name := range list {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "arc-") {
+			continue
+		}
+		for _, f := range fields {
+			if headerName(f) == name {
+				names = append(names, name)
+				hasFrom = hasFrom || name == "from"
+			}
+		}
+	}
+	if !hasFrom {
+		return nil, errors.New(`gomail: ARCSigner requires a "From" field`)
+	}
+	return names, nil
+}
+
+// arcSet holds the header fields of an ARC set of a message.
+type arcSet struct {
+	results, signature, seal string
+}
+
+// arcSets returns the ARC sets of the message header fields, ordered by
+// instance.
+func arcSets(fields []string) ([]arcSet, error) {
+	var sets []arcSet
+	for _, f := range fields {
+		var field *string
+		i := arcInstance(f)
+		if i == 0 {
+			continue
+		}
+		if i < 0 || i > maxARCInstance {
+			return nil, fmt.Errorf("gomail: invalid ARC header field %q", f)
+		}
+		for len(sets) < i {
+			sets = append(sets, arcSet{})
+		}
+		switch headerName(f) {
+		case "arc-authentication-results":
+			field = &sets[i-1].results
+		case "arc-message-signature":
+			field = &sets[i-1].signature
+		case "arc-seal":
+			field = &sets[i-1].seal
+		}
+		if *field != "" {
+			return nil, fmt.Errorf("gomail: duplicate ARC header field %q", f)
+		}
+		*field = f
+	}
+	for i, set := range sets {
+		if set.results == "" || set.signature == "" || set.seal == "" {
+			return nil, fmt.Errorf("gomail: incomplete ARC set %d", i+1)
+		}
+	}
+	return sets, nil
+}
+
+// arcInstance returns the value of the instance tag of an ARC header field, 0
+// if f is not an ARC header field and -1 if its instance tag is invalid.
+func arcInstance(f string) int {
+	switch headerName(f) {
+	case "arc-authentication-results", "arc-message-signature", "arc-seal":
+	default:
+		return 0
+	}
+	for _, tag := range strings.Split(f[strings.IndexByte(f, ':')+1:], ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if ok && strings.TrimSpace(k) == "i" {
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || i < 1 {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// splitMessage returns the header fields of the message, with their CRLF and
+// folding, and its body.
+func splitMessage(message []byte) ([]string, []byte) {
+	header, body := message, []byte(nil)
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i != -1 {
+		header, body = message[:i+2], message[i+4:]
+	}
+
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return fields, body
+}
+
+// headerName returns the lowercased name of the header field f.
+func headerName(f string) string {
+	i := strings.IndexByte(f, ':')
+	if i == -1 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimRight(f[:i], " \t"))
+}
+
+// selectHeaders returns the header fields signed for the given names: the
+// instances of a field are selected from the bottom of the header, as defined
+// in RFC 6376, section 5.4.2.
+func selectHeaders(fields, names []string) []string {
+	used := make(map[int]bool)
+	selected := make([]string, 0, len(names))
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && headerName(fields[i]) == name {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// relaxedHeader returns the header field f with the relaxed canonicalization
+// defined in RFC 6376, section 3.4.2.
+func relaxedHeader(f string) string {
+	value := strings.ReplaceAll(f[strings.IndexByte(f, ':')+1:], "\r\n", "")
+	return headerName(f) + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ") + "\r\n"
+}
+
+// relaxedBody returns the body with the relaxed canonicalization defined in
+// RFC 6376, section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := bytes.Split(body, []byte("\r\n"))
+	var buf bytes.Buffer
+	empty := 0
+	for _, line := range lines {
+		line = bytes.TrimRightFunc(line, isWSP)
+		if len(line) == 0 {
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			buf.WriteString("\r\n")
+		}
+		for i, word := range bytes.FieldsFunc(line, isWSP) {
+			if i > 0 || isWSP(rune(line[0])) {
+				buf.WriteByte(' ')
+			}
+			buf.Write(word)
+		}
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
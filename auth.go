@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/smtp"
+	"unicode/utf8"
 )
 
 // loginAuth is an smtp.Auth that implements the LOGIN authentication mechanism.
@@ -47,3 +48,95 @@ func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 		return nil, fmt.Errorf("gomail: unexpected server challenge: %q", fromServer)
 	}
 }
+
+// plainAuth is an smtp.Auth that implements the PLAIN authentication
+// mechanism like smtp.PlainAuth. The credentials are sent as the initial
+// response of the AUTH command, or after the first server challenge with
+// servers that do not support initial responses.
+type plainAuth struct {
+	identity string
+	username string
+	password string
+	host     string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like smtp.PlainAuth, only send the credentials over an encrypted
+	// connection or to localhost.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("gomail: unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("gomail: wrong host name")
+	}
+	return "PLAIN", a.credentials(), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	if len(fromServer) != 0 {
+		return nil, fmt.Errorf("gomail: unexpected server challenge: %q", fromServer)
+	}
+	// The server ignored the initial response and asks for the credentials.
+	return a.credentials(), nil
+}
+
+func (a *plainAuth) credentials() []byte {
+	return []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// ExternalAuth returns an smtp.Auth that implements the EXTERNAL mechanism
+// defined in RFC 4422, the client is authenticated by external means such as a
+// TLS client certificate. The authorization identity is usually empty, so the
+// server derives it from the credentials.
+func ExternalAuth(identity string) smtp.Auth {
+	return &externalAuth{identity: identity}
+}
+
+type externalAuth struct {
+	identity string
+}
+
+func (a *externalAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "EXTERNAL", []byte(a.identity), nil
+}
+
+func (a *externalAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server asks for the identity when the initial response is empty.
+		return []byte(a.identity), nil
+	}
+	return nil, nil
+}
+
+// AnonymousAuth returns an smtp.Auth that implements the ANONYMOUS mechanism
+// defined in RFC 4505, for servers allowing anonymous submission. The trace
+// is an optional email address or string of at most 255 characters
+// identifying the client. It is never chosen automatically by the Dialer.
+func AnonymousAuth(trace string) smtp.Auth {
+	return &anonymousAuth{trace: trace}
+}
+
+type anonymousAuth struct {
+	trace string
+}
+
+func (a *anonymousAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if utf8.RuneCountInString(a.trace) > 255 {
+		return "", nil, errors.New("gomail: anonymous trace longer than 255 characters")
+	}
+	return "ANONYMOUS", []byte(a.trace), nil
+}
+
+func (a *anonymousAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte(a.trace), nil
+	}
+	return nil, nil
+}
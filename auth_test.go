@@ -1,7 +1,11 @@
 package mail
 
 import (
+	"encoding/base64"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 	"testing"
 )
 
@@ -98,3 +102,132 @@ func testLoginAuth(t *testing.T, test *authTest) {
 		}
 	}
 }
+
+// testAuthExchange authenticates with auth to a fake server advertising the
+// mechanisms in auths. The server expects the lines in want and answers each
+// of them with the reply at the same index.
+func testAuthExchange(t *testing.T, auth smtp.Auth, auths string, want, replies []string) {
+	testAuthExchangeEHLO(t, auth, "AUTH "+auths, want, replies)
+}
+
+// testAuthExchangeEHLO works like testAuthExchange with a server advertising
+// the ext extension.
+func testAuthExchangeEHLO(t *testing.T, auth smtp.Auth, ext string, want, replies []string) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer serverConn.Close()
+		tc := textproto.NewConn(serverConn)
+		tc.PrintfLine("220 %s ESMTP", testHost)
+		if _, err := tc.ReadLine(); err != nil { // EHLO
+			t.Error(err)
+			return
+		}
+		tc.PrintfLine("250-%s\r\n250 %s", testHost, ext)
+		for i, w := range want {
+			line, err := tc.ReadLine()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if line != w {
+				t.Errorf("invalid command, got %q, want %q", line, w)
+			}
+			tc.PrintfLine("%s", replies[i])
+		}
+	}()
+
+	c, err := newSMTPClient(clientConn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(auth); err != nil {
+		t.Error(err)
+	}
+	clientConn.Close()
+	<-done
+}
+
+func TestObsoleteAuthExtension(t *testing.T) {
+	tests := []struct {
+		ehlo, want string
+		ok         bool
+	}{
+		{"250-AUTH LOGIN PLAIN XOAUTH2\r\n250 AUTH=LOGIN PLAIN", "LOGIN PLAIN XOAUTH2", true},
+		{"250 AUTH=PLAIN", "PLAIN", true},
+		{"250 AUTH=LOGIN PLAIN", "LOGIN PLAIN", true},
+		{"250 8BITMIME", "", false},
+	}
+	for _, test := range tests {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			tc := textproto.NewConn(serverConn)
+			tc.PrintfLine("220 %s ESMTP", testHost)
+			tc.ReadLine()
+			tc.PrintfLine("250-%s\r\n%s", testHost, test.ehlo)
+		}()
+
+		c, err := newSMTPClient(clientConn, testHost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, auths := c.Extension("AUTH"); ok != test.ok || auths != test.want {
+			t.Errorf("invalid AUTH extension for %q, got %v %q, want %v %q",
+				test.ehlo, ok, auths, test.ok, test.want)
+		}
+		clientConn.Close()
+	}
+}
+
+func TestExternalAuth(t *testing.T) {
+	testAuthExchange(t, ExternalAuth("admin"), "PLAIN EXTERNAL",
+		[]string{"AUTH EXTERNAL YWRtaW4="},
+		[]string{"235 2.7.0 Authentication successful"})
+
+	testAuthExchange(t, ExternalAuth(""), "EXTERNAL",
+		[]string{"AUTH EXTERNAL", ""},
+		[]string{"334 ", "235 2.7.0 Authentication successful"})
+}
+
+func TestAnonymousAuth(t *testing.T) {
+	testAuthExchange(t, AnonymousAuth("sirhc@example.com"), "ANONYMOUS",
+		[]string{"AUTH ANONYMOUS c2lyaGNAZXhhbXBsZS5jb20="},
+		[]string{"235 2.7.0 Authentication successful"})
+
+	testAuthExchange(t, AnonymousAuth(""), "ANONYMOUS",
+		[]string{"AUTH ANONYMOUS", ""},
+		[]string{"334 ", "235 2.7.0 Authentication successful"})
+
+	if _, _, err := AnonymousAuth(strings.Repeat("a", 256)).Start(&smtp.ServerInfo{}); err == nil {
+		t.Error("expected an error with a trace longer than 255 characters")
+	}
+}
+
+func TestPlainAuth(t *testing.T) {
+	auth := &plainAuth{username: testUser, password: testPwd, host: "localhost"}
+	testAuthExchange(t, auth, "LOGIN PLAIN",
+		[]string{"AUTH PLAIN AHVzZXIAcHdk"},
+		[]string{"235 2.7.0 Authentication successful"})
+
+	// Servers only advertising the obsolete AUTH= form may not support
+	// initial responses.
+	testAuthExchangeEHLO(t, auth, "AUTH=LOGIN PLAIN",
+		[]string{"AUTH PLAIN", "AHVzZXIAcHdk"},
+		[]string{"334 ", "235 2.7.0 Authentication successful"})
+
+	long := &plainAuth{username: testUser, password: strings.Repeat("a", 400), host: "localhost"}
+	testAuthExchange(t, long, "PLAIN",
+		[]string{"AUTH PLAIN", base64.StdEncoding.EncodeToString(long.credentials())},
+		[]string{"334 ", "235 2.7.0 Authentication successful"})
+
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "localhost"}); err != nil {
+		t.Errorf("PLAIN should be allowed to localhost, got %v", err)
+	}
+	if _, _, err := (&plainAuth{host: testHost}).Start(&smtp.ServerInfo{Name: testHost}); err == nil {
+		t.Error("expected an error with an unencrypted connection")
+	}
+}
@@ -0,0 +1,97 @@
+package mail
+
+import (
+	"context"
+	"sync"
+)
+
+// BatchSender sends many messages concurrently over several connections. Each
+// connection is reused to send several messages.
+type BatchSender struct {
+	// Dial opens a new connection, Dialer.Dial is typically used.
+	Dial func(ctx context.Context) (SendCloser, error)
+	// Concurrency is the maximum number of connections opened at the same
+	// time. Defaults to 1.
+	Concurrency int
+}
+
+// NewBatchSender returns a BatchSender sending messages over at most
+// concurrency connections opened with d.
+func NewBatchSender(d *Dialer, concurrency int) *BatchSender {
+	return &BatchSender{
+		Dial:        d.Dial,
+		Concurrency: concurrency,
+	}
+}
+
+// SendBatch sends the messages and returns the error of each message, the
+// error at index i is nil when msg[i] was sent successfully.
+//
+// When ctx is canceled, the messages being sent are completed and the
+// remaining messages are not sent, their error is the error of the context.
+// After a failed message the connection is closed and a new one is opened for
+// the next message.
+func (b *BatchSender) SendBatch(ctx context.Context, msg ...*Message) []error {
+	errs := make([]error, len(msg))
+
+	n := b.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	if n > len(msg) {
+		n = len(msg)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			b.work(ctx, msg, errs, jobs)
+		}()
+	}
+
+	i := 0
+dispatch:
+	for ; i < len(msg); i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	for ; i < len(msg); i++ {
+		errs[i] = ctx.Err()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (b *BatchSender) work(ctx context.Context, msg []*Message, errs []error, jobs <-chan int) {
+	var s SendCloser
+	defer func() {
+		if s != nil {
+			s.Close()
+		}
+	}()
+
+	for i := range jobs {
+		if s == nil {
+			var err error
+			if s, err = b.Dial(ctx); err != nil {
+				s = nil
+				errs[i] = err
+				continue
+			}
+		}
+
+		if err := send(ctx, s, msg[i]); err != nil {
+			errs[i] = err
+			s.Close()
+			s = nil
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type batchStats struct {
+	mu      sync.Mutex
+	dials   int
+	active  int
+	maxOpen int
+	sent    map[string]int
+}
+
+func (s *batchStats) dial(ctx context.Context) (SendCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dials++
+	s.active++
+	if s.active > s.maxOpen {
+		s.maxOpen = s.active
+	}
+
+	return &mockSendCloser{
+		mockSender: func(_ context.Context, _ string, to []string, m io.WriterTo) error {
+			time.Sleep(time.Millisecond)
+			if _, err := m.WriteTo(ioutil.Discard); err != nil {
+				return err
+			}
+			if to[0] == "fail@example.com" {
+				return errors.New("kaboom")
+			}
+			s.mu.Lock()
+			s.sent[to[0]]++
+			s.mu.Unlock()
+			return nil
+		},
+		close: func() error {
+			s.mu.Lock()
+			s.active--
+			s.mu.Unlock()
+			return nil
+		},
+	}, nil
+}
+
+func getBatchMessages(n int) []*Message {
+	msgs := make([]*Message, n)
+	for i := range msgs {
+		m := NewMessage()
+		m.SetHeader("From", testFrom)
+		m.SetHeader("To", "to"+string(rune('a'+i%26))+string(rune('a'+i/26))+"@example.com")
+		m.SetBody("text/plain", testBody)
+		msgs[i] = m
+	}
+	return msgs
+}
+
+func TestSendBatch(t *testing.T) {
+	stats := &batchStats{sent: make(map[string]int)}
+	b := &BatchSender{Dial: stats.dial, Concurrency: 4}
+
+	msgs := getBatchMessages(100)
+	msgs[10].SetHeader("To", "fail@example.com")
+	errs := b.SendBatch(context.Background(), msgs...)
+
+	if len(errs) != len(msgs) {
+		t.Fatalf("invalid number of errors, got %d, want %d", len(errs), len(msgs))
+	}
+	for i, err := range errs {
+		if (err != nil) != (i == 10) {
+			t.Errorf("invalid error for message %d: %v", i, err)
+		}
+	}
+	if len(stats.sent) != 99 {
+		t.Errorf("invalid number of messages sent, got %d, want 99", len(stats.sent))
+	}
+	for to, n := range stats.sent {
+		if n != 1 {
+			t.Errorf("message to %s sent %d times", to, n)
+		}
+	}
+	if stats.maxOpen > 4 {
+		t.Errorf("too many connections opened at the same time: %d", stats.maxOpen)
+	}
+	if stats.dials < 4 || stats.dials > 5 {
+		t.Errorf("connections should be reused, got %d dials", stats.dials)
+	}
+	if stats.active != 0 {
+		t.Errorf("%d connections left open", stats.active)
+	}
+}
+
+func TestSendBatchCancel(t *testing.T) {
+	stats := &batchStats{sent: make(map[string]int)}
+	ctx, cancel := context.WithCancel(context.Background())
+	var n int32
+	b := &BatchSender{
+		Dial: func(ctx context.Context) (SendCloser, error) {
+			s, err := stats.dial(ctx)
+			sc := s.(*mockSendCloser)
+			send := sc.mockSender
+			sc.mockSender = func(ctx context.Context, from string, to []string, m io.WriterTo) error {
+				if atomic.AddInt32(&n, 1) == 5 {
+					cancel()
+				}
+				return send(ctx, from, to, m)
+			}
+			return sc, err
+		},
+		Concurrency: 2,
+	}
+
+	errs := b.SendBatch(ctx, getBatchMessages(50)...)
+	canceled := 0
+	for _, err := range errs {
+		if errors.Is(err, context.Canceled) {
+			canceled++
+		} else if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if canceled == 0 || len(stats.sent)+canceled != 50 {
+		t.Errorf("invalid result, %d messages sent and %d canceled", len(stats.sent), canceled)
+	}
+	if stats.active != 0 {
+		t.Errorf("%d connections left open", stats.active)
+	}
+}
+
+func TestSendBatchDialError(t *testing.T) {
+	b := &BatchSender{Dial: func(ctx context.Context) (SendCloser, error) {
+		return nil, errors.New("dial error")
+	}}
+	for i, err := range b.SendBatch(context.Background(), getBatchMessages(3)...) {
+		if err == nil {
+			t.Errorf("expected a dial error for message %d", i)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// A Resolver looks up DNS records, it is implemented by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+func (d *Dialer) resolver() Resolver {
+	if d.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.Resolver
+}
+
+// dialContext opens a connection with DialProxy, or from LocalAddr when set.
+func (d *Dialer) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.LocalAddr != nil {
+		return d.netDialer().DialContext(ctx, network, address)
+	}
+	return d.DialProxy(ctx, network, address)
+}
+
+// netDialer returns the net.Dialer used when LocalAddr is set.
+func (d *Dialer) netDialer() *net.Dialer {
+	return &net.Dialer{LocalAddr: d.LocalAddr}
+}
+
+// happyEyeballsDelay is the delay before the next address is tried when
+// HappyEyeballs is set, RFC 8305 recommends 250ms.
+var happyEyeballsDelay = 250 * time.Millisecond
+
+// dialConn opens the connection to the SMTP server.
+func (d *Dialer) dialConn(ctx context.Context) (net.Conn, error) {
+	switch {
+	case d.Network == "unix":
+		return d.dialContext(ctx, "unix", d.Host)
+	case d.Network != "":
+		return d.dialContext(ctx, d.Network, addr(d.Host, d.Port))
+	case !d.HappyEyeballs:
+		return d.dialContext(ctx, "tcp", addr(d.Host, d.Port))
+	}
+	return d.dialHappyEyeballs(ctx)
+}
+
+// dialHappyEyeballs resolves the host and races connections to its addresses,
+// alternating IPv6 and IPv4, as described in RFC 8305. A new attempt starts
+// every happyEyeballsDelay or as soon as the previous one fails, the first
+// connection established is returned and the other ones are closed.
+func (d *Dialer) dialHappyEyeballs(ctx context.Context) (net.Conn, error) {
+	ips, err := d.resolver().LookupIPAddr(ctx, d.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("gomail: no addresses found for %q", d.Host)
+	}
+	addrs := interleaveIPs(ips)
+	port := strconv.Itoa(d.Port)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		address := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialContext(ctx, "tcp", address)
+			results <- result{conn, err}
+		}()
+	}
+	// closeLate closes the connections established after the first one.
+	closeLate := func() {
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(pending)
+	}
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	start()
+
+	var firstErr error
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				closeLate()
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				resetTimer(timer, happyEyeballsDelay)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-ctx.Done():
+			closeLate()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// resetTimer resets a timer which may have fired without its value being
+// received, so that the stale value does not trigger the next attempt early.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// interleaveIPs returns the addresses alternating IPv6 and IPv4 addresses,
+// starting with IPv6, and otherwise keeping their order. The zones of the
+// IPv6 addresses are kept.
+func interleaveIPs(ips []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,329 @@
+package mail
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver is a Resolver returning the IP addresses ips and the MX
+// records returned by mx.
+type stubResolver struct {
+	t   *testing.T
+	ips []string
+	mx  func(name string) ([]*net.MX, error)
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host != testHost {
+		r.t.Errorf("invalid host, got %q, want %q", host, testHost)
+	}
+	addrs := make([]net.IPAddr, len(r.ips))
+	for i, ip := range r.ips {
+		ip, zone, _ := strings.Cut(ip, "%")
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip), Zone: zone}
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.mx(name)
+}
+
+func TestHappyEyeballs(t *testing.T) {
+
+	var mu sync.Mutex
+	var dialed []string
+	canceled := make(chan struct{})
+	d := &Dialer{
+		Host:          testHost,
+		Port:          testPort,
+		HappyEyeballs: true,
+		Resolver:      &stubResolver{t: t, ips: []string{"192.0.2.1", "2001:db8::1"}},
+	}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		if address == "[2001:db8::1]:587" {
+			// Broken IPv6, the connection hangs.
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	start := time.Now()
+	conn, err := d.dialConn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the dead address should not stall the dial, took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("the attempt to the dead address should be canceled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 2 || dialed[0] != "[2001:db8::1]:587" || dialed[1] != "192.0.2.1:587" {
+		t.Errorf("IPv6 should be tried first, got %v", dialed)
+	}
+}
+
+func TestHappyEyeballsErrors(t *testing.T) {
+	n := 0
+	d := &Dialer{
+		Host:          testHost,
+		Port:          testPort,
+		HappyEyeballs: true,
+		Resolver:      &stubResolver{t: t, ips: []string{"2001:db8::1", "2001:db8::2", "192.0.2.1"}},
+	}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		n++
+		return nil, errors.New("connection refused")
+	}
+	if _, err := d.dialConn(context.Background()); err == nil || err.Error() != "connection refused" {
+		t.Errorf("expected the error of the first attempt, got %v", err)
+	}
+	if n != 3 {
+		t.Errorf("all the addresses should be tried, got %d attempts", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if _, err := d.dialConn(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the error of the context, got %v", err)
+	}
+}
+
+func TestHappyEyeballsAddresses(t *testing.T) {
+	d := &Dialer{
+		Host:          testHost,
+		Port:          testPort,
+		HappyEyeballs: true,
+		Resolver:      &stubResolver{t: t},
+	}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		t.Errorf("no address should be dialed, got %q", address)
+		return nil, errors.New("unexpected dial")
+	}
+	if _, err := d.dialConn(context.Background()); err == nil || !strings.Contains(err.Error(), "no addresses") {
+		t.Errorf("expected an error without addresses, got %v", err)
+	}
+
+	var dialed string
+	d.Resolver = &stubResolver{t: t, ips: []string{"fe80::1%eth0"}}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = address
+		return nil, errors.New("connection refused")
+	}
+	d.dialConn(context.Background())
+	if want := "[fe80::1%eth0]:587"; dialed != want {
+		t.Errorf("the zone should be kept, got %q, want %q", dialed, want)
+	}
+}
+
+func TestResetTimer(t *testing.T) {
+	timer := time.NewTimer(time.Millisecond)
+	defer timer.Stop()
+	time.Sleep(20 * time.Millisecond)
+	resetTimer(timer, time.Hour)
+	select {
+	case <-timer.C:
+		t.Error("the timer should not fire with the value of the previous period")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestInterleaveIPs(t *testing.T) {
+	var ips []net.IPAddr
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3"} {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	got := interleaveIPs(ips)
+	want := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	for i := range want {
+		if i >= len(got) || got[i].String() != want[i] {
+			t.Fatalf("invalid order, got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestDialerResolver(t *testing.T) {
+	d := new(Dialer)
+	if d.resolver() != net.DefaultResolver {
+		t.Error("the default resolver should be net.DefaultResolver")
+	}
+	r := &stubResolver{t: t}
+	if d.Resolver = r; d.resolver() != r {
+		t.Error("the resolver of the Dialer should be used")
+	}
+}
+
+// smtpSession is what a client sent to the server started by serveSMTP.
+type smtpSession struct {
+	commands []string
+	// data is the content sent with DATA or BDAT, as transmitted.
+	data []byte
+}
+
+// serveSMTP runs a minimal SMTP server advertising the extensions ext on the
+// first connection accepted by l, and returns the session once the client
+// quits.
+func serveSMTP(t *testing.T, l net.Listener, ext ...string) <-chan smtpSession {
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		var s smtpSession
+		defer func() { sessions <- s }()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			s.commands = append(s.commands, line)
+			switch args := strings.Fields(line); strings.ToUpper(args[0]) {
+			case "EHLO":
+				reply := "250-localhost\r\n"
+				for _, e := range ext {
+					reply += "250-" + e + "\r\n"
+				}
+				c.PrintfLine("%s250 AUTH PLAIN", reply)
+			case "AUTH":
+				c.PrintfLine("235 Authenticated")
+			case "DATA":
+				c.PrintfLine("354 Go ahead")
+				// Keep the data as sent, with its dot-stuffing.
+				for {
+					line, err := c.R.ReadSlice('\n')
+					if err != nil {
+						return
+					}
+					if string(line) == ".\r\n" {
+						break
+					}
+					s.data = append(s.data, line...)
+				}
+				c.PrintfLine("250 Queued")
+			case "BDAT":
+				n, _ := strconv.Atoi(args[1])
+				chunk := make([]byte, n)
+				if _, err := io.ReadFull(c.R, chunk); err != nil {
+					return
+				}
+				s.data = append(s.data, chunk...)
+				c.PrintfLine("250 OK")
+			case "HELP":
+				c.PrintfLine("214-Commands supported:\r\n214 EHLO MAIL RCPT DATA QUIT")
+			case "QUIT":
+				c.PrintfLine("221 Bye")
+				return
+			default:
+				c.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return sessions
+}
+
+func TestDialerUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailgo-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "smtp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+	defer l.Close()
+	session := serveSMTP(t, l)
+
+	d := NewUnixDialer(path, testUser, testPwd)
+	var network, address string
+	dial := d.DialProxy
+	d.DialProxy = func(ctx context.Context, n, a string) (net.Conn, error) {
+		network, address = n, a
+		return dial(ctx, n, a)
+	}
+	if err := d.DialAndSend(context.Background(), getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if network != "unix" || address != path {
+		t.Errorf("invalid dial, got %s %q, want unix %q", network, address, path)
+	}
+
+	want := []string{
+		"EHLO localhost",
+		"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00"+testUser+"\x00"+testPwd)),
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RCPT TO:<" + testTo2 + ">",
+		"DATA",
+		"QUIT",
+	}
+	got := (<-session).commands
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("invalid SMTP commands, got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDialerLocalAddr(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	d := NewDialer("127.0.0.1", 0, testUser, testPwd)
+	d.LocalAddr = local
+	if got := d.netDialer().LocalAddr; got != local {
+		t.Errorf("invalid net.Dialer LocalAddr, got %v, want %v", got, local)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d.Port = l.Addr().(*net.TCPAddr).Port
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		t.Error("DialProxy should not be used with LocalAddr")
+		return nil, errors.New("unexpected dial")
+	}
+
+	conn, err := d.dialConn(context.Background())
+	if err != nil {
+		t.Skipf("cannot bind to %v: %v", local, err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(local.IP) {
+		t.Errorf("invalid local address, got %v, want %v", ip, local.IP)
+	}
+}
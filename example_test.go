@@ -6,6 +6,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	texttemplate "text/template"
 	"time"
 
 	mail "github.com/SchumacherFM/mailgo"
@@ -208,6 +209,20 @@ func ExampleMessage_SetBodyWriter() {
 	})
 }
 
+func ExampleTemplate() {
+	tpl := &mail.Template{
+		Subject: texttemplate.Must(texttemplate.New("subject").Parse("Welcome {{.}}")),
+		Text:    texttemplate.Must(texttemplate.New("text").Parse("Hello {{.}}!")),
+		HTML:    template.Must(template.New("html").Parse("<b>Hello {{.}}!</b>")),
+	}
+	m, err := tpl.Message("Bob")
+	if err != nil {
+		panic(err)
+	}
+	m.SetHeader("From", "alex@example.com")
+	m.SetHeader("To", "bob@example.com")
+}
+
 func ExampleMessage_SetDateHeader() {
 	m.SetDateHeader("X-Date", time.Now())
 }
@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+)
+
+// FailoverSender is a SendCloser sending each message through the first of its
+// Dialers accepting it, for example a primary relay followed by its backups.
+// The next Dialer is tried when the connection, the TLS negotiation or the
+// authentication fails or when the server rejects the message temporarily. A
+// permanent rejection of the mail transaction, with a 5xx reply code, is
+// returned without trying the next Dialers since they would most likely
+// reject the message too.
+type FailoverSender struct {
+	// Dialers are the Dialers tried in order.
+	Dialers []*Dialer
+}
+
+// NewFailoverSender returns a FailoverSender trying the given Dialers in order.
+func NewFailoverSender(d ...*Dialer) *FailoverSender {
+	return &FailoverSender{Dialers: d}
+}
+
+// Send implements Sender. A connection is opened for each message, the
+// returned error joins the errors of the Dialers that were tried.
+func (s *FailoverSender) Send(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	if len(s.Dialers) == 0 {
+		return errors.New("gomail: FailoverSender has no Dialer")
+	}
+
+	var errs []error
+	for _, d := range s.Dialers {
+		permanent, err := s.send(ctx, d, from, to, msg)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("gomail: could not send through %s: %w", addr(d.Host, d.Port), err))
+		if ctx.Err() != nil || permanent {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send sends the message through d and reports whether the error is a
+// permanent rejection of the transaction. The errors of Dial never are, even
+// with a 5xx reply, since another relay has its own credentials and policy.
+func (s *FailoverSender) send(ctx context.Context, d *Dialer, from string, to []string, msg io.WriterTo) (bool, error) {
+	sc, err := d.Dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	err = sc.Send(ctx, from, to, msg)
+	permanent := isPermanentError(err)
+	if cerr := sc.Close(); err == nil {
+		err = cerr
+	}
+	return permanent, err
+}
+
+// DialAndSend sends the messages like Dialer.DialAndSend, each one through the
+// first Dialer accepting it.
+func (s *FailoverSender) DialAndSend(ctx context.Context, m ...*Message) error {
+	return Send(ctx, s, m...)
+}
+
+// Close implements SendCloser, it does nothing as a connection is opened for
+// each message.
+func (s *FailoverSender) Close() error {
+	return nil
+}
+
+// isPermanentError reports whether err holds a reply of the server with a 5xx
+// code.
+func isPermanentError(err error) bool {
+	var terr *textproto.Error
+	return errors.As(err, &terr) && terr.Code >= 500 && terr.Code < 600
+}
@@ -0,0 +1,121 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// rejectingDialer returns a Dialer connecting to a server replying reply to
+// the command cmd.
+func rejectingDialer(t *testing.T, host, cmd, reply string) *Dialer {
+	d := &Dialer{Host: host, Port: 25, StartTLSPolicy: NoStartTLS}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			c := textproto.NewConn(server)
+			c.PrintfLine("220 %s ESMTP", host)
+			for {
+				line, err := c.ReadLine()
+				if err != nil {
+					return
+				}
+				switch verb := strings.Fields(line)[0]; {
+				case verb == cmd:
+					c.PrintfLine("%s", reply)
+				case verb == "EHLO":
+					c.PrintfLine("250-%s", host)
+					c.PrintfLine("250 AUTH CRAM-MD5")
+				case verb == "QUIT":
+					c.PrintfLine("221 Bye")
+					return
+				default:
+					c.PrintfLine("250 OK")
+				}
+			}
+		}()
+		return conn, nil
+	}
+	return d
+}
+
+func TestFailoverSender(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	session := serveSMTP(t, l)
+
+	dead := &Dialer{Host: "primary.example.com", Port: 25}
+	dead.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	busy := rejectingDialer(t, "secondary.example.com", "MAIL", "451 4.3.2 Try again later")
+	backup := NewDialer("127.0.0.1", l.Addr().(*net.TCPAddr).Port, "", "")
+
+	if err := NewFailoverSender(dead, busy, backup).DialAndSend(context.Background(), getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if commands := (<-session).commands; len(commands) < 2 || commands[1] != "MAIL FROM:<"+testFrom+">" {
+		t.Errorf("the message should be sent through the backup, got %q", commands)
+	}
+}
+
+func TestFailoverSenderPermanentError(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	primary := rejectingDialer(t, "primary.example.com", "MAIL", "550 5.7.1 Relaying denied")
+	backup := &Dialer{Host: "backup.example.com", Port: 25}
+	backup.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		t.Error("a permanent error should not fail over")
+		return nil, errors.New("unexpected dial")
+	}
+
+	err := NewFailoverSender(primary, backup).DialAndSend(context.Background(), getTestMessage())
+	var terr *textproto.Error
+	if !errors.As(err, &terr) || terr.Code != 550 {
+		t.Errorf("expected the 550 reply, got %v", err)
+	}
+
+	dead := &Dialer{Host: "dead.example.com", Port: 25}
+	dead.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	err = NewFailoverSender(dead, dead).DialAndSend(context.Background(), getTestMessage())
+	if err == nil || strings.Count(err.Error(), "connection refused") != 2 {
+		t.Errorf("the errors of all the Dialers should be returned, got %v", err)
+	}
+}
+
+func TestFailoverSenderAuthError(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	session := serveSMTP(t, l)
+
+	primary := rejectingDialer(t, "primary.example.com", "AUTH", "535 5.7.8 Authentication credentials invalid")
+	primary.Auth = smtp.CRAMMD5Auth("user", "secret")
+	backup := NewDialer("127.0.0.1", l.Addr().(*net.TCPAddr).Port, "", "")
+
+	if err := NewFailoverSender(primary, backup).DialAndSend(context.Background(), getTestMessage()); err != nil {
+		t.Fatalf("a rejected authentication should fail over, got %v", err)
+	}
+	if commands := (<-session).commands; len(commands) < 2 || commands[1] != "MAIL FROM:<"+testFrom+">" {
+		t.Errorf("the message should be sent through the backup, got %q", commands)
+	}
+}
@@ -0,0 +1,93 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FileSender is a SendCloser writing each message to a file instead of
+// sending it, which is useful during development. The files use the .eml
+// extension so they can be opened with an email client.
+//
+// The envelope sender and recipients are written at the beginning of the file
+// in the X-Envelope-From and X-Envelope-To header fields. The file names start
+// with the current time, given by the clock of the message set with SetClock
+// for a *Message.
+type FileSender struct {
+	// Dir is the directory where the messages are written, it is created if
+	// it does not exist.
+	Dir string
+}
+
+// NewFileSender returns a FileSender writing messages to dir.
+func NewFileSender(dir string) *FileSender {
+	return &FileSender{Dir: dir}
+}
+
+var fileSenderSeq uint64
+
+// Send implements Sender.
+func (s *FileSender) Send(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The envelope is written as header fields, like netClient.Rcpt it must
+	// not contain line breaks.
+	if strings.ContainsAny(from, "\r\n") || strings.ContainsAny(strings.Join(to, ""), "\r\n") {
+		return errors.New("gomail: a line must not contain CR or LF")
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("gomail: could not create directory: %w", err)
+	}
+
+	t := now()
+	if m, ok := msg.(*Message); ok {
+		t = m.now()
+	}
+	f, err := s.create(t)
+	if err != nil {
+		return fmt.Errorf("gomail: could not create file: %w", err)
+	}
+
+	bw := bufio.NewWriter(f)
+	fmt.Fprintf(bw, "X-Envelope-From: %s\r\nX-Envelope-To: %s\r\n", from, strings.Join(to, ", "))
+	_, err = msg.WriteTo(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("gomail: could not write file: %w", err)
+	}
+
+	return nil
+}
+
+// create creates a new file in s.Dir. The file name is made of t and a
+// sequence number, which is incremented until the name is not used.
+func (s *FileSender) create(t time.Time) (*os.File, error) {
+	prefix := t.UTC().Format("20060102T150405.000000000")
+	for {
+		name := fmt.Sprintf("%s-%d.eml", prefix, atomic.AddUint64(&fileSenderSeq, 1))
+		f, err := os.OpenFile(filepath.Join(s.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// Close implements SendCloser, it does nothing.
+func (s *FileSender) Close() error {
+	return nil
+}
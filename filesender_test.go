@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailgo-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewFileSender(filepath.Join(dir, "outbox"))
+
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			if err := Send(context.Background(), s, getTestMessage()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != n {
+		t.Fatalf("invalid number of files, got %d, want %d", len(files), n)
+	}
+
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope := "X-Envelope-From: " + testFrom + "\r\n" +
+			"X-Envelope-To: " + testTo1 + ", " + testTo2 + "\r\n"
+		if !bytes.HasPrefix(b, []byte(envelope)) {
+			t.Fatalf("the file should start with the envelope, got:\n%s", b)
+		}
+		compareBodies(t, string(b[len(envelope):]), testMsg)
+
+		m, err := ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := m.Recipients(); err != nil || len(got) != 2 || got[0] != testTo1 || got[1] != testTo2 {
+			t.Errorf("invalid recipients, got %v (%v)", got, err)
+		}
+		if got := m.GetHeader("X-Envelope-From"); len(got) != 1 || got[0] != testFrom {
+			t.Errorf("invalid X-Envelope-From, got %v", got)
+		}
+	}
+
+	clock := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := NewMessage(SetClock(func() time.Time { return clock }))
+	msg.SetHeader("From", testFrom)
+	msg.SetHeader("To", testTo1)
+	if err := Send(context.Background(), s, msg); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(s.Dir, "20200102T030405.000000000-*.eml")); len(files) != 1 {
+		t.Errorf("the file name should start with the time of the clock of the message, got %q", files)
+	}
+
+	if err := s.Send(context.Background(), testFrom, []string{testTo1 + "\r\nX-Injected: 1"}, msg); err == nil {
+		t.Error("expected an error with a line break in the envelope")
+	}
+	if err := s.Send(context.Background(), testFrom+"\n", []string{testTo1}, msg); err == nil {
+		t.Error("expected an error with a line break in the envelope sender")
+	}
+	if files, _ := filepath.Glob(filepath.Join(s.Dir, "*.eml")); len(files) != n+1 {
+		t.Errorf("no file should be written with an invalid envelope, got %d files", len(files))
+	}
+}
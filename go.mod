@@ -1,3 +1,3 @@
 module github.com/SchumacherFM/mailgo
 
-go 1.15
+go 1.21
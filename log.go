@@ -0,0 +1,148 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// loggingClient is an smtpClient logging the commands sent to the server. The
+// reply codes of successful commands are the ones required by net/smtp.
+type loggingClient struct {
+	sc     smtpClient
+	logger *slog.Logger
+}
+
+func (c *loggingClient) log(command string, code int, start time.Time, err error) {
+	ctx := context.Background()
+	if !c.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("command", command),
+		slog.Duration("duration", time.Since(start)),
+	}
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		code = terr.Code
+	}
+	if code != 0 {
+		attrs = append(attrs, slog.Int("code", code))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	c.logger.LogAttrs(ctx, slog.LevelDebug, "gomail: smtp command", attrs...)
+}
+
+func (c *loggingClient) Hello(localName string) error {
+	start := time.Now()
+	err := c.sc.Hello(localName)
+	c.log("EHLO "+localName, 250, start, err)
+	return err
+}
+
+func (c *loggingClient) Extension(ext string) (bool, string) {
+	return c.sc.Extension(ext)
+}
+
+func (c *loggingClient) StartTLS(config *tls.Config) error {
+	start := time.Now()
+	err := c.sc.StartTLS(config)
+	c.log("STARTTLS", 220, start, err)
+	return err
+}
+
+// Auth logs the AUTH command without its arguments, the mechanism and the
+// credentials are only known by a.
+func (c *loggingClient) Auth(a smtp.Auth) error {
+	start := time.Now()
+	err := c.sc.Auth(a)
+	c.log("AUTH", 235, start, err)
+	return err
+}
+
+func (c *loggingClient) Mail(from string, params ...string) error {
+	start := time.Now()
+	err := c.sc.Mail(from, params...)
+	c.log(strings.Join(append([]string{"MAIL FROM:<" + from + ">"}, params...), " "), 250, start, err)
+	return err
+}
+
+func (c *loggingClient) Rcpt(to string, params ...string) error {
+	start := time.Now()
+	err := c.sc.Rcpt(to, params...)
+	c.log(strings.Join(append([]string{"RCPT TO:<" + to + ">"}, params...), " "), 250, start, err)
+	return err
+}
+
+func (c *loggingClient) Data() (io.WriteCloser, error) {
+	start := time.Now()
+	w, err := c.sc.Data()
+	c.log("DATA", 354, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingDataWriter{WriteCloser: w, c: c, command: ".", start: time.Now()}, nil
+}
+
+// Bdat logs the message data as a single BDAT command, when the last chunk is
+// sent.
+func (c *loggingClient) Bdat() (io.WriteCloser, error) {
+	w, err := c.sc.Bdat()
+	if err != nil {
+		return nil, err
+	}
+	return &loggingDataWriter{WriteCloser: w, c: c, command: "BDAT LAST", start: time.Now()}, nil
+}
+
+func (c *loggingClient) Reset() error {
+	start := time.Now()
+	err := c.sc.Reset()
+	c.log("RSET", 250, start, err)
+	return err
+}
+
+func (c *loggingClient) Command(line string) (int, string, error) {
+	start := time.Now()
+	code, msg, err := c.sc.Command(line)
+	c.log(line, code, start, err)
+	return code, msg, err
+}
+
+func (c *loggingClient) Quit() error {
+	start := time.Now()
+	err := c.sc.Quit()
+	c.log("QUIT", 221, start, err)
+	return err
+}
+
+func (c *loggingClient) Close() error {
+	return c.sc.Close()
+}
+
+func (c *loggingClient) TLSConnectionState() (tls.ConnectionState, bool) {
+	return c.sc.TLSConnectionState()
+}
+
+// loggingDataWriter logs the end of the message data, which is sent as a line
+// with a single dot or as the last BDAT chunk, when it is closed.
+type loggingDataWriter struct {
+	io.WriteCloser
+	c       *loggingClient
+	command string
+	start   time.Time
+}
+
+func (w *loggingDataWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.c.log(w.command, 250, w.start, err)
+	return err
+}
@@ -0,0 +1,62 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// RecordedMessage is a message recorded by a MemorySender.
+type RecordedMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemorySender is a SendCloser recording the messages instead of sending
+// them, so the code sending emails can be tested without a server. It is safe
+// for concurrent use.
+type MemorySender struct {
+	mu   sync.Mutex
+	msgs []RecordedMessage
+}
+
+// Send implements Sender.
+func (s *MemorySender) Send(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.msgs = append(s.msgs, RecordedMessage{
+		From: from,
+		To:   append([]string(nil), to...),
+		Data: buf.Bytes(),
+	})
+	s.mu.Unlock()
+	return nil
+}
+
+// Close implements SendCloser, it does nothing.
+func (s *MemorySender) Close() error {
+	return nil
+}
+
+// Messages returns the messages recorded so far, in the order they were sent.
+func (s *MemorySender) Messages() []RecordedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RecordedMessage(nil), s.msgs...)
+}
+
+// Reset forgets the recorded messages.
+func (s *MemorySender) Reset() {
+	s.mu.Lock()
+	s.msgs = nil
+	s.mu.Unlock()
+}
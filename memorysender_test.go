@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemorySender(t *testing.T) {
+	s := new(MemorySender)
+	m2 := getTestMessage()
+	m2.SetHeader("To", "other@example.com")
+	if err := Send(context.Background(), s, getTestMessage(), m2); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := s.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("invalid number of messages, got %d, want 2", len(msgs))
+	}
+	if msgs[0].From != testFrom || fmt.Sprint(msgs[0].To) != fmt.Sprint([]string{testTo1, testTo2}) {
+		t.Errorf("invalid envelope, got %q %v", msgs[0].From, msgs[0].To)
+	}
+	compareBodies(t, string(msgs[0].Data), testMsg)
+	if fmt.Sprint(msgs[1].To) != "[other@example.com]" {
+		t.Errorf("messages should be recorded in order, got %v", msgs[1].To)
+	}
+
+	s.Reset()
+	var wg sync.WaitGroup
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer wg.Done()
+			if err := Send(context.Background(), s, getTestMessage()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(s.Messages()); n != 10 {
+		t.Errorf("invalid number of messages after concurrent sends, got %d, want 10", n)
+	}
+}
@@ -2,16 +2,30 @@ package mail
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	stdmail "net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // Message represents an email.
 type Message struct {
 	header      header
+	headerOrder []string
+	fieldOrder  []string
+	repeated    map[string]bool
 	parts       []*part
 	attachments []*file
 	embedded    []*file
@@ -20,6 +34,37 @@ type Message struct {
 	hEncoder    mimeEncoder
 	buf         bytes.Buffer
 	boundary    string
+
+	messageIDDomain string
+	noMessageID     bool
+	base64LineLen   int
+	lineLength      LineLengthPolicy
+	boundaryFunc    func() string
+	clock           func() time.Time
+	utcDates        bool
+	requireTLS      bool
+	deliverBy       time.Duration
+	deliverByMode   ByMode
+	progress        func(sent, total int64)
+	mailParams      []esmtpParam
+	// authSubmitter is sent with the AUTH parameter when hasAuthSubmitter
+	// is set.
+	authSubmitter    string
+	hasAuthSubmitter bool
+	rcptParams       map[string][]esmtpParam
+	// mtPriority is sent with the MT-PRIORITY parameter when hasMTPriority
+	// is set.
+	mtPriority    int
+	hasMTPriority bool
+
+	transformers  []Transformer
+	headerSigners []HeaderSigner
+	// raw writes the body set with SetRaw, rawOneShot is set when it can only
+	// be read once.
+	raw        func(io.Writer) error
+	rawOneShot bool
+	// report is set by SetDeliveryReport.
+	report *reportContent
 }
 
 type header map[string][]string
@@ -28,15 +73,21 @@ type part struct {
 	contentType string
 	copier      func(io.Writer) error
 	encoding    Encoding
+	// charset overrides the charset of the message when set.
+	charset string
+	// static is set when the content is a string, copier can then be run
+	// any number of times.
+	static bool
 }
 
 // NewMessage creates a new message. It uses UTF-8 and quoted-printable encoding
 // by default.
 func NewMessage(settings ...MessageSetting) *Message {
 	m := &Message{
-		header:   make(header),
-		charset:  "UTF-8",
-		encoding: QuotedPrintable,
+		header:        make(header),
+		charset:       "UTF-8",
+		encoding:      QuotedPrintable,
+		base64LineLen: maxLineLen,
 	}
 
 	m.applySettings(settings)
@@ -50,15 +101,148 @@ func NewMessage(settings ...MessageSetting) *Message {
 	return m
 }
 
-// Reset resets the message so it can be reused. The message keeps its previous
-// settings so it is in the same state that after a call to NewMessage.
+// Reset resets the message so it can be reused. The message keeps the
+// MessageSettings given to NewMessage and the formatting options set with
+// SetBoundaryFunc, SetMessageIDDomain and SetBase64LineLength. Everything else
+// is cleared: the headers, the header order, the boundary set with SetBoundary,
+// the progress function, the SMTP parameters set with SetMailParam,
+// SetRcptParam, SetAuthSubmitter, SetMTPriority, SetRequireTLS and
+// SetDeliverBy, the body parts, attachments and embedded files.
+//
+// The memory allocated for the headers, parts and files is kept, so building
+// many messages with a single Message allocates less. The functions given to
+// SetBodyWriter, SetCopyFunc and the like, and the readers given to
+// AttachReader and EmbedReader, are released and never called after Reset.
 func (m *Message) Reset() {
+	m.resetContent()
+	m.fieldOrder = nil
+	m.progress = nil
+	m.requireTLS = false
+	m.deliverBy = 0
+	m.deliverByMode = ""
+	m.mailParams = m.mailParams[:0]
+	for k := range m.rcptParams {
+		delete(m.rcptParams, k)
+	}
+	m.authSubmitter = ""
+	m.hasAuthSubmitter = false
+	m.mtPriority = 0
+	m.hasMTPriority = false
+}
+
+// resetContent clears the headers and the content of the message: its body
+// parts, files, raw body and delivery report.
+func (m *Message) resetContent() {
 	for k := range m.header {
 		delete(m.header, k)
 	}
-	m.parts = nil
-	m.attachments = nil
-	m.embedded = nil
+	m.headerOrder = m.headerOrder[:0]
+	for k := range m.repeated {
+		delete(m.repeated, k)
+	}
+	for i := range m.parts {
+		m.parts[i] = nil
+	}
+	m.parts = m.parts[:0]
+	m.attachments = resetFiles(m.attachments)
+	m.embedded = resetFiles(m.embedded)
+	m.raw = nil
+	m.rawOneShot = false
+	m.report = nil
+	m.boundary = ""
+}
+
+// resetFiles empties files, keeping its capacity.
+func resetFiles(files []*file) []*file {
+	for i := range files {
+		files[i] = nil
+	}
+	return files[:0]
+}
+
+// Copy returns a deep copy of the message. The headers, body parts,
+// attachments and embedded files of the copy can be modified without affecting
+// the original message.
+//
+// The functions writing the content of the parts and files are shared. Files
+// added with AttachReader or EmbedReader share their io.Reader: they can only
+// be written by both messages when the reader implements io.Seeker, and the
+// messages must then not be written concurrently.
+func (m *Message) Copy() *Message {
+	c := *m
+	c.buf = bytes.Buffer{}
+
+	c.header = make(header, len(m.header))
+	for k, v := range m.header {
+		c.header[k] = append([]string(nil), v...)
+	}
+	c.headerOrder = append([]string(nil), m.headerOrder...)
+	c.fieldOrder = append([]string(nil), m.fieldOrder...)
+	if m.repeated != nil {
+		c.repeated = make(map[string]bool, len(m.repeated))
+		for k := range m.repeated {
+			c.repeated[k] = true
+		}
+	}
+
+	if m.parts != nil {
+		c.parts = make([]*part, len(m.parts))
+		for i, p := range m.parts {
+			cp := *p
+			c.parts[i] = &cp
+		}
+	}
+	c.mailParams = append([]esmtpParam(nil), m.mailParams...)
+	if m.rcptParams != nil {
+		c.rcptParams = make(map[string][]esmtpParam, len(m.rcptParams))
+		for addr, params := range m.rcptParams {
+			c.rcptParams[addr] = append([]esmtpParam(nil), params...)
+		}
+	}
+	c.attachments = copyFiles(m.attachments)
+	c.embedded = copyFiles(m.embedded)
+	c.transformers = append([]Transformer(nil), m.transformers...)
+	c.headerSigners = append([]HeaderSigner(nil), m.headerSigners...)
+
+	return &c
+}
+
+// errOneShot is returned when a message would be written several times while
+// it has content that can only be read once.
+var errOneShot = errors.New("gomail: the message can only be written once, it has content read from an io.Reader not implementing io.Seeker")
+
+// oneShot reports whether the message has content read from an io.Reader that
+// cannot be rewound, the message can then only be written once.
+func (m *Message) oneShot() bool {
+	if m.raw != nil {
+		return m.rawOneShot
+	}
+	for _, files := range [][]*file{m.attachments, m.embedded} {
+		for _, f := range files {
+			if f.oneShot {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyFiles(files []*file) []*file {
+	if files == nil {
+		return nil
+	}
+
+	c := make([]*file, len(files))
+	for i, f := range files {
+		cf := *f
+		cf.Header = make(map[string][]string, len(f.Header))
+		for k, v := range f.Header {
+			cf.Header[k] = append([]string(nil), v...)
+		}
+		c[i] = &cf
+	}
+
+	return c
 }
 
 func (m *Message) applySettings(settings []MessageSetting) {
@@ -78,6 +262,33 @@ func SetCharset(charset string) MessageSetting {
 	}
 }
 
+// SetAutoMessageID is a message setting to enable or disable the automatic
+// generation of the Message-ID header field when it is not set. It is enabled
+// by default.
+func SetAutoMessageID(enabled bool) MessageSetting {
+	return func(m *Message) {
+		m.noMessageID = !enabled
+	}
+}
+
+// SetClock is a message setting to set the function returning the current
+// time, used for the Date and Message-ID header fields generated when the
+// message is written, the signatures of ARCSigner and SMIMESigner and the
+// file names of FileSender. It defaults to time.Now.
+func SetClock(clock func() time.Time) MessageSetting {
+	return func(m *Message) {
+		m.clock = clock
+	}
+}
+
+// SetUTCDates is a message setting to format all the dates of the email in
+// UTC instead of in the location of the given time.Time.
+func SetUTCDates(enabled bool) MessageSetting {
+	return func(m *Message) {
+		m.utcDates = enabled
+	}
+}
+
 // SetEncoding is a message setting to set the encoding of the email.
 func SetEncoding(enc Encoding) MessageSetting {
 	return func(m *Message) {
@@ -85,6 +296,83 @@ func SetEncoding(enc Encoding) MessageSetting {
 	}
 }
 
+// LineLengthPolicy defines how the lines of the parts and files using the
+// Unencoded encoding longer than the 998 octets allowed by RFC 5322 are
+// written.
+type LineLengthPolicy int
+
+const (
+	// LineLengthIgnore writes long lines as is, the server may reject or
+	// truncate them. It is the default.
+	LineLengthIgnore LineLengthPolicy = iota
+	// LineLengthStrict makes writing the message fail.
+	LineLengthStrict
+	// LineLengthWrap breaks long lines with a CRLF, without splitting UTF-8
+	// characters.
+	LineLengthWrap
+)
+
+// SetLineLengthPolicy is a message setting to define how the long lines of
+// unencoded content are written. The line endings of unencoded content are
+// always normalized to CRLF.
+func SetLineLengthPolicy(p LineLengthPolicy) MessageSetting {
+	return func(m *Message) {
+		m.lineLength = p
+	}
+}
+
+// A Transformer rewrites the MIME entity of a message when it is written, for
+// example to sign or encrypt it.
+//
+// Transform receives the fully serialized entity, that is the Content-*
+// headers and the body of the message with CRLF line endings, and writes its
+// replacement to w. The message headers (From, To, Subject...) are not part of
+// the entity and are written unchanged.
+type Transformer interface {
+	Transform(w io.Writer, entity []byte) error
+}
+
+// SetTransformers is a message setting to apply the given transformers, in
+// order, when the message is written. The whole entity is buffered in memory
+// while it is transformed.
+func SetTransformers(t ...Transformer) MessageSetting {
+	return func(m *Message) {
+		m.transformers = append(m.transformers, t...)
+	}
+}
+
+// A HeaderSigner computes header fields prepended to a message when it is
+// written, for example the ARC header fields added by ARCSigner.
+//
+// SignHeader receives the whole serialized message, its header and its body
+// with CRLF line endings, and returns the header fields to prepend, each one
+// ending with CRLF.
+type HeaderSigner interface {
+	SignHeader(message []byte) ([]byte, error)
+}
+
+// timedHeaderSigner is implemented by the header signers of the package using
+// the current time, they are given the time of the clock of the message.
+type timedHeaderSigner interface {
+	signHeaderAt(message []byte, t time.Time) ([]byte, error)
+}
+
+// timedTransformer is implemented by the transformers of the package using
+// the current time, like timedHeaderSigner.
+type timedTransformer interface {
+	transformAt(w io.Writer, entity []byte, t time.Time) error
+}
+
+// SetHeaderSigners is a message setting to apply the given header signers, in
+// order, when the message is written. Each signer receives the message with
+// the fields of the previous signers. The whole message is buffered in memory
+// while it is signed.
+func SetHeaderSigners(s ...HeaderSigner) MessageSetting {
+	return func(m *Message) {
+		m.headerSigners = append(m.headerSigners, s...)
+	}
+}
+
 // Encoding represents a MIME encoding scheme like quoted-printable or base64.
 type Encoding string
 
@@ -97,23 +385,165 @@ const (
 	// Unencoded can be used to avoid encoding the body of an email. The headers
 	// will still be encoded using quoted-printable encoding.
 	Unencoded Encoding = "8bit"
+	// Auto chooses the encoding of each text part from its content: 7bit for
+	// ASCII text, 8bit for other text when the SMTP server supports the
+	// 8BITMIME extension and quoted-printable otherwise. Quoted-printable is
+	// also used when a line is longer than the 998 characters allowed by RFC
+	// 5322. Files using Auto are encoded in base64.
+	Auto Encoding = "auto"
 )
 
-// SetBoundary sets a custom multipart boundary.
+// SetBoundary sets a custom multipart boundary. Writing the message fails if
+// the boundary is invalid or appears in the content, use SetValidatedBoundary
+// to check it right away.
 func (m *Message) SetBoundary(boundary string) {
 	m.boundary = boundary
 }
 
-// SetHeader sets a value to the given header field.
+// SetValidatedBoundary works like SetBoundary but returns an error if the
+// boundary is not valid according to RFC 2046: it must be 1 to 70 characters
+// long, only contain letters, digits and the characters '()+_,-./:=? and must
+// not end with a space.
+func (m *Message) SetValidatedBoundary(boundary string) error {
+	if err := checkBoundary(boundary); err != nil {
+		return err
+	}
+	m.boundary = boundary
+	return nil
+}
+
+func checkBoundary(boundary string) error {
+	if boundary == "" || len(boundary) > 70 {
+		return fmt.Errorf("gomail: multipart boundary %q must be 1 to 70 characters long", boundary)
+	}
+	for i := 0; i < len(boundary); i++ {
+		c := boundary[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("'()+_,-./:=?", c) != -1:
+		case c == ' ' && i != len(boundary)-1:
+		default:
+			return fmt.Errorf("gomail: invalid character %q in multipart boundary %q", c, boundary)
+		}
+	}
+	return nil
+}
+
+// SetBoundaryFunc sets a function returning the boundaries of the multipart
+// entities of the message, it is called once for each nesting level every time
+// the message is written. It takes precedence over SetBoundary and makes the
+// output reproducible, for example to compare messages with golden files. The
+// boundaries must be unique within a message, writing the message fails
+// otherwise.
+func (m *Message) SetBoundaryFunc(f func() string) {
+	m.boundaryFunc = f
+}
+
+// SetMessageIDDomain sets the domain used in generated Message-ID header
+// fields. By default the domain of the From address is used.
+func (m *Message) SetMessageIDDomain(domain string) {
+	m.messageIDDomain = domain
+}
+
+// SetBase64LineLength sets the maximum length of the lines of base64 encoded
+// attachments, embedded files and bodies. By default lines are wrapped at 76
+// characters as required by RFC 2045, use 0 to disable wrapping.
+func (m *Message) SetBase64LineLength(n int) {
+	if n < 0 {
+		n = 0
+	}
+	m.base64LineLen = n
+}
+
+// SetHeader sets a value to the given header field. In the address fields,
+// like From or To, only the display names of the addresses are encoded.
 func (m *Message) SetHeader(field string, value ...string) {
-	m.SetRawHeader(field, m.encodeHeader(value)...)
+	m.SetRawHeader(field, m.encodeField(field, value)...)
+}
+
+// AddHeader adds values to the given header field instead of replacing the
+// previous ones. Each value of a field set with AddHeader is written on its own
+// line, as needed by fields appearing several times like Received or Comments.
+func (m *Message) AddHeader(field string, value ...string) {
+	m.addField(field, m.encodeField(field, value))
 }
 
 // SetRawHeader sets the value for a field without any further encoding.
 // Useful when setting multiple addresses in a header:
 // m.SetRawHeader("To", m.FormatAddress(address, name), m.FormatAddress(address, name))
 func (m *Message) SetRawHeader(field string, value ...string) {
+	m.setField(field, value)
+}
+
+// SetRaw replaces the headers and the content of the message with the given
+// header fields and body, for example to send a message signed by another
+// program. The message is then written as the header fields, sorted by name,
+// neither encoded nor folded, followed by the body copied verbatim: the
+// MIME-Version, Date and Message-ID header fields are not generated, the
+// transformers are not applied and the body parts and files of the message
+// are removed.
+//
+// The envelope is still read from the From, Sender, To, Cc and Bcc fields and
+// the Bcc field is not written. The SMTP parameters, like those set with
+// SetMailParam and SetRcptParam, and the progress function are kept. Like with
+// AttachReader, the message can only be written several times, for example
+// when sending is retried, if body implements io.Seeker.
+func (m *Message) SetRaw(headers map[string]string, body io.Reader) {
+	m.resetContent()
+	fields := make([]string, 0, len(headers))
+	for field := range headers {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		m.SetRawHeader(field, headers[field])
+	}
+	f := fileFromReader("", body)
+	m.raw = f.CopyFunc
+	m.rawOneShot = f.oneShot
+}
+
+// SetHeaderOrder sets the order in which the header fields are written, field
+// names are case-insensitive. The fields not listed follow in the order they
+// were first set. This includes the fields generated when the message is
+// written: MIME-Version, Date, Message-ID and Sender come first by default.
+func (m *Message) SetHeaderOrder(fields []string) {
+	m.fieldOrder = append([]string(nil), fields...)
+}
+
+// setField sets the values of a header field. A new field is written after the
+// existing ones while a field set again keeps its position.
+func (m *Message) setField(field string, value []string) {
+	if _, ok := m.header[field]; !ok {
+		m.headerOrder = append(m.headerOrder, field)
+	}
 	m.header[field] = value
+	delete(m.repeated, field)
+}
+
+// addField adds values to a header field, each value is written on its own
+// line.
+func (m *Message) addField(field string, value []string) {
+	m.setField(field, append(m.header[field], value...))
+	if m.repeated == nil {
+		m.repeated = make(map[string]bool)
+	}
+	m.repeated[field] = true
+}
+
+// deleteField removes a header field.
+func (m *Message) deleteField(field string) {
+	if _, ok := m.header[field]; !ok {
+		return
+	}
+	delete(m.header, field)
+	delete(m.repeated, field)
+	for i, k := range m.headerOrder {
+		if k == field {
+			m.headerOrder = append(m.headerOrder[:i:i], m.headerOrder[i+1:]...)
+			break
+		}
+	}
 }
 
 func (m *Message) encodeHeader(values []string) []string {
@@ -125,53 +555,288 @@ func (m *Message) encodeHeader(values []string) []string {
 	return encoded
 }
 
+// encodeField encodes the values of the given header field. The display names
+// of the addresses of an address field are encoded on their own, so the
+// addresses and the commas separating them are not part of an encoded-word.
+func (m *Message) encodeField(field string, values []string) []string {
+	if !isAddressField(textproto.CanonicalMIMEHeaderKey(field)) {
+		return m.encodeHeader(values)
+	}
+
+	encoded := m.encodeHeader(values)
+	for i, v := range values {
+		if encoded[i] == v || strings.HasSuffix(strings.TrimSpace(v), ";") {
+			// net/mail drops the display names of groups.
+			continue
+		}
+		if list, err := stdmail.ParseAddressList(v); err == nil {
+			addrs := make([]string, len(list))
+			for j, a := range list {
+				addrs[j] = m.FormatAddress(a.Address, a.Name)
+			}
+			encoded[i] = strings.Join(addrs, ", ")
+		}
+	}
+	return encoded
+}
+
 func (m *Message) encodeString(value string) string {
 	return m.hEncoder.Encode(m.charset, value)
 }
 
 // SetHeaders sets the message headers.
 func (m *Message) SetHeaders(h map[string][]string) {
-	for k, v := range h {
-		m.SetHeader(k, v...)
+	// Sort the fields so they are written in a reproducible order.
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.SetHeader(k, h[k]...)
 	}
 }
 
-// SetAddressHeader sets an address to the given header field.
+// SetAddressHeader sets an address to the given header field. The address is
+// not validated, SetAddresses can be used to reject invalid addresses.
 func (m *Message) SetAddressHeader(field, address, name string) {
 	m.SetRawHeader(field, m.FormatAddress(address, name))
 }
 
+// SetAddressHeaders sets the addresses mapped to their display names to the
+// given header field. The addresses are sorted so the output is reproducible,
+// an empty name only writes the address. Like with SetAddressHeader, the
+// addresses are not validated.
+func (m *Message) SetAddressHeaders(field string, addresses map[string]string) {
+	keys := make([]string, 0, len(addresses))
+	for address := range addresses {
+		keys = append(keys, address)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, address := range keys {
+		values[i] = m.FormatAddress(address, addresses[address])
+	}
+	m.SetRawHeader(field, values...)
+}
+
+// SetFrom sets the From header field to the given addresses, replacing any
+// previous value. Each address can contain a display name, for example
+// "Señor From <from@example.com>", which is properly encoded. The addresses
+// are validated with ParseAddress.
+//
+// When several addresses are given, RFC 5322 requires a Sender header field.
+// If none is set with SetSender, the first address is used as Sender when the
+// message is written. The Sender address is also used as the envelope sender.
+func (m *Message) SetFrom(addresses ...string) error {
+	if len(addresses) == 0 {
+		return errors.New("gomail: From requires at least one address")
+	}
+	values, err := m.formatAddresses(addresses)
+	if err != nil {
+		return err
+	}
+	m.SetRawHeader("From", values...)
+	return nil
+}
+
+// SetSender sets the Sender header field to the given address, replacing any
+// previous value. The address can contain a display name.
+func (m *Message) SetSender(address string) error {
+	values, err := m.formatAddresses([]string{address})
+	if err != nil {
+		return err
+	}
+	m.SetRawHeader("Sender", values...)
+	return nil
+}
+
+func (m *Message) formatAddresses(addresses []string) ([]string, error) {
+	values := make([]string, len(addresses))
+	for i, a := range addresses {
+		addr, err := ParseAddress(a)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = m.FormatAddress(addr.Addr(), addr.Name)
+	}
+	return values, nil
+}
+
+// SetReplyTo sets the Reply-To header field, replacing any previous value.
+// Each address can contain a display name, for example
+// "Señor From <from@example.com>", which is properly encoded. Like with
+// SetFrom, the addresses are validated with ParseAddress and the field is left
+// unchanged if one of them is invalid.
+func (m *Message) SetReplyTo(addresses ...string) error {
+	if len(addresses) == 0 {
+		return errors.New("gomail: Reply-To requires at least one address")
+	}
+	values, err := m.formatAddresses(addresses)
+	if err != nil {
+		return err
+	}
+	m.SetRawHeader("Reply-To", values...)
+	return nil
+}
+
+// SetReplyToName sets a single address and its display name to the Reply-To
+// header field, replacing any previous value.
+func (m *Message) SetReplyToName(address, name string) {
+	m.SetAddressHeader("Reply-To", address, name)
+}
+
+// SetContentLanguage sets the Content-Language header field defined in
+// RFC 3282 to the given BCP 47 language tags, such as "en" or "de-CH".
+func (m *Message) SetContentLanguage(tags ...string) error {
+	if len(tags) == 0 {
+		return errors.New("gomail: Content-Language requires at least one language tag")
+	}
+	for _, tag := range tags {
+		if !isLanguageTag(tag) {
+			return fmt.Errorf("gomail: invalid language tag %q", tag)
+		}
+	}
+	m.SetRawHeader("Content-Language", tags...)
+	return nil
+}
+
+// isLanguageTag loosely checks the shape of a BCP 47 language tag: subtags of
+// 1 to 8 alphanumeric characters separated by hyphens, the first one being
+// alphabetic.
+func isLanguageTag(tag string) bool {
+	for i, sub := range strings.Split(tag, "-") {
+		if len(sub) == 0 || len(sub) > 8 {
+			return false
+		}
+		for _, c := range sub {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			case c >= '0' && c <= '9' && i > 0:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetListUnsubscribe sets the List-Unsubscribe header field defined in
+// RFC 2369 to the given mailto, http or https URLs. At least one URL must be
+// given.
+func (m *Message) SetListUnsubscribe(urls ...string) error {
+	values, err := listUnsubscribeValues(urls, false)
+	if err != nil {
+		return err
+	}
+	m.SetRawHeader("List-Unsubscribe", values...)
+	m.deleteField("List-Unsubscribe-Post")
+	return nil
+}
+
+// SetListUnsubscribeOneClick works like SetListUnsubscribe but also enables
+// the one-click unsubscription defined in RFC 8058 by setting the
+// List-Unsubscribe-Post header field. At least one https URL must be given.
+func (m *Message) SetListUnsubscribeOneClick(urls ...string) error {
+	values, err := listUnsubscribeValues(urls, true)
+	if err != nil {
+		return err
+	}
+	m.SetRawHeader("List-Unsubscribe", values...)
+	m.SetRawHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	return nil
+}
+
+func listUnsubscribeValues(urls []string, oneClick bool) ([]string, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("gomail: List-Unsubscribe requires at least one URL")
+	}
+
+	hasHTTPS := false
+	values := make([]string, len(urls))
+	for i, raw := range urls {
+		raw = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(raw), "<"), ">")
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("gomail: invalid List-Unsubscribe URL %q: %w", raw, err)
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "https":
+			hasHTTPS = true
+		case "mailto", "http":
+		default:
+			return nil, fmt.Errorf("gomail: invalid List-Unsubscribe URL %q: scheme must be mailto, http or https", raw)
+		}
+		values[i] = "<" + raw + ">"
+	}
+
+	if oneClick && !hasHTTPS {
+		return nil, errors.New("gomail: one-click List-Unsubscribe requires an https URL")
+	}
+
+	return values, nil
+}
+
 // FormatAddress formats an address and a name as a valid RFC 5322 address.
 func (m *Message) FormatAddress(address, name string) string {
 	if name == "" {
 		return address
 	}
 
-	enc := m.encodeString(name)
+	m.writeDisplayName(name)
+	m.buf.WriteString(" <")
+	m.buf.WriteString(address)
+	m.buf.WriteByte('>')
+
+	addr := m.buf.String()
+	m.buf.Reset()
+	return addr
+}
+
+// FormatGroup formats a named group of addresses as defined in RFC 5322, for
+// example `"Team": a@example.com, b@example.com;`. The addresses can be
+// formatted with FormatAddress. A group is written as a single value of an
+// address header field and the message is still sent to each of its members.
+func (m *Message) FormatGroup(name string, addresses ...string) string {
+	m.writeDisplayName(name)
+	m.buf.WriteByte(':')
+	if len(addresses) > 0 {
+		m.buf.WriteByte(' ')
+		m.buf.WriteString(strings.Join(addresses, ", "))
+	}
+	m.buf.WriteByte(';')
+
+	group := m.buf.String()
+	m.buf.Reset()
+	return group
+}
+
+// writeDisplayName writes the quoted or encoded name to m.buf.
+func (m *Message) writeDisplayName(name string) {
+	writeDisplayName(&m.buf, m.hEncoder, m.charset, name)
+}
+
+// writeDisplayName writes name to buf, quoted when it only contains ASCII
+// characters and encoded with enc otherwise.
+func writeDisplayName(buf *bytes.Buffer, enc mimeEncoder, charset, name string) {
+	encoded := enc.Encode(charset, name)
 	switch {
-	case enc == name:
-		m.buf.WriteByte('"')
+	case encoded == name:
+		buf.WriteByte('"')
 		for i := 0; i < len(name); i++ {
 			b := name[i]
 			if b == '\\' || b == '"' {
-				m.buf.WriteByte('\\')
+				buf.WriteByte('\\')
 			}
-			m.buf.WriteByte(b)
+			buf.WriteByte(b)
 		}
-		m.buf.WriteByte('"')
+		buf.WriteByte('"')
 	case hasSpecials(name):
-		m.buf.WriteString(bEncoding.Encode(m.charset, name))
+		buf.WriteString(bEncoding.Encode(charset, name))
 	default:
-		m.buf.WriteString(enc)
+		buf.WriteString(encoded)
 	}
-
-	m.buf.WriteString(" <")
-	m.buf.WriteString(address)
-	m.buf.WriteByte('>')
-
-	addr := m.buf.String()
-	m.buf.Reset()
-	return addr
 }
 
 func hasSpecials(text string) bool {
@@ -185,25 +850,183 @@ func hasSpecials(text string) bool {
 	return false
 }
 
+// SetRequireTLS requires the message to be sent over TLS all the way to the
+// recipients, as defined by the REQUIRETLS extension of RFC 8689: servers
+// return the message rather than relaying it in the clear. Sending the
+// message with a Dialer fails with a RequireTLSError when the connection is
+// not encrypted or the server does not support REQUIRETLS.
+func (m *Message) SetRequireTLS(required bool) {
+	m.requireTLS = required
+}
+
+// ByMode is the action taken by a server when a message sent with
+// SetDeliverBy cannot be delivered in time.
+type ByMode string
+
+const (
+	// ByReturn returns the message to the sender as undeliverable.
+	ByReturn ByMode = "R"
+	// ByNotify sends a delay notification to the sender and keeps trying to
+	// deliver the message.
+	ByNotify ByMode = "N"
+)
+
+// SetDeliverBy asks the servers to deliver the message within d with the
+// DELIVERBY extension defined in RFC 2852. Sending the message with a Dialer
+// fails when the server does not support DELIVERBY or when d is shorter than
+// the minimum advertised by the server in ByReturn mode. A zero d disables
+// the extension.
+func (m *Message) SetDeliverBy(d time.Duration, mode ByMode) {
+	m.deliverBy = d
+	m.deliverByMode = mode
+}
+
+// SetAuthSubmitter sets the address of the authenticated submitter of the
+// message, sent to the servers advertising the AUTH extension with the AUTH
+// parameter of the MAIL command defined in RFC 4954, for example by a trusted
+// relay sending on behalf of its users. An empty addr declares the submitter
+// as anonymous.
+func (m *Message) SetAuthSubmitter(addr string) {
+	m.authSubmitter = addr
+	m.hasAuthSubmitter = true
+}
+
+// SetMTPriority sets the priority of the message, from -9 to 9, sent with the
+// MT-PRIORITY parameter of the MAIL command defined in RFC 6710 so the servers
+// queue urgent messages ahead of bulk ones. The parameter is only sent to the
+// servers advertising the MT-PRIORITY extension, unless
+// Dialer.RequireMTPriority is set. The message is not sent if p is out of
+// range.
+func (m *Message) SetMTPriority(p int) {
+	m.mtPriority = p
+	m.hasMTPriority = true
+}
+
+// SetMailParam sets a parameter of the MAIL command sent by a Dialer, for
+// ESMTP extensions without a dedicated setting. It is sent as KEY=VALUE, or
+// KEY alone when value is empty, and replaces a parameter with the same key.
+// The message is not sent if the parameter is not valid or is one the package
+// sends itself: AUTH, BODY, BY, MT-PRIORITY, REQUIRETLS and SMTPUTF8 have
+// their own settings or are sent when the server supports them. Whether the
+// server supports the extension is not checked.
+func (m *Message) SetMailParam(key, value string) {
+	m.mailParams = setParam(m.mailParams, key, value)
+}
+
+// SetRcptParam sets a parameter of the RCPT command sent by a Dialer for the
+// recipient address addr, without display name, like SetMailParam. The domain
+// of addr is matched case-insensitively.
+func (m *Message) SetRcptParam(addr, key, value string) {
+	if m.rcptParams == nil {
+		m.rcptParams = make(map[string][]esmtpParam)
+	}
+	addr = normalizeAddress(addr)
+	m.rcptParams[addr] = setParam(m.rcptParams[addr], key, value)
+}
+
+// esmtpParam is a parameter of the MAIL or RCPT command.
+type esmtpParam struct {
+	key, value string
+}
+
+func setParam(params []esmtpParam, key, value string) []esmtpParam {
+	for i, p := range params {
+		if strings.EqualFold(p.key, key) {
+			params[i] = esmtpParam{key, value}
+			return params
+		}
+	}
+	return append(params, esmtpParam{key, value})
+}
+
+// SetProgressFunc sets a function called each time bytes of the message are
+// written by WriteTo or sent by a Dialer, with the number of bytes written so
+// far and the total length of the message. The total is computed like Size,
+// it is -1 when the content of a file, or of a part added with SetBodyWriter or
+// AddAlternativeWriter, would have to be read to know it. The
+// function is called synchronously and should return quickly. A nil fn
+// disables the reporting.
+func (m *Message) SetProgressFunc(fn func(sent, total int64)) {
+	m.progress = fn
+}
+
+// SetAutoSubmitted sets the Auto-Submitted header field defined in RFC 3834,
+// so automatic responders do not reply to the message. The value is one of
+// "no", "auto-generated", "auto-replied" and "auto-notified", optionally
+// followed by parameters like in `auto-replied; owner-email="a@example.com"`.
+// An error is returned if the value is not valid.
+func (m *Message) SetAutoSubmitted(value string) error {
+	keyword, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return fmt.Errorf("gomail: invalid Auto-Submitted value %q: %w", value, err)
+	}
+	switch keyword {
+	case "no", "auto-generated", "auto-replied", "auto-notified":
+	default:
+		return fmt.Errorf("gomail: invalid Auto-Submitted value %q", value)
+	}
+	m.SetHeader("Auto-Submitted", value)
+	return nil
+}
+
+// SetDate sets the Date header field. The date is formatted in its own
+// location unless the SetUTCDates message setting is used. When no date is
+// set, the current time is used when the message is written.
+func (m *Message) SetDate(date time.Time) {
+	m.SetDateHeader("Date", date)
+}
+
 // SetDateHeader sets a date to the given header field.
 func (m *Message) SetDateHeader(field string, date time.Time) {
-	m.header[field] = []string{m.FormatDate(date)}
+	m.setField(field, []string{m.FormatDate(date)})
 }
 
 // FormatDate formats a date as a valid RFC 5322 date.
 func (m *Message) FormatDate(date time.Time) string {
+	if m.utcDates {
+		date = date.UTC()
+	}
 	return date.Format(time.RFC1123Z)
 }
 
-// GetHeader gets a header field.
+func (m *Message) now() time.Time {
+	if m.clock != nil {
+		return m.clock()
+	}
+	return now()
+}
+
+// GetHeader gets a header field. It returns all the values of a field set with
+// AddHeader.
 func (m *Message) GetHeader(field string) []string {
 	return m.header[field]
 }
 
+// Headers returns a copy of the header fields of the message. The fields
+// generated when the message is written, like Date or Message-ID, are not
+// included unless they were set.
+func (m *Message) Headers() map[string][]string {
+	h := make(map[string][]string, len(m.header))
+	for k, v := range m.header {
+		h[k] = append([]string(nil), v...)
+	}
+	return h
+}
+
+// DeleteHeader removes a header field, the field name is case insensitive.
+func (m *Message) DeleteHeader(field string) {
+	for k := range m.header {
+		if strings.EqualFold(k, field) {
+			m.deleteField(k)
+		}
+	}
+}
+
 // SetBody sets the body of the message. It replaces any content previously set
 // by SetBody, SetBodyWriter, AddAlternative or AddAlternativeWriter.
 func (m *Message) SetBody(contentType, body string, settings ...PartSetting) {
 	m.SetBodyWriter(contentType, newCopier(body), settings...)
+	m.parts[0].static = true
 }
 
 // SetBodyWriter sets the body of the message. It can be useful with the
@@ -220,6 +1043,7 @@ func (m *Message) SetBodyWriter(contentType string, f func(io.Writer) error, set
 // HTML part. See http://en.wikipedia.org/wiki/MIME#Alternative
 func (m *Message) AddAlternative(contentType, body string, settings ...PartSetting) {
 	m.AddAlternativeWriter(contentType, newCopier(body), settings...)
+	m.parts[len(m.parts)-1].static = true
 }
 
 func newCopier(s string) func(io.Writer) error {
@@ -235,6 +1059,36 @@ func (m *Message) AddAlternativeWriter(contentType string, f func(io.Writer) err
 	m.parts = append(m.parts, m.newPart(contentType, f, settings))
 }
 
+// SetCalendar adds a text/calendar alternative part with the iCalendar object
+// read from ics, so mail clients display the message as a meeting invitation.
+// The method is the iTIP method defined in RFC 5546, such as "REQUEST",
+// "CANCEL" or "REPLY", and must match the METHOD property of the object.
+// SetCalendar replaces the calendar part added by a previous call.
+func (m *Message) SetCalendar(method string, ics io.Reader, settings ...PartSetting) error {
+	method = strings.ToUpper(method)
+	switch method {
+	case "PUBLISH", "REQUEST", "REPLY", "ADD", "CANCEL", "REFRESH", "COUNTER", "DECLINECOUNTER":
+	default:
+		return fmt.Errorf("gomail: invalid iCalendar method %q", method)
+	}
+
+	b, err := ioutil.ReadAll(ics)
+	if err != nil {
+		return fmt.Errorf("gomail: could not read iCalendar object: %w", err)
+	}
+
+	parts := m.parts[:0]
+	for _, p := range m.parts {
+		if !strings.HasPrefix(p.contentType, "text/calendar") {
+			parts = append(parts, p)
+		}
+	}
+	p := m.newPart("text/calendar; method="+method, newCopier(string(b)), settings)
+	p.static = true
+	m.parts = append(parts, p)
+	return nil
+}
+
 func (m *Message) newPart(contentType string, f func(io.Writer) error, settings []PartSetting) *part {
 	p := &part{
 		contentType: contentType,
@@ -262,10 +1116,74 @@ func SetPartEncoding(e Encoding) PartSetting {
 	}
 }
 
+// SetPartCharset sets the charset of the part added to the message. By
+// default, parts use the same charset than the message. The content must
+// already be encoded in this charset.
+func SetPartCharset(charset string) PartSetting {
+	return func(p *part) {
+		p.charset = charset
+	}
+}
+
 type file struct {
-	Name     string
-	Header   map[string][]string
-	CopyFunc func(w io.Writer) error
+	Name        string
+	Header      map[string][]string
+	CopyFunc    func(w io.Writer) error
+	Disposition string
+	// Encoding is the transfer encoding of the file content, Base64 when
+	// empty. Unencoded content is sent as 7bit or 8bit.
+	Encoding Encoding
+
+	// size returns the length of the content without reading it, it is nil
+	// when the length is unknown.
+	size func() (int64, error)
+	// sniff is set to detect the media type from the content.
+	sniff bool
+	// charset replaces the charset of the media type derived from the name.
+	charset string
+	// sanitize cleans the name before it is written, sanitizeFilename is
+	// used when nil.
+	sanitize func(string) string
+	// mediaType replaces the media type derived from the name.
+	mediaType string
+	// oneShot is set when the content is read from an io.Reader that cannot
+	// be rewound, it can then only be read once.
+	oneShot bool
+}
+
+// name returns the sanitized name of the file.
+func (f *file) name() string {
+	if f.sanitize == nil {
+		return sanitizeFilename(f.Name)
+	}
+	return f.sanitize(f.Name)
+}
+
+// sanitizeFilename removes the directories and the control characters of a
+// file name.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// contentID returns the Content-ID of the file, without angle brackets.
+func (f *file) contentID() string {
+	if v := f.Header["Content-ID"]; len(v) > 0 {
+		return strings.TrimSuffix(strings.TrimPrefix(v[0], "<"), ">")
+	}
+	return f.name()
 }
 
 func (f *file) setHeader(field, value string) {
@@ -296,14 +1214,69 @@ func Rename(name string) FileSetting {
 	}
 }
 
+// SetContentDisposition is a file setting to set the disposition of the file,
+// either "inline" or "attachment". By default attached files use "attachment"
+// and embedded files use "inline". Inline files always get a Content-ID so they
+// can be referenced from an HTML body.
+func SetContentDisposition(disposition string) FileSetting {
+	return func(f *file) {
+		f.Disposition = disposition
+	}
+}
+
+// SetContentID is a file setting to set the Content-ID of an embedded file,
+// referenced with "cid:" followed by id in an HTML body. It defaults to the
+// file name. The angle brackets of the header field are added to id.
+func SetContentID(id string) FileSetting {
+	return func(f *file) {
+		f.setHeader("Content-ID", "<"+strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")+">")
+	}
+}
+
+// SetFileCharset is a file setting to set the charset parameter of the media
+// type derived from the file name or its content, for example to attach a text
+// file encoded in ISO-8859-1. It has no effect when the Content-Type is set
+// with SetHeader.
+func SetFileCharset(charset string) FileSetting {
+	return func(f *file) {
+		f.charset = charset
+	}
+}
+
+// SetContentTypeSniffing is a file setting to detect the media type of the
+// file from its first 512 bytes, with http.DetectContentType, when it is not
+// set with SetHeader and the extension of the file name is unknown or maps to
+// application/octet-stream.
+func SetContentTypeSniffing(enabled bool) FileSetting {
+	return func(f *file) {
+		f.sniff = enabled
+	}
+}
+
+// SetFilenameSanitizer is a file setting to replace the function cleaning the
+// file name before it is written in the Content-Type, Content-Disposition and
+// Content-ID header fields. By default the directories and the control
+// characters are removed, a nil function disables the sanitization.
+func SetFilenameSanitizer(sanitize func(name string) string) FileSetting {
+	return func(f *file) {
+		if sanitize == nil {
+			sanitize = func(name string) string { return name }
+		}
+		f.sanitize = sanitize
+	}
+}
+
 // SetCopyFunc is a file setting to replace the function that runs when the
 // message is sent. It should copy the content of the file to the io.Writer.
 //
 // The default copy function opens the file with the given filename, and copy
-// its content to the io.Writer.
+// its content to the io.Writer. The size of the file on disk is not used since
+// the content comes from f.
 func SetCopyFunc(f func(io.Writer) error) FileSetting {
 	return func(fi *file) {
 		fi.CopyFunc = f
+		fi.size = nil
+		fi.oneShot = false
 	}
 }
 
@@ -312,11 +1285,45 @@ func (m *Message) AttachReader(name string, r io.Reader, settings ...FileSetting
 	m.attachments = m.appendFile(m.attachments, fileFromReader(name, r), settings)
 }
 
-// Attach attaches the files to the email.
+// Attach attaches the files to the email. The file is only opened when the
+// message is written and its content is streamed, so large files are never
+// loaded into memory.
 func (m *Message) Attach(filename string, settings ...FileSetting) {
 	m.attachments = m.appendFile(m.attachments, fileFromFilename(filename), settings)
 }
 
+// AttachFS attaches the file read from fsys, for example an embed.FS. Like
+// with Attach, the file is only opened when the message is written.
+func (m *Message) AttachFS(fsys fs.FS, name string, settings ...FileSetting) {
+	m.attachments = m.appendFile(m.attachments, fileFromFS(fsys, name), settings)
+}
+
+// AttachMessage attaches the forwarded message to the email as a
+// message/rfc822 part, so mail clients display it as an embedded email.
+func (m *Message) AttachMessage(name string, forwarded *Message, settings ...FileSetting) {
+	f := &file{
+		Name:   filepath.Base(name),
+		Header: make(map[string][]string),
+		CopyFunc: func(w io.Writer) error {
+			_, err := forwarded.WriteTo(w)
+			return err
+		},
+	}
+	m.attachments = m.appendFile(m.attachments, asMessageFile(f), settings)
+}
+
+// AttachMessageReader attaches the raw message read from r to the email as a
+// message/rfc822 part.
+func (m *Message) AttachMessageReader(name string, r io.Reader, settings ...FileSetting) {
+	m.attachments = m.appendFile(m.attachments, asMessageFile(fileFromReader(name, r)), settings)
+}
+
+func asMessageFile(f *file) *file {
+	f.mediaType = "message/rfc822"
+	f.Encoding = Unencoded
+	return f
+}
+
 // EmbedReader embeds the images to the email.
 func (m *Message) EmbedReader(name string, r io.Reader, settings ...FileSetting) {
 	m.embedded = m.appendFile(m.embedded, fileFromReader(name, r), settings)
@@ -327,6 +1334,49 @@ func (m *Message) Embed(filename string, settings ...FileSetting) {
 	m.embedded = m.appendFile(m.embedded, fileFromFilename(filename), settings)
 }
 
+// EmbedFS embeds the image read from fsys, for example an embed.FS.
+func (m *Message) EmbedFS(fsys fs.FS, name string, settings ...FileSetting) {
+	m.embedded = m.appendFile(m.embedded, fileFromFS(fsys, name), settings)
+}
+
+// EmbeddedContentIDs returns the Content-IDs of the embedded files, without
+// angle brackets, mapped by file name, so an HTML body can reference them with
+// "cid:" followed by the ID.
+func (m *Message) EmbeddedContentIDs() map[string]string {
+	ids := make(map[string]string, len(m.embedded))
+	for _, f := range m.embedded {
+		ids[f.Name] = f.contentID()
+	}
+	return ids
+}
+
+// checkContentIDs returns an error when two inline files have the same
+// Content-ID.
+func (m *Message) checkContentIDs() error {
+	seen := make(map[string]bool, len(m.embedded))
+	check := func(f *file) error {
+		id := f.contentID()
+		if seen[id] {
+			return fmt.Errorf("gomail: duplicate Content-ID %q", id)
+		}
+		seen[id] = true
+		return nil
+	}
+	for _, f := range m.embedded {
+		if err := check(f); err != nil {
+			return err
+		}
+	}
+	for _, f := range m.attachments {
+		if _, ok := f.Header["Content-ID"]; ok || f.Disposition == "inline" {
+			if err := check(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func fileFromFilename(name string) *file {
 	return &file{
 		Name:   filepath.Base(name),
@@ -342,16 +1392,63 @@ func fileFromFilename(name string) *file {
 			}
 			return h.Close()
 		},
+		size: func() (int64, error) {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return 0, err
+			}
+			return fi.Size(), nil
+		},
 	}
 }
 
-func fileFromReader(name string, r io.Reader) *file {
+func fileFromFS(fsys fs.FS, name string) *file {
 	return &file{
-		Name:   filepath.Base(name),
+		Name:   path.Base(name),
 		Header: make(map[string][]string),
 		CopyFunc: func(w io.Writer) error {
+			h, err := fsys.Open(name)
+			if err != nil {
+				return fmt.Errorf("fileFromFS failed to open: %w", err)
+			}
+			if _, err := io.Copy(w, h); err != nil {
+				h.Close()
+				return fmt.Errorf("fileFromFS failed to copy with error: %w", err)
+			}
+			return h.Close()
+		},
+		size: func() (int64, error) {
+			fi, err := fs.Stat(fsys, name)
+			if err != nil {
+				return 0, err
+			}
+			return fi.Size(), nil
+		},
+	}
+}
+
+func fileFromReader(name string, r io.Reader) *file {
+	// Remember the position of seekable readers so the file can be written
+	// again, for example by a copy of the message.
+	var offset int64 = -1
+	if s, ok := r.(io.Seeker); ok {
+		if o, err := s.Seek(0, io.SeekCurrent); err == nil {
+			offset = o
+		}
+	}
+
+	return &file{
+		Name:    filepath.Base(name),
+		Header:  make(map[string][]string),
+		oneShot: offset < 0,
+		CopyFunc: func(w io.Writer) error {
+			if offset >= 0 {
+				if _, err := r.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+					return fmt.Errorf("fileFromReader failed to seek with error: %w", err)
+				}
+			}
 			if _, err := io.Copy(w, r); err != nil {
-				return fmt.Errorf("fileFromFilename failed to copy with error: %w", err)
+				return fmt.Errorf("fileFromReader failed to copy with error: %w", err)
 			}
 			return nil
 		},
@@ -3,14 +3,25 @@ package mail
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"embed"
 	"encoding/base64"
+	"errors"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -18,8 +29,11 @@ func init() {
 	now = func() time.Time {
 		return time.Date(2014, 0o6, 25, 17, 46, 0, 0, time.UTC)
 	}
+	randReader = zeroReader{}
 }
 
+const testMessageID = "<1403718360000000000.000000000000000000000000@example.com>"
+
 type message struct {
 	from    string
 	to      []string
@@ -64,240 +78,1419 @@ func TestMessage(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
-func TestCustomMessage(t *testing.T) {
-	m := NewMessage(SetCharset("ISO-8859-1"), SetEncoding(Base64))
-	m.SetHeaders(map[string][]string{
-		"From":    {"from@example.com"},
-		"To":      {"to@example.com"},
-		"Subject": {"Café"},
-	})
-	m.SetBody("text/html", "¡Hola, señor!")
+func TestFrom(t *testing.T) {
+	m := NewMessage()
+	if err := m.SetFrom("Señor From <from@example.com>", "from2@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	m.SetHeader("To", "to@example.com")
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
-		content: "From: from@example.com\r\n" +
-			"To: to@example.com\r\n" +
-			"Subject: =?ISO-8859-1?b?Q2Fmw6k=?=\r\n" +
-			"Content-Type: text/html; charset=ISO-8859-1\r\n" +
-			"Content-Transfer-Encoding: base64\r\n" +
-			"\r\n" +
-			"wqFIb2xhLCBzZcOxb3Ih",
+		content: "Sender: =?UTF-8?q?Se=C3=B1or_From?= <from@example.com>\r\n" +
+			"From: =?UTF-8?q?Se=C3=B1or_From?= <from@example.com>, from2@example.com\r\n" +
+			"To: to@example.com\r\n",
+	}
+	testMessage(t, m, 0, want)
+
+	if err := m.SetSender("from2@example.com"); err != nil {
+		t.Fatal(err)
 	}
+	want.from = "from2@example.com"
+	want.content = "From: =?UTF-8?q?Se=C3=B1or_From?= <from@example.com>, from2@example.com\r\n" +
+		"Sender: from2@example.com\r\n" +
+		"To: to@example.com\r\n"
+	testMessage(t, m, 0, want)
 
+	if err := m.SetFrom("from@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	delete(m.header, "Sender")
+	want.from = "from@example.com"
+	want.content = "From: from@example.com\r\n" +
+		"To: to@example.com\r\n"
 	testMessage(t, m, 0, want)
+
+	if err := m.SetFrom(); err == nil {
+		t.Error("expected an error without address")
+	}
+	if err := m.SetFrom("from@example.com", "invalid"); err == nil {
+		t.Error("expected an error with an invalid address")
+	}
+	if err := m.SetSender("invalid"); err == nil {
+		t.Error("expected an error with an invalid Sender")
+	}
+
+	m.SetHeader("Sender", "from@example.com", "from2@example.com")
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error with several Sender addresses")
+	}
+	if _, err := m.getFrom(); err == nil {
+		t.Error("expected an error with several Sender addresses")
+	}
 }
 
-func TestUnencodedMessage(t *testing.T) {
-	m := NewMessage(SetEncoding(Unencoded))
-	m.SetHeaders(map[string][]string{
-		"From":    {"from@example.com"},
-		"To":      {"to@example.com"},
-		"Subject": {"Café"},
+func TestAddressHeaders(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetAddressHeaders("To", map[string]string{
+		"c@example.com": "Señor C",
+		"a@example.com": "Zoë",
+		"b@example.com": "",
 	})
-	m.SetBody("text/html", "¡Hola, señor!")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"a@example.com", "b@example.com", "c@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: =?UTF-8?q?Zo=C3=AB?= <a@example.com>, b@example.com,\r\n" +
+			" =?UTF-8?q?Se=C3=B1or_C?= <c@example.com>\r\n",
+	}
+	testMessage(t, m, 0, want)
+}
+
+func TestDisplayNameSpecials(t *testing.T) {
+	for _, name := range []string{"Müller, Hans", `O'Brien "The Boss"`, `Müller "Hans"`, `Hans, \ Müller`} {
+		m := NewMessage()
+		m.SetAddressHeader("To", "hans@example.com", name)
+		if err := m.SetFrom(m.FormatAddress("from@example.com", name)); err != nil {
+			t.Fatal(err)
+		}
+		m.SetHeader("Cc", `"`+strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name)+`" <cc@example.com>, other@example.com`)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(mustBytes(t, m)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for field, want := range map[string][]string{
+			"To":   {"hans@example.com"},
+			"From": {"from@example.com"},
+			"Cc":   {"cc@example.com", "other@example.com"},
+		} {
+			list, err := msg.Header.AddressList(field)
+			if err != nil {
+				t.Errorf("%s: invalid %s field %q: %v", name, field, msg.Header.Get(field), err)
+				continue
+			}
+			if len(list) != len(want) || list[0].Name != name || list[0].Address != want[0] {
+				t.Errorf("%s: invalid %s addresses, got %q", name, field, list)
+			}
+		}
+	}
+}
+
+func mustBytes(t *testing.T, m *Message) []byte {
+	t.Helper()
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFormatGroup(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetRawHeader("To",
+		m.FormatGroup("Team", "a@example.com", m.FormatAddress("b@example.com", "Señor B")),
+		"c@example.com",
+	)
+	m.SetRawHeader("Cc", m.FormatGroup("Équipe", "d@example.com"), m.FormatGroup("undisclosed-recipients"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: \"Team\": a@example.com, =?UTF-8?q?Se=C3=B1or_B?= <b@example.com>;,\r\n" +
+			" c@example.com\r\n" +
+			"Cc: =?UTF-8?q?=C3=89quipe?=: d@example.com;, \"undisclosed-recipients\":;\r\n",
+	}
+	testMessage(t, m, 0, want)
+
+	m.SetRawHeader("Bcc", "Broken: a@example.com, invalid;")
+	if _, err := m.Recipients(); err == nil {
+		t.Error("expected an error with an invalid group member")
+	}
+}
+
+func TestReplyTo(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	if err := m.SetReplyTo("old@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetReplyTo(
+		"reply@example.com",
+		"Señor Reply <reply2@example.com>",
+		m.FormatAddress("reply3@example.com", "A, B"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetReplyTo("reply@example.com", "invalid address"); err == nil {
+		t.Error("expected an error with an invalid address")
+	}
+	if err := m.SetReplyTo(); err == nil {
+		t.Error("expected an error without address")
+	}
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"Reply-To: reply@example.com, =?UTF-8?q?Se=C3=B1or_Reply?=\r\n" +
+			" <reply2@example.com>, \"A, B\" <reply3@example.com>\r\n",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m.SetReplyToName("reply@example.com", "Señor Reply")
+	want.content = "From: from@example.com\r\n" +
+		"Reply-To: =?UTF-8?q?Se=C3=B1or_Reply?= <reply@example.com>\r\n"
+
+	testMessage(t, m, 0, want)
+}
+
+func TestListUnsubscribe(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	if err := m.SetListUnsubscribeOneClick("mailto:unsub@example.com?subject=unsubscribe", "<https://example.com/unsub?id=42>"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"List-Unsubscribe: <mailto:unsub@example.com?subject=unsubscribe>,\r\n" +
+			" <https://example.com/unsub?id=42>\r\n" +
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+	}
+	testMessage(t, m, 0, want)
+
+	if err := m.SetListUnsubscribe("mailto:unsub@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	want.content = "From: from@example.com\r\n" +
+		"List-Unsubscribe: <mailto:unsub@example.com>\r\n"
+	testMessage(t, m, 0, want)
+}
+
+func TestListUnsubscribeInvalid(t *testing.T) {
+	m := NewMessage()
+	if err := m.SetListUnsubscribe(); err == nil {
+		t.Error("expected an error without URL")
+	}
+	if err := m.SetListUnsubscribe("ftp://example.com/unsub"); err == nil {
+		t.Error("expected an error with an ftp URL")
+	}
+	if err := m.SetListUnsubscribeOneClick("mailto:unsub@example.com"); err == nil {
+		t.Error("expected an error for one-click without https URL")
+	}
+	if len(m.GetHeader("List-Unsubscribe")) != 0 {
+		t.Error("the header should not be set on error")
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	if err := m.SetContentLanguage("de-CH"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"Content-Language: de-CH\r\n",
+	}
+	testMessage(t, m, 0, want)
+
+	if err := m.SetContentLanguage("en", "zh-Hant-TW", "x-klingon"); err != nil {
+		t.Fatal(err)
+	}
+	want.content = "From: from@example.com\r\n" +
+		"Content-Language: en, zh-Hant-TW, x-klingon\r\n"
+	testMessage(t, m, 0, want)
+
+	for _, tags := range [][]string{nil, {""}, {"en_US"}, {"en-"}, {"1en"}, {"en", "de, fr"}, {"toolongsubtag"}} {
+		if err := m.SetContentLanguage(tags...); err == nil {
+			t.Errorf("expected an error for %q", tags)
+		}
+	}
+	if got := m.GetHeader("Content-Language"); len(got) != 3 {
+		t.Errorf("the header should not be changed on error, got %q", got)
+	}
+}
+
+func TestDate(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	date := time.Date(2014, 6, 26, 2, 46, 0, 0, tokyo)
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetDate(date)
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\r\nDate: Thu, 26 Jun 2014 02:46:00 +0900\r\n") {
+		t.Errorf("invalid Date header:\n%s", buf.String())
+	}
+
+	m = NewMessage(SetUTCDates(true), SetClock(func() time.Time { return date }))
+	m.SetHeader("From", "from@example.com")
+	m.SetDateHeader("X-Date", date)
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"X-Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n",
+	}
+	testMessage(t, m, 0, want)
+
+	clock := time.Date(2020, 1, 2, 3, 4, 5, 0, tokyo)
+	m = NewMessage(SetClock(func() time.Time { return clock }))
+	m.SetHeader("From", "from@example.com")
+
+	buf.Reset()
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "MIME-Version: 1.0\r\n"+
+		"Date: Thu, 02 Jan 2020 03:04:05 +0900\r\n"+
+		"Message-ID: <"+strconv.FormatInt(clock.UnixNano(), 10)+".") {
+		t.Errorf("the clock should be used for generated fields:\n%s", buf.String())
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("Subject", "Hello!")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Message-ID", "<id@example.com>")
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("X-Mailer", "mailgo")
+	m.SetHeader("Bcc", "bcc@example.com")
+	m.SetHeader("Subject", "Hello again!")
+	m.SetBody("text/plain", "Test")
+
+	headerBlock := func() string {
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()[:strings.Index(buf.String(), "\r\n\r\n")+2]
+	}
+
+	want := "MIME-Version: 1.0\r\n" +
+		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
+		"Subject: Hello again!\r\n" +
+		"To: to@example.com\r\n" +
+		"Message-ID: <id@example.com>\r\n" +
+		"From: from@example.com\r\n" +
+		"X-Mailer: mailgo\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n"
+	if got := headerBlock(); got != want {
+		t.Errorf("the fields should be written in insertion order, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	m.SetHeaderOrder([]string{"from", "To", "Subject", "Date", "Missing"})
+	want = "From: from@example.com\r\n" +
+		"To: to@example.com\r\n" +
+		"Subject: Hello again!\r\n" +
+		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Message-ID: <id@example.com>\r\n" +
+		"X-Mailer: mailgo\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n"
+	if got := headerBlock(); got != want {
+		t.Errorf("invalid field order, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := m.SetListUnsubscribeOneClick("https://example.com/unsubscribe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetListUnsubscribe("mailto:unsubscribe@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	m.SetHeader("X-Mailer", "mailgo", "again")
+	if got := headerBlock(); !strings.HasSuffix(got, "X-Mailer: mailgo, again\r\n"+
+		"List-Unsubscribe: <mailto:unsubscribe@example.com>\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n") {
+		t.Errorf("a deleted field should not be written, got:\n%s", got)
+	}
+}
+
+func TestAddHeader(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.AddHeader("Received", "from a.example.com by b.example.com")
+	m.AddHeader("Received", "from c.example.com by a.example.com")
+	m.AddHeader("Comments", "Señor")
+
+	if got := m.GetHeader("Received"); len(got) != 2 {
+		t.Errorf("GetHeader should return all the values, got %q", got)
+	}
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"Received: from a.example.com by b.example.com\r\n" +
+			"Received: from c.example.com by a.example.com\r\n" +
+			"Comments: =?UTF-8?q?Se=C3=B1or?=\r\n",
+	}
+	testMessage(t, m, 0, want)
+
+	m.SetHeader("Received", "from d.example.com", "by e.example.com")
+	want.content = "From: from@example.com\r\n" +
+		"Received: from d.example.com, by e.example.com\r\n" +
+		"Comments: =?UTF-8?q?Se=C3=B1or?=\r\n"
+	testMessage(t, m, 0, want)
+}
+
+func TestDeleteHeader(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("X-Internal-Id", "42")
+	m.SetHeader("x-internal-id", "43")
+	m.SetHeader("X-Mailer", "mailgo")
+	m.AddHeader("Received", "from a.example.com")
+
+	h := m.Headers()
+	if len(h) != 5 || h["X-Mailer"][0] != "mailgo" {
+		t.Errorf("invalid headers, got %q", h)
+	}
+	h["X-Mailer"][0] = "changed"
+	if m.GetHeader("X-Mailer")[0] != "mailgo" {
+		t.Error("Headers should return a copy")
+	}
+
+	m.DeleteHeader("X-INTERNAL-ID")
+	m.DeleteHeader("Missing")
+	if _, ok := m.Headers()["X-Internal-Id"]; ok {
+		t.Error("the field should be deleted")
+	}
+
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.ToLower(b), []byte("x-internal-id")) {
+		t.Errorf("the deleted field should not be written:\n%s", b)
+	}
+	if !bytes.Contains(b, []byte("X-Mailer: mailgo\r\nReceived: from a.example.com\r\n")) {
+		t.Errorf("the other fields should be kept in order:\n%s", b)
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("Subject", "x\r\nBcc: attacker@evil")
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "\nBcc:") {
+		t.Fatalf("header injected:\n%s", buf.String())
+	}
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); got != "x\r\nBcc: attacker@evil" {
+		t.Errorf("invalid decoded Subject, got %q", got)
+	}
+
+	for name, set := range map[string]func(m *Message){
+		"raw value":    func(m *Message) { m.SetRawHeader("Subject", "x\r\nBcc: attacker@evil") },
+		"bare LF":      func(m *Message) { m.SetRawHeader("Subject", "x\nBcc: attacker@evil") },
+		"bare CR":      func(m *Message) { m.SetRawHeader("Subject", "x\rBcc: attacker@evil") },
+		"trailing":     func(m *Message) { m.SetRawHeader("Subject", "x\r\n") },
+		"field name":   func(m *Message) { m.SetRawHeader("Subject: x\r\nBcc", "attacker@evil") },
+		"address":      func(m *Message) { m.SetAddressHeader("To", "to@example.com>\r\nBcc: <attacker@evil", "") },
+		"content type": func(m *Message) { m.SetBody("text/plain\r\nBcc: attacker@evil", "Test") },
+		"file header": func(m *Message) {
+			m.Attach(mockCopyFileWithHeader(m, "test.pdf", map[string][]string{"X-Test": {"x\r\nBcc: attacker@evil"}}))
+		},
+	} {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		set(m)
+		if _, err := m.WriteTo(ioutil.Discard); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	m = NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetRawHeader("X-Folded", "a\r\n b")
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"X-Folded: a\r\n" +
+			" b\r\n",
+	}
+	testMessage(t, m, 0, want)
+}
+
+func TestMessageID(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("Message-ID", "<custom@example.com>")
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(buf.String(), "Message-ID: "); got != 1 {
+		t.Fatalf("expected exactly one Message-ID, got %d:\n%s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "Message-ID: <custom@example.com>\r\n") {
+		t.Errorf("explicit Message-ID not preserved:\n%s", buf.String())
+	}
+
+	randReader = rand.Reader
+	defer func() { randReader = zeroReader{} }()
+
+	re := regexp.MustCompile(`(?m)^Message-ID: <\d+\.[0-9a-f]{24}@(.+)>\r$`)
+	ids := make(map[string]bool)
+	for _, domain := range []string{"", "mail.example.org"} {
+		m := NewMessage()
+		m.SetAddressHeader("From", "from@Example.com", "Señor From")
+		m.SetMessageIDDomain(domain)
+
+		for i := 0; i < 2; i++ {
+			buf.Reset()
+			if _, err := m.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			match := re.FindStringSubmatch(buf.String())
+			if match == nil {
+				t.Fatalf("invalid generated Message-ID:\n%s", buf.String())
+			}
+			wantDomain := domain
+			if wantDomain == "" {
+				wantDomain = "Example.com"
+			}
+			if match[1] != wantDomain {
+				t.Errorf("invalid Message-ID domain, got %q, want %q", match[1], wantDomain)
+			}
+			if ids[match[0]] {
+				t.Errorf("duplicate Message-ID %q", match[0])
+			}
+			ids[match[0]] = true
+		}
+	}
+
+	m = NewMessage(SetAutoMessageID(false))
+	m.SetHeader("From", "from@example.com")
+	buf.Reset()
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Message-ID") {
+		t.Errorf("Message-ID should not be generated:\n%s", buf.String())
+	}
+}
+
+func TestCopy(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
+	m.AttachReader("file.txt", strings.NewReader("Test file"))
+
+	c := m.Copy()
+	c.SetHeader("To", "copy@example.com")
+	c.SetHeader("Subject", "Copy")
+	c.SetBody("text/html", "Copy")
+	c.attachments[0].Header["X-Copy"] = []string{"true"}
+	c.Attach(mockCopyFile("/tmp/test.zip"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=utf-8; name=\"file.txt\"\r\n" +
+			"Content-Disposition: attachment; filename=\"file.txt\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Test file")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+	testMessage(t, m, 1, want)
+
+	if got := c.GetHeader("To"); len(got) != 1 || got[0] != "copy@example.com" {
+		t.Errorf("invalid To header in copy, got %q", got)
+	}
+	if len(c.attachments) != 3 || c.parts[0].contentType != "text/html" {
+		t.Error("the copy was not modified")
+	}
+
+	// The copy can still write the shared reader.
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), base64.StdEncoding.EncodeToString([]byte("Test file"))) {
+		t.Errorf("the copy should contain the reader attachment:\n%s", buf.String())
+	}
+}
+
+func TestSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailgo-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.bin")
+	if err := ioutil.WriteFile(name, bytes.Repeat([]byte("0123456789"), 1000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	simple := NewMessage()
+	simple.SetHeader("From", "from@example.com")
+	simple.SetHeader("Subject", "¡Hola, señor!")
+	simple.SetBody("text/plain", "Test")
+
+	full := NewMessage()
+	full.SetHeader("From", "from@example.com")
+	full.SetHeader("To", "to@example.com")
+	full.SetBody("text/plain", strings.Repeat("¡Hola, señor! ", 100))
+	full.AddAlternative("text/html", "<p>¡Hola, señor!</p>", SetPartEncoding(Base64))
+	full.Embed(name)
+	full.Attach(name)
+	full.AttachReader("test.txt", strings.NewReader("Test"))
+	full.AttachMessage("forwarded.eml", simple)
+
+	copied := NewMessage()
+	copied.SetHeader("From", "from@example.com")
+	copy := SetCopyFunc(func(w io.Writer) error {
+		_, err := io.WriteString(w, "Generated content")
+		return err
+	})
+	copied.Attach(name, copy)
+	copied.Attach(filepath.Join(dir, "generated.txt"), copy)
+
+	for _, m := range []*Message{simple, full, copied} {
+		size, err := m.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := m.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(b)) {
+			t.Errorf("invalid size, got %d, want %d", size, len(b))
+		}
+		if n, err := m.WriteTo(ioutil.Discard); err != nil || n != int64(len(b)) {
+			t.Errorf("invalid number of bytes written, got %d (%v), want %d", n, err, len(b))
+		}
+	}
+
+	oneShot := NewMessage()
+	oneShot.SetHeader("From", "from@example.com")
+	oneShot.AttachReader("test.txt", struct{ io.Reader }{strings.NewReader("Test")})
+	size, err := oneShot.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := oneShot.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(b, []byte("\r\n\r\nVGVzdA==")) {
+		t.Errorf("Size should not read a reader that cannot be rewound:\n%s", b)
+	}
+	if size >= int64(len(b)) {
+		t.Errorf("the content of the reader should not be counted, got %d, want less than %d", size, len(b))
+	}
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.Attach(filepath.Join(dir, "missing.bin"))
+	if _, err := m.Size(); err == nil {
+		t.Error("expected an error with a missing file")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	m := getTestMessage()
+	m.SetHeader("Message-ID", "<test@example.com>")
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
+	m.SetBoundary("_BOUNDARY_")
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareBodies(t, string(b), buf.String())
+
+	name := filepath.Join(t.TempDir(), "message.eml")
+	if err := m.WriteToFile(name); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareBodies(t, string(b), buf.String())
+
+	if err := m.WriteToFile(filepath.Join(name, "invalid.eml")); err == nil {
+		t.Error("expected an error with an invalid path")
+	}
+}
+
+func TestCustomMessage(t *testing.T) {
+	m := NewMessage(SetCharset("ISO-8859-1"), SetEncoding(Base64))
+	m.SetHeaders(map[string][]string{
+		"From":    {"from@example.com"},
+		"To":      {"to@example.com"},
+		"Subject": {"Café"},
+	})
+	m.SetBody("text/html", "¡Hola, señor!")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Subject: =?ISO-8859-1?b?Q2Fmw6k=?=\r\n" +
+			"Content-Type: text/html; charset=ISO-8859-1\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"wqFIb2xhLCBzZcOxb3Ih",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestUnencodedMessage(t *testing.T) {
+	m := NewMessage(SetEncoding(Unencoded))
+	m.SetHeaders(map[string][]string{
+		"From":    {"from@example.com"},
+		"To":      {"to@example.com"},
+		"Subject": {"Café"},
+	})
+	m.SetBody("text/html", "¡Hola, señor!")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Subject: =?UTF-8?q?Caf=C3=A9?=\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"¡Hola, señor!",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestRecipients(t *testing.T) {
+	m := NewMessage()
+	m.SetHeaders(map[string][]string{
+		"From":    {"from@example.com"},
+		"To":      {"to@example.com"},
+		"Cc":      {"cc@example.com"},
+		"Bcc":     {"bcc1@example.com", "bcc2@example.com"},
+		"Subject": {"Hello!"},
+	})
+	m.SetBody("text/plain", "Test message")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com", "cc@example.com", "bcc1@example.com", "bcc2@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Cc: cc@example.com\r\n" +
+			"Subject: Hello!\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestMessageRecipients(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to1@example.com", m.FormatAddress("To2@Example.COM", "Señor To"))
+	m.SetHeader("Cc", m.FormatAddress("to1@example.com", "To 1"), "cc@example.com")
+	m.SetHeader("Bcc", "to2@example.com", "bcc@EXAMPLE.com", "Cc@example.com")
+
+	got, err := m.Recipients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"to1@example.com", "To2@example.com", "cc@example.com", "to2@example.com", "bcc@example.com", "Cc@example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid recipients, got %q, want %q", got, want)
+	}
+
+	m.SetHeader("Cc", "invalid")
+	if _, err := m.Recipients(); err == nil {
+		t.Error("expected an error with an invalid address")
+	}
+}
+
+func TestAlternative(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "¡Hola, señor!")
+	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1Hola, se=C3=B1or!\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestPartSetting(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain; format=flowed", "¡Hola, señor!", SetPartEncoding(Unencoded))
+	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; format=flowed; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"¡Hola, señor!\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestPartEncodings(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBodyWriter("text/plain", newCopier("¡Hola, señor!"))
+	m.AddAlternative("text/plain; name=\"app.log\"", "line 1\r\nline 2", SetPartEncoding(Base64))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1Hola, se=C3=B1or!\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; name=\"app.log\"; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("line 1\r\nline 2")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestQuotedPrintableLines(t *testing.T) {
+	bodies := []string{
+		"trailing space \r\ntrailing tab\t\r\nlast line  ",
+		strings.Repeat("a", 74) + "é" + strings.Repeat("b", 80),
+		strings.Repeat("a", 73) + " =" + strings.Repeat("é", 40),
+		strings.Repeat(" ", 80) + "\r\n" + strings.Repeat("\t", 80),
+	}
+	for _, body := range bodies {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetBody("text/plain", body)
+
+		b, err := m.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := string(b[bytes.Index(b, []byte("\r\n\r\n"))+4:])
+		for _, line := range strings.Split(encoded, "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("line longer than 76 characters: %q", line)
+			}
+			if strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") {
+				t.Errorf("whitespace at the end of a line must be encoded: %q", line)
+			}
+		}
+
+		decoded, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != body {
+			t.Errorf("invalid decoded body, got %q, want %q", decoded, body)
+		}
+	}
+}
+
+func TestQuotedPrintableLongURL(t *testing.T) {
+	url := "https://click.example.com/track?redirect=" + strings.Repeat("a1b2c3%2Fd4=", 25)
+	html := `<p>Hello, <a href="` + url + `">click here</a>.</p>`
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Hello")
+	m.AddAlternative("text/html", html)
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			t.Fatal("the HTML part is missing: ", err)
+		}
+		if !strings.HasPrefix(p.Header.Get("Content-Type"), "text/html") {
+			continue
+		}
+		// The part is decoded by the multipart reader.
+		decoded, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != html {
+			t.Errorf("the URL does not survive the encoding, got %q, want %q", decoded, html)
+		}
+		break
+	}
+	for _, line := range strings.Split(string(b), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("line longer than 76 characters: %q", line)
+		}
+	}
+}
+
+func TestPartSettingWithCustomBoundary(t *testing.T) {
+	m := NewMessage()
+	m.SetBoundary("lalalaDaiMne3Ryblya")
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain; format=flowed", "¡Hola, señor!", SetPartEncoding(Unencoded))
+	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=lalalaDaiMne3Ryblya\r\n" +
+			"\r\n" +
+			"--lalalaDaiMne3Ryblya\r\n" +
+			"Content-Type: text/plain; format=flowed; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"¡Hola, señor!\r\n" +
+			"--lalalaDaiMne3Ryblya\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			"--lalalaDaiMne3Ryblya--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestInvalidBoundary(t *testing.T) {
+	m := NewMessage()
+	for _, b := range []string{"", strings.Repeat("a", 100), "with space", "trailing ", "semi;colon"} {
+		if err := m.SetValidatedBoundary(b); err == nil && b != "with space" {
+			t.Errorf("expected an error with boundary %q", b)
+		} else if err != nil && b == "with space" {
+			t.Errorf("a boundary can contain a space: %v", err)
+		}
+	}
+	if err := m.SetValidatedBoundary(strings.Repeat("a", 70)); err != nil {
+		t.Errorf("a boundary of 70 characters should be valid: %v", err)
+	}
+
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Test")
+	m.AddAlternative("text/html", "<p>Test</p>")
+	m.SetBoundary(strings.Repeat("a", 100))
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error when writing an invalid boundary")
+	}
+
+	m.SetBoundary("with space")
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(" boundary=\"with space\"\r\n")) {
+		t.Errorf("the boundary should be quoted:\n%s", b)
+	}
+	if _, err := ReadMessage(bytes.NewReader(b)); err != nil {
+		t.Errorf("the message should be readable: %v", err)
+	}
+
+	m.SetBoundary("frontier")
+	m.SetBody("text/plain", "Test\n--frontier\n", SetPartEncoding(Unencoded))
+	m.AddAlternative("text/html", "<p>Test</p>")
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error when the boundary appears in the content")
+	}
+	m.SetBody("text/plain", "Test --frontier", SetPartEncoding(Unencoded))
+	m.AddAlternative("text/html", "<p>Test</p>")
+	if _, err := m.WriteTo(ioutil.Discard); err != nil {
+		t.Errorf("the boundary can appear inside a line: %v", err)
+	}
+	m.SetBodyWriter("text/plain", func(w io.Writer) error {
+		for _, s := range []string{"Test\r", "\n-", "-front", "ier"} {
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, SetPartEncoding(Unencoded))
+	m.AddAlternative("text/html", "<p>Test</p>")
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error when the boundary is split across writes")
+	}
+}
+
+func newTestBoundaryFunc() func() string {
+	i := 0
+	return func() string {
+		i++
+		return "_BOUNDARY_" + strconv.Itoa(i) + "_"
+	}
+}
+
+func TestBoundaryFunc(t *testing.T) {
+	newMessage := func() *Message {
+		m := NewMessage()
+		m.SetBoundaryFunc(newTestBoundaryFunc())
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.SetHeader("Subject", "Golden")
+		m.SetBody("text/plain", "Test")
+		m.AddAlternative("text/html", `<img src="cid:image.jpg">`)
+		m.Embed(mockCopyFile("image.jpg"))
+		m.Attach(mockCopyFile("test.pdf"))
+		return m
+	}
+
+	m := newMessage()
+	first, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newMessage().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("serializations differ:\n%s\n\n%s", first, second)
+	}
+
+	boundaries := getBoundaries(t, 3, string(first))
+	for i, b := range boundaries {
+		if want := "_BOUNDARY_" + strconv.Itoa(i+1) + "_"; b != want {
+			t.Errorf("invalid boundary, got %q, want %q", b, want)
+		}
+	}
+
+	m.SetBoundaryFunc(func() string { return "_BOUNDARY_" })
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error with duplicate boundaries")
+	}
+}
+
+func TestBodyWriter(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBodyWriter("text/plain", func(w io.Writer) error {
+		_, err := w.Write([]byte("Test message"))
+		return err
+	})
+	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
+		_, err := w.Write([]byte("Test HTML"))
+		return err
+	})
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test HTML\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestAlternativeWriter(t *testing.T) {
+	html := "<p>" + strings.Repeat("¡Hola, señor! ", 100) + "</p>"
+	newMessage := func() *Message {
+		m := NewMessage()
+		m.SetBoundaryFunc(newTestBoundaryFunc())
+		m.SetHeader("From", "from@example.com")
+		m.SetBody("text/plain", "¡Hola, señor!")
+		return m
+	}
+
+	m := newMessage()
+	m.AddAlternative("text/html", html)
+	want, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = newMessage()
+	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
+		_, err := io.Copy(w, strings.NewReader(html))
+		return err
+	})
+	got, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("invalid message, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	errWrite := errors.New("template error")
+	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
+		return errWrite
+	})
+	if _, err := m.WriteTo(ioutil.Discard); !errors.Is(err, errWrite) {
+		t.Errorf("invalid error, got %v, want %v", err, errWrite)
+	}
+}
+
+func TestAttachmentReader(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+
+	var b bytes.Buffer
+	b.Write([]byte("Test file"))
+	m.AttachReader("file.txt", &b)
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Subject: =?UTF-8?q?Caf=C3=A9?=\r\n" +
-			"Content-Type: text/html; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: 8bit\r\n" +
+			"Content-Type: text/plain; charset=utf-8; name=\"file.txt\"\r\n" +
+			"Content-Disposition: attachment; filename=\"file.txt\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			"¡Hola, señor!",
+			base64.StdEncoding.EncodeToString([]byte("Test file")),
 	}
 
 	testMessage(t, m, 0, want)
 }
 
-func TestRecipients(t *testing.T) {
+//go:embed testdata/embedded.txt
+var testFS embed.FS
+
+func TestAttachmentFS(t *testing.T) {
 	m := NewMessage()
-	m.SetHeaders(map[string][]string{
-		"From":    {"from@example.com"},
-		"To":      {"to@example.com"},
-		"Cc":      {"cc@example.com"},
-		"Bcc":     {"bcc1@example.com", "bcc2@example.com"},
-		"Subject": {"Hello!"},
-	})
-	m.SetBody("text/plain", "Test message")
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.AttachFS(testFS, "testdata/embedded.txt")
 
 	want := &message{
 		from: "from@example.com",
-		to:   []string{"to@example.com", "cc@example.com", "bcc1@example.com", "bcc2@example.com"},
+		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Cc: cc@example.com\r\n" +
-			"Subject: Hello!\r\n" +
-			"Content-Type: text/plain; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"Content-Type: text/plain; charset=utf-8; name=\"embedded.txt\"\r\n" +
+			"Content-Disposition: attachment; filename=\"embedded.txt\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			"Test message",
+			base64.StdEncoding.EncodeToString([]byte("Embedded file\n")),
 	}
-
 	testMessage(t, m, 0, want)
+
+	m.AttachFS(testFS, "testdata/missing.txt")
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error with a missing file")
+	}
 }
 
-func TestAlternative(t *testing.T) {
+func TestEmbeddedFS(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.SetBody("text/plain", "¡Hola, señor!")
-	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+	m.EmbedFS(fstest.MapFS{"images/logo.png": {Data: []byte("PNG")}}, "images/logo.png")
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: multipart/alternative;\r\n" +
-			" boundary=_BOUNDARY_1_\r\n" +
-			"\r\n" +
-			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/plain; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: quoted-printable\r\n" +
-			"\r\n" +
-			"=C2=A1Hola, se=C3=B1or!\r\n" +
-			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/html; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"Content-Type: image/png; name=\"logo.png\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"Content-Disposition: inline; filename=\"logo.png\"\r\n" +
+			"Content-ID: <logo.png>\r\n" +
 			"\r\n" +
-			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
-			"--_BOUNDARY_1_--\r\n",
+			base64.StdEncoding.EncodeToString([]byte("PNG")),
 	}
+	testMessage(t, m, 0, want)
 
-	testMessage(t, m, 1, want)
+	if n, err := m.Size(); err != nil || n == 0 {
+		t.Errorf("invalid size %d: %v", n, err)
+	}
 }
 
-func TestPartSetting(t *testing.T) {
+func TestEmbeddedContentID(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.SetBody("text/plain; format=flowed", "¡Hola, señor!", SetPartEncoding(Unencoded))
-	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+	m.SetBody("text/html", `<img src="cid:logo@example.com">`)
+	m.EmbedReader("logo.png", strings.NewReader("PNG"), SetContentID("logo@example.com"))
+	m.EmbedReader("images/photo.jpg", strings.NewReader("JPG"))
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: multipart/alternative;\r\n" +
+			"Content-Type: multipart/related;\r\n" +
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/plain; format=flowed; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: 8bit\r\n" +
-			"\r\n" +
-			"¡Hola, señor!\r\n" +
-			"--_BOUNDARY_1_\r\n" +
 			"Content-Type: text/html; charset=UTF-8\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			`<img src=3D"cid:logo@example.com">` + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: image/png; name=\"logo.png\"\r\n" +
+			"Content-Disposition: inline; filename=\"logo.png\"\r\n" +
+			"Content-ID: <logo@example.com>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("PNG")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: image/jpeg; name=\"photo.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"photo.jpg\"\r\n" +
+			"Content-ID: <photo.jpg>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("JPG")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
-
 	testMessage(t, m, 1, want)
+
+	ids := m.EmbeddedContentIDs()
+	if len(ids) != 2 || ids["logo.png"] != "logo@example.com" || ids["photo.jpg"] != "photo.jpg" {
+		t.Errorf("invalid Content-IDs, got %v", ids)
+	}
+
+	m.EmbedReader("logo2.png", strings.NewReader("PNG"), SetContentID("<logo@example.com>"))
+	if _, err := m.WriteTo(ioutil.Discard); err == nil || !strings.Contains(err.Error(), "duplicate Content-ID") {
+		t.Errorf("expected a duplicate Content-ID error, got %v", err)
+	}
 }
 
-func TestPartSettingWithCustomBoundary(t *testing.T) {
+func TestFilenameSanitization(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"../../secret.txt", "secret.txt"},
+		{`..\..\secret.txt`, "secret.txt"},
+		{"evil.txt\r\nBcc: victim@example.com", "evil.txtBcc: victim@example.com"},
+		{"..", ""},
+		{"¡Hola!.txt", "¡Hola!.txt"},
+	}
+	for _, test := range tests {
+		if got := sanitizeFilename(test.name); got != test.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
 	m := NewMessage()
-	m.SetBoundary("lalalaDaiMne3Ryblya")
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.SetBody("text/plain; format=flowed", "¡Hola, señor!", SetPartEncoding(Unencoded))
-	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+	m.AttachReader("file.txt", strings.NewReader("Test file"), Rename("../../secret.txt"))
+	m.AttachReader("file.txt", strings.NewReader("Test file"), Rename("a\r\nb.txt"),
+		SetFilenameSanitizer(strings.ToUpper))
+	m.AttachReader("file.txt", strings.NewReader("Test file"), Rename("dir/raw.txt"),
+		SetFilenameSanitizer(nil))
 
-	want := &message{
-		from: "from@example.com",
-		to:   []string{"to@example.com"},
-		content: "From: from@example.com\r\n" +
-			"To: to@example.com\r\n" +
-			"Content-Type: multipart/alternative;\r\n" +
-			" boundary=lalalaDaiMne3Ryblya\r\n" +
-			"\r\n" +
-			"--lalalaDaiMne3Ryblya\r\n" +
-			"Content-Type: text/plain; format=flowed; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: 8bit\r\n" +
-			"\r\n" +
-			"¡Hola, señor!\r\n" +
-			"--lalalaDaiMne3Ryblya\r\n" +
-			"Content-Type: text/html; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: quoted-printable\r\n" +
-			"\r\n" +
-			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
-			"--lalalaDaiMne3Ryblya--\r\n",
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Content-Disposition: attachment; filename=\"secret.txt\"\r\n",
+		"Content-Disposition: attachment;\r\n filename*=UTF-8''A%0D%0AB.TXT\r\n",
+		"Content-Disposition: attachment; filename=\"dir/raw.txt\"\r\n",
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("missing %q in:\n%s", want, b)
+		}
 	}
-
-	testMessage(t, m, 1, want)
 }
 
-func TestBodyWriter(t *testing.T) {
+func TestCharsetSettings(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.SetBodyWriter("text/plain", func(w io.Writer) error {
-		_, err := w.Write([]byte("Test message"))
-		return err
-	})
-	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
-		_, err := w.Write([]byte("Test HTML"))
-		return err
-	})
+	m.SetBody("text/plain", "Été")
+	m.AddAlternative("text/html", "\xc9t\xe9", SetPartCharset("ISO-8859-1"))
+	m.AttachReader("legacy.txt", strings.NewReader("\xc9t\xe9"), SetFileCharset("ISO-8859-1"))
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: multipart/alternative;\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_2_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_\r\n" +
 			"Content-Type: text/plain; charset=UTF-8\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"Test message\r\n" +
-			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"=C3=89t=C3=A9\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/html; charset=ISO-8859-1\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"Test HTML\r\n" +
+			"=C9t=E9\r\n" +
+			"--_BOUNDARY_2_--\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=ISO-8859-1; name=\"legacy.txt\"\r\n" +
+			"Content-Disposition: attachment; filename=\"legacy.txt\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("\xc9t\xe9")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
-
-	testMessage(t, m, 1, want)
+	testMessage(t, m, 2, want)
 }
 
-func TestAttachmentReader(t *testing.T) {
+func TestAttachmentOnly(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-
-	var b bytes.Buffer
-	b.Write([]byte("Test file"))
-	m.AttachReader("file.txt", &b)
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: text/plain; charset=utf-8; name=\"file.txt\"\r\n" +
-			"Content-Disposition: attachment; filename=\"file.txt\"\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Test file")),
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")),
 	}
 
 	testMessage(t, m, 0, want)
 }
 
-func TestAttachmentOnly(t *testing.T) {
+func TestAttachment(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
 	m.Attach(mockCopyFile("/tmp/test.pdf"))
 
 	want := &message{
@@ -305,22 +1498,34 @@ func TestAttachmentOnly(t *testing.T) {
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test\r\n" +
+			"--_BOUNDARY_1_\r\n" +
 			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
 			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")),
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
 	}
 
-	testMessage(t, m, 0, want)
+	testMessage(t, m, 1, want)
 }
 
-func TestAttachment(t *testing.T) {
+func TestRename(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
 	m.SetBody("text/plain", "Test")
-	m.Attach(mockCopyFile("/tmp/test.pdf"))
+	name, copy := mockCopyFile("/tmp/test.pdf")
+	rename := Rename("another.pdf")
+	m.Attach(name, copy, rename)
 
 	want := &message{
 		from: "from@example.com",
@@ -336,8 +1541,8 @@ func TestAttachment(t *testing.T) {
 			"\r\n" +
 			"Test\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
-			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Content-Type: application/pdf; name=\"another.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"another.pdf\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
 			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
@@ -347,38 +1552,267 @@ func TestAttachment(t *testing.T) {
 	testMessage(t, m, 1, want)
 }
 
-func TestRename(t *testing.T) {
+func TestContentDisposition(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.SetBody("text/plain", "Test")
-	name, copy := mockCopyFile("/tmp/test.pdf")
-	rename := Rename("another.pdf")
-	m.Attach(name, copy, rename)
+	m.SetBody("text/html", `<img src="cid:image.jpg">`)
+	m.Embed(mockCopyFile("image.jpg"))
+	m.Embed(mockCopyFileWithDisposition("photo.jpg", "attachment"))
+	m.Attach(mockCopyFileWithDisposition("test.pdf", "inline"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: multipart/related;\r\n" +
+			" boundary=_BOUNDARY_2_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<img src=3D\"cid:image.jpg\">\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: image/jpeg; name=\"image.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"image.jpg\"\r\n" +
+			"Content-ID: <image.jpg>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of image.jpg")) + "\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: image/jpeg; name=\"photo.jpg\"\r\n" +
+			"Content-Disposition: attachment; filename=\"photo.jpg\"\r\n" +
+			"Content-ID: <photo.jpg>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of photo.jpg")) + "\r\n" +
+			"--_BOUNDARY_2_--\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: inline; filename=\"test.pdf\"\r\n" +
+			"Content-ID: <test.pdf>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 2, want)
+}
+
+func TestAttachMessage(t *testing.T) {
+	forwarded := NewMessage(SetEncoding(Unencoded))
+	forwarded.SetHeader("From", "alice@example.org")
+	forwarded.SetHeader("To", "from@example.com")
+	forwarded.SetHeader("Subject", "Café")
+	forwarded.SetBody("text/plain", "Un café ?")
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "See the forwarded message.")
+	m.AttachMessage("forwarded.eml", forwarded)
+	m.AttachMessageReader("raw.eml", strings.NewReader("From: bob@example.org\r\n\r\nHello"))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, mr := getMultipart(t, buf.Bytes(), "multipart/mixed")
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct{ name, cte, from string }{
+		{"forwarded.eml", "8bit", "alice@example.org"},
+		{"raw.eml", "7bit", "bob@example.org"},
+	} {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := p.Header.Get("Content-Type"); ct != `message/rfc822; name="`+want.name+`"` {
+			t.Errorf("invalid Content-Type, got %q", ct)
+		}
+		if cte := p.Header.Get("Content-Transfer-Encoding"); cte != want.cte {
+			t.Errorf("invalid Content-Transfer-Encoding, got %q, want %q", cte, want.cte)
+		}
+
+		nested, err := ReadMessage(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nested.GetHeader("From"); len(got) != 1 || got[0] != want.from {
+			t.Errorf("invalid nested From header, got %q, want %q", got, want.from)
+		}
+		if want.name == "forwarded.eml" {
+			if got := nested.GetHeader("Subject"); len(got) != 1 || got[0] != "=?UTF-8?q?Caf=C3=A9?=" {
+				t.Errorf("invalid nested Subject header, got %q", got)
+			}
+			var body bytes.Buffer
+			if err := nested.parts[0].copier(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.String() != "Un café ?" {
+				t.Errorf("invalid nested body, got %q", body.String())
+			}
+		}
+	}
+
+	m = NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "See the forwarded messages.")
+	m.AttachMessage("forwarded.eml", forwarded, Rename("renamed.eml"))
+	m.AttachMessageReader(`Отчёт "q".eml`, strings.NewReader("From: bob@example.org\r\n\r\nHello"))
+	buf.Reset()
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, mr = getMultipart(t, buf.Bytes(), "multipart/mixed")
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"renamed.eml", `Отчёт "q".eml`} {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil || mediaType != "message/rfc822" || params["name"] != want {
+			t.Errorf("invalid Content-Type, got %q, want the name %q", p.Header.Get("Content-Type"), want)
+		}
+		if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err != nil || params["filename"] != want {
+			t.Errorf("invalid Content-Disposition, got %q, want the filename %q", p.Header.Get("Content-Disposition"), want)
+		}
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\n" +
+		"METHOD:REQUEST\r\n" +
+		"END:VCALENDAR\r\n"
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Invitation")
+	m.AddAlternative("text/html", "<p>Invitation</p>")
+	if err := m.SetCalendar("CANCEL", strings.NewReader(ics)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetCalendar("request", strings.NewReader(ics)); err != nil {
+		t.Fatal(err)
+	}
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: multipart/mixed;\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
 			"Content-Type: text/plain; charset=UTF-8\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"Test\r\n" +
+			"Invitation\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: application/pdf; name=\"another.pdf\"\r\n" +
-			"Content-Disposition: attachment; filename=\"another.pdf\"\r\n" +
-			"Content-Transfer-Encoding: base64\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"<p>Invitation</p>\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/calendar; method=REQUEST; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			ics + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
 	testMessage(t, m, 1, want)
+
+	if err := m.SetCalendar("INVITE", strings.NewReader(ics)); err == nil {
+		t.Error("expected an error with an invalid method")
+	}
+}
+
+func TestAttachmentFilenames(t *testing.T) {
+	names := []string{
+		"отчёт.pdf",
+		"報告書 2024.pdf",
+		"my report \"final\".pdf",
+		strings.Repeat("очень длинное имя файла ", 4) + ".txt",
+		strings.Repeat("a very long file name ", 5) + ".txt",
+	}
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Test")
+	for _, name := range names {
+		m.AttachReader(name, strings.NewReader("Test"))
+	}
+
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line too long (%d chars): %q", len(line), line)
+		}
+	}
+
+	_, mr := getMultipart(t, raw, "multipart/mixed")
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, param := range map[string]string{"Content-Type": "name", "Content-Disposition": "filename"} {
+			_, params, err := mime.ParseMediaType(p.Header.Get(k))
+			if err != nil {
+				t.Fatalf("invalid %s %q: %v", k, p.Header.Get(k), err)
+			}
+			if params[param] != name {
+				t.Errorf("invalid %s %s parameter, got %q, want %q", k, param, params[param], name)
+			}
+		}
+	}
+
+	r, err := ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range r.attachments {
+		if f.Name != names[i] {
+			t.Errorf("invalid parsed file name, got %q, want %q", f.Name, names[i])
+		}
+	}
+}
+
+func TestFileParam(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"test.pdf", `; filename="test.pdf"`},
+		{`a "b".pdf`, `; filename="a \"b\".pdf"`},
+		{"отчёт.pdf", ";\r\n filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.pdf"},
+		{"報告書 2024.pdf", ";\r\n filename*=UTF-8''%E5%A0%B1%E5%91%8A%E6%9B%B8%202024.pdf"},
+		{strings.Repeat("a", 60), ";\r\n filename*0=\"" + strings.Repeat("a", 56) + "\";\r\n filename*1=\"aaaa\""},
+	} {
+		if got := fileParam("filename", tt.name); got != tt.want {
+			t.Errorf("fileParam(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
 }
 
 func TestAttachmentsOnly(t *testing.T) {
@@ -593,6 +2027,152 @@ func TestFullMessage(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+func TestResetReuse(t *testing.T) {
+	build := func(m *Message) {
+		n := 0
+		m.SetBoundaryFunc(func() string {
+			n++
+			return "_BOUNDARY_" + strconv.Itoa(n) + "_"
+		})
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.AddHeader("X-Tag", "a", "b")
+		m.SetBody("text/plain", "Test reset")
+		m.AddAlternative("text/html", "<p>Test reset</p>")
+		m.AttachReader("a.txt", strings.NewReader("attachment"))
+		m.EmbedReader("b.png", strings.NewReader("image"))
+	}
+	write := func(m *Message) string {
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	m := NewMessage()
+	build(m)
+	m.SetHeaderOrder([]string{"To", "From"})
+	m.SetBoundary("previous")
+	m.SetProgressFunc(func(sent, total int64) { t.Error("the progress function should be cleared") })
+	m.SetMailParam("ENVID", "previous")
+	m.SetRcptParam("to@example.com", "NOTIFY", "NEVER")
+	m.SetAuthSubmitter("from@example.com")
+	m.SetMTPriority(3)
+	m.SetRequireTLS(true)
+	m.SetDeliverBy(time.Hour, ByReturn)
+	m.Reset()
+	if len(m.mailParams) != 0 || len(m.rcptParams) != 0 || m.hasAuthSubmitter || m.hasMTPriority || m.requireTLS || m.deliverBy != 0 {
+		t.Error("Reset should clear the SMTP parameters of the message")
+	}
+	if got, want := write(m), write(NewMessage()); got != want {
+		t.Errorf("a reset message should be empty, got %q, want %q", got, want)
+	}
+	if cap(m.parts) < 2 || cap(m.attachments) < 1 || cap(m.embedded) < 1 || cap(m.headerOrder) < 1 {
+		t.Error("Reset should keep the allocated memory")
+	}
+
+	build(m)
+	fresh := NewMessage()
+	build(fresh)
+	if got, want := write(m), write(fresh); got != want {
+		t.Errorf("invalid rebuilt message, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSetRaw(t *testing.T) {
+	body := "This is an S/MIME signed message\r\n" +
+		"\r\n" +
+		"--sig\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Très long\r\n" +
+		"--sig--\r\n"
+	m := NewMessage()
+	m.SetBody("text/plain", "Replaced")
+	m.Attach("/tmp/test.pdf")
+	m.SetRaw(map[string]string{
+		"From":         "from@example.com",
+		"To":           "to@example.com",
+		"Bcc":          "bcc@example.com",
+		"Content-Type": `multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary=sig`,
+		"Subject":      "Héllo",
+	}, strings.NewReader(body))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com", "bcc@example.com"},
+		content: `Content-Type: multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary=sig` + "\r\n" +
+			"From: from@example.com\r\n" +
+			"Subject: Héllo\r\n" +
+			"To: to@example.com\r\n" +
+			"\r\n" +
+			body,
+	}
+	err := Send(context.Background(), SendFunc(func(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+		if from != want.from || !reflect.DeepEqual(to, want.to) {
+			t.Errorf("invalid envelope, got %q %q, want %q %q", from, to, want.from, want.to)
+		}
+		var buf bytes.Buffer
+		if _, err := msg.WriteTo(&buf); err != nil {
+			return err
+		}
+		if buf.String() != want.content {
+			t.Errorf("the message should be written verbatim, got:\n%s\nwant:\n%s", &buf, want.content)
+		}
+		return nil
+	}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetRaw(map[string]string{"Subject": "a\r\nBcc: evil@example.com"}, strings.NewReader(body))
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error with an invalid header field")
+	}
+
+	m = NewMessage()
+	m.SetMailParam("ENVID", "QQ314159")
+	m.SetRcptParam("to@example.com", "NOTIFY", "NEVER")
+	m.SetRaw(map[string]string{"From": "from@example.com", "To": "to@example.com"}, strings.NewReader(body))
+	if len(m.mailParams) != 1 || len(m.rcptParams[normalizeAddress("to@example.com")]) != 1 {
+		t.Errorf("SetRaw should keep the SMTP parameters, got %v and %v", m.mailParams, m.rcptParams)
+	}
+}
+
+func TestLineLengthPolicy(t *testing.T) {
+	long := strings.Repeat("a", 2000)
+	body := func(policy LineLengthPolicy, content string) (string, error) {
+		m := NewMessage(SetEncoding(Unencoded), SetLineLengthPolicy(policy))
+		m.SetHeader("From", "from@example.com")
+		m.SetBody("text/plain", content)
+		b, err := m.Bytes()
+		if err != nil {
+			return "", err
+		}
+		return string(b[bytes.Index(b, []byte("\r\n\r\n"))+4:]), nil
+	}
+
+	if got, err := body(LineLengthIgnore, long); err != nil || got != long {
+		t.Errorf("long lines should be kept by default, got %v", err)
+	}
+	if _, err := body(LineLengthStrict, long); err == nil {
+		t.Error("expected an error with a line longer than 998 octets")
+	}
+	if got, err := body(LineLengthStrict, strings.Repeat("a", 998)+"\n"+long[:998]); err != nil || got != long[:998]+"\r\n"+long[:998] {
+		t.Errorf("lines of 998 octets should be allowed, got %v", err)
+	}
+
+	got, err := body(LineLengthWrap, long+"\rb\nc")
+	if want := long[:998] + "\r\n" + long[:998] + "\r\n" + "aaaa\r\nb\r\nc"; err != nil || got != want {
+		t.Errorf("invalid wrapped body, got %q, %v", got, err)
+	}
+	got, err = body(LineLengthWrap, long[:997]+"é")
+	if want := long[:997] + "\r\n" + "é"; err != nil || got != want {
+		t.Errorf("UTF-8 characters should not be split, got %q, %v", got, err)
+	}
+}
+
 func TestQpLineLength(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
@@ -646,6 +2226,76 @@ func TestBase64LineLength(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+func TestSetBase64LineLength(t *testing.T) {
+	content := strings.Repeat("0123456789", 20)
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+
+	for _, n := range []int{64, 76, 0} {
+		m := NewMessage(SetEncoding(Base64))
+		if n != 76 {
+			m.SetBase64LineLength(n)
+		}
+		m.SetHeader("From", "from@example.com")
+		m.SetBody("text/plain", content)
+		m.AttachReader("test.txt", strings.NewReader(content))
+
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		var want string
+		for s := encoded; s != ""; {
+			l := n
+			if l == 0 || l > len(s) {
+				l = len(s)
+			}
+			want += s[:l] + "\r\n"
+			s = s[l:]
+		}
+		if got := strings.Count(buf.String(), "\r\n\r\n"+want); got != 2 {
+			t.Errorf("line length %d: expected 2 parts wrapped as %q, got %d:\n%s", n, want, got, buf.String())
+		}
+		if strings.Contains(strings.Replace(buf.String(), "\r\n", "", -1), "\n") {
+			t.Errorf("line length %d: bare LF in output", n)
+		}
+	}
+}
+
+func TestLongEncodedHeader(t *testing.T) {
+	subject := strings.Repeat("Grüße 🎉🎉 aus dem Büro, ", 6)
+	name := strings.Repeat("Émile Zöla 🎉 ", 5)
+
+	for _, enc := range []Encoding{QuotedPrintable, Base64} {
+		m := NewMessage(SetEncoding(enc))
+		m.SetHeader("From", "from@example.com")
+		m.SetAddressHeader("To", "to@example.com", name)
+		m.SetHeader("Subject", subject)
+
+		raw, err := m.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(raw), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("%s: line too long (%d chars): %q", enc, len(line), line)
+			}
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := new(mime.WordDecoder)
+		if got, err := dec.DecodeHeader(msg.Header.Get("Subject")); err != nil || got != subject {
+			t.Errorf("%s: invalid decoded Subject, got %q (%v), want %q", enc, got, err, subject)
+		}
+		if to, err := mail.ParseAddress(msg.Header.Get("To")); err != nil || to.Name != name {
+			t.Errorf("%s: invalid decoded To, got %v (%v), want %q", enc, to, err, name)
+		}
+	}
+}
+
 func TestEmptyName(t *testing.T) {
 	m := NewMessage()
 	m.SetAddressHeader("From", "from@example.com", "")
@@ -674,6 +2324,123 @@ func TestEmptyHeader(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+// countingReader produces n bytes on demand and records how many were read.
+type countingReader struct {
+	n    int64
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.read >= r.n {
+		return 0, io.EOF
+	}
+	if rem := r.n - r.read; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	for i := range p {
+		p[i] = 'a'
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+// boundedWriter fails the test when the source has been read too far ahead of
+// what has been written, which would mean the attachment is buffered.
+type boundedWriter struct {
+	t        *testing.T
+	src      *countingReader
+	written  int64
+	maxAhead int64
+	maxChunk int
+}
+
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if len(p) > w.maxChunk {
+		w.maxChunk = len(p)
+	}
+	if w.src != nil {
+		// base64 expands 3 bytes into 4, ignore headers and line breaks.
+		if ahead := w.src.read - w.written*3/4; ahead > w.maxAhead {
+			w.t.Fatalf("attachment buffered in memory: %d bytes read ahead", ahead)
+		}
+	}
+	return len(p), nil
+}
+
+func TestAttachmentStreaming(t *testing.T) {
+	const size = 16 << 20
+
+	src := &countingReader{n: size}
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	m.AttachReader("large.bin", src)
+
+	w := &boundedWriter{t: t, src: src, maxAhead: 64 << 10}
+	if _, err := m.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if src.read != size {
+		t.Errorf("invalid read count, got %d, want %d", src.read, size)
+	}
+
+	f, err := ioutil.TempFile("", "mailgo-large-*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, &countingReader{n: size}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Reset()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.Attach(f.Name())
+
+	w = &boundedWriter{t: t}
+	if _, err := m.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if w.written < size*4/3 {
+		t.Errorf("message too short, got %d bytes", w.written)
+	}
+	if w.maxChunk > 64<<10 {
+		t.Errorf("attachment not streamed, got a write of %d bytes", w.maxChunk)
+	}
+}
+
+// failingWriter accepts n bytes and then fails with err.
+type failingWriter struct {
+	n   int
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, w.err
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestAttachmentWriteError(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.AttachReader("file.txt", strings.NewReader(strings.Repeat("a", 1024)))
+
+	wantErr := errors.New("kaboom")
+	w := &failingWriter{n: 512, err: wantErr}
+	if _, err := m.WriteTo(w); !errors.Is(err, wantErr) {
+		t.Errorf("expected %v, got %v", wantErr, err)
+	}
+}
+
 func testMessage(t *testing.T, m *Message, bCount int, want *message) {
 	err := Send(context.Background(), stubSendMail(t, bCount, want), m)
 	if err != nil {
@@ -709,6 +2476,7 @@ func stubSendMail(t *testing.T, bCount int, want *message) SendFunc {
 		got := buf.String()
 		wantMsg := string("MIME-Version: 1.0\r\n" +
 			"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
+			"Message-ID: " + testMessageID + "\r\n" +
 			want.content)
 		if bCount > 0 {
 			boundaries := getBoundaries(t, bCount, got)
@@ -793,6 +2561,11 @@ func mockCopyFile(name string) (string, FileSetting) {
 	})
 }
 
+func mockCopyFileWithDisposition(name, disposition string) (string, FileSetting, FileSetting) {
+	name, f := mockCopyFile(name)
+	return name, f, SetContentDisposition(disposition)
+}
+
 func mockCopyFileWithHeader(m *Message, name string, h map[string][]string) (string, FileSetting, FileSetting) {
 	name, f := mockCopyFile(name)
 	return name, f, SetHeader(h)
@@ -825,3 +2598,247 @@ func BenchmarkFull(b *testing.B) {
 		m.Reset()
 	}
 }
+
+func TestAutoEncoding(t *testing.T) {
+	tests := []struct {
+		name, body string
+		allow8bit  bool
+		cte, want  string
+	}{
+		{"ASCII", "Hello\nWorld", false, "7bit", "Hello\r\nWorld"},
+		{"ASCII long line", strings.Repeat("a", 1000), false, "quoted-printable",
+			strings.Repeat("a", 75) + "=\r\n"},
+		{"UTF-8", "¡Hola!", false, "quoted-printable", "=C2=A1Hola!"},
+		{"UTF-8 8BITMIME", "¡Hola!", true, "8bit", "¡Hola!"},
+		{"UTF-8 8BITMIME long line", strings.Repeat("é", 500), true, "quoted-printable", "=C3=A9"},
+		{"bare CR", "a\rb", false, "quoted-printable", "a\r\nb"},
+	}
+	for _, test := range tests {
+		m := NewMessage(SetEncoding(Auto))
+		m.SetHeader("From", "from@example.com")
+		m.SetBody("text/plain", test.body)
+
+		var buf bytes.Buffer
+		if _, err := m.writeTo(&buf, test.allow8bit); err != nil {
+			t.Fatal(err)
+		}
+		raw := buf.String()
+		if !strings.Contains(raw, "Content-Transfer-Encoding: "+test.cte+"\r\n") {
+			t.Errorf("%s: invalid encoding, want %s:\n%s", test.name, test.cte, raw)
+		}
+		if body := raw[strings.Index(raw, "\r\n\r\n")+4:]; !strings.HasPrefix(body, test.want) {
+			t.Errorf("%s: invalid body, got %q, want prefix %q", test.name, body, test.want)
+		}
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Subject", "¡Hola, señor!")
+	m.SetBody("text/plain", strings.Repeat("Hello world\n", 100), SetPartEncoding(Auto))
+	m.AddAlternative("text/html", "<p>¡Hola, señor!</p>")
+	m.Attach("data.bin", SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := m.WriteTo(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type upperTransformer struct{}
+
+func (upperTransformer) Transform(w io.Writer, entity []byte) error {
+	_, err := w.Write(bytes.ToUpper(entity))
+	return err
+}
+
+func getPoolTestMessage(body string) *Message {
+	m := NewMessage(SetEncoding(Auto), SetTransformers(upperTransformer{}))
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", body)
+	m.Attach("file.txt", SetCopyFunc(func(w io.Writer) error {
+		_, err := io.WriteString(w, body)
+		return err
+	}), func(f *file) { f.Encoding = Unencoded })
+	m.SetBoundaryFunc(func() string { return "_BOUNDARY_" })
+	return m
+}
+
+func TestBufferPool(t *testing.T) {
+	want, err := getPoolTestMessage("small").Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer wg.Done()
+			large := getPoolTestMessage(strings.Repeat("large body\n", 1000))
+			small := getPoolTestMessage("small")
+			for j := 0; j < 10; j++ {
+				if _, err := large.WriteTo(ioutil.Discard); err != nil {
+					t.Error(err)
+				}
+				got, err := small.Bytes()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("output changed after writing another message:\n%s\nwant:\n%s", got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestContentTypeSniffing(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 1000)...)
+	text := "Just some text in a file without extension.\n"
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Test")
+	// The readers are not seekable, so they can only be read once.
+	m.AttachReader("image.bin", io.MultiReader(bytes.NewReader(png)), SetContentTypeSniffing(true))
+	m.AttachReader("README", io.MultiReader(strings.NewReader(text)), SetContentTypeSniffing(true))
+	m.AttachReader("other", strings.NewReader(text))
+
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ mediaType, content string }{
+		{"image/png", string(png)},
+		{"text/plain; charset=utf-8", text},
+		{"application/octet-stream", text},
+	}
+	if len(r.attachments) != len(want) {
+		t.Fatalf("invalid number of attachments, got %d, want %d", len(r.attachments), len(want))
+	}
+	for i, f := range r.attachments {
+		if ct := f.Header["Content-Type"][0]; !strings.HasPrefix(ct, want[i].mediaType+";") {
+			t.Errorf("invalid Content-Type of %s, got %q, want %q", f.Name, ct, want[i].mediaType)
+		}
+		var buf bytes.Buffer
+		if err := f.CopyFunc(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want[i].content {
+			t.Errorf("invalid content of %s, got %d bytes, want %d", f.Name, buf.Len(), len(want[i].content))
+		}
+	}
+}
+
+func TestProgressFunc(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", strings.Repeat("Lorem ipsum dolor sit amet. ", 100))
+	m.Attach("testdata/embedded.txt")
+
+	var sent, totals []int64
+	m.SetProgressFunc(func(n, total int64) {
+		sent = append(sent, n)
+		totals = append(totals, total)
+	})
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) < 2 {
+		t.Fatalf("the progress should be reported several times, got %d calls", len(sent))
+	}
+	for i := range sent {
+		if i > 0 && sent[i] <= sent[i-1] {
+			t.Errorf("the progress should increase, got %d after %d", sent[i], sent[i-1])
+		}
+		if totals[i] != int64(buf.Len()) {
+			t.Errorf("invalid total, got %d, want %d", totals[i], buf.Len())
+		}
+	}
+	if last := sent[len(sent)-1]; last != int64(buf.Len()) {
+		t.Errorf("invalid number of bytes sent, got %d, want %d", last, buf.Len())
+	}
+
+	m.Attach("data.bin", SetCopyFunc(func(w io.Writer) error {
+		_, err := io.WriteString(w, "unknown size")
+		return err
+	}))
+	totals = nil
+	if _, err := m.WriteTo(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if totals[0] != -1 {
+		t.Errorf("the total should be unknown, got %d", totals[0])
+	}
+
+	m.SetProgressFunc(nil)
+	if _, err := m.WriteTo(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	streamed := NewMessage()
+	streamed.SetHeader("From", "from@example.com")
+	done := false
+	streamed.SetBodyWriter("text/plain", func(w io.Writer) error {
+		if done {
+			return nil
+		}
+		done = true
+		_, err := io.WriteString(w, "Streamed once")
+		return err
+	})
+	totals = nil
+	streamed.SetProgressFunc(func(n, total int64) { totals = append(totals, total) })
+	buf.Reset()
+	if _, err := streamed.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "\r\n\r\nStreamed once") {
+		t.Errorf("the body should only be written once, got:\n%s", buf.String())
+	}
+	if len(totals) == 0 || totals[0] != -1 {
+		t.Errorf("the total should be unknown with a body writer, got %v", totals)
+	}
+}
+
+func TestSetAutoSubmitted(t *testing.T) {
+	for _, value := range []string{"no", "auto-generated", "Auto-Replied", `auto-replied; owner-email="a@example.com"`, "auto-notified; x=y"} {
+		m := NewMessage()
+		if err := m.SetAutoSubmitted(value); err != nil {
+			t.Errorf("unexpected error with %q: %v", value, err)
+		}
+		if got := m.GetHeader("Auto-Submitted"); len(got) != 1 || got[0] != value {
+			t.Errorf("invalid Auto-Submitted header, got %q, want %q", got, value)
+		}
+	}
+
+	for _, value := range []string{"", "yes", "auto generated", "auto-replied; owner-email=a@example.com", "auto-replied; =x"} {
+		m := NewMessage()
+		if err := m.SetAutoSubmitted(value); err == nil {
+			t.Errorf("expected an error with %q", value)
+		}
+		if _, ok := m.header["Auto-Submitted"]; ok {
+			t.Errorf("the header should not be set with %q", value)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package mail
 
 import (
+	"encoding/base64"
 	"mime"
 	"mime/quotedprintable"
+	"strconv"
 	"strings"
 )
 
@@ -17,3 +19,67 @@ var (
 	qEncoding     = mimeEncoder{mime.QEncoding}
 	lastIndexByte = strings.LastIndexByte
 )
+
+// splitEncodedWord splits the RFC 2047 encoded-word w in two adjacent
+// encoded-words so the first one is at most max characters long. Multi-byte
+// UTF-8 sequences are never split. It returns false if w is not an
+// encoded-word or cannot be split.
+func splitEncodedWord(w string, max int) (first, rest string, ok bool) {
+	if !strings.HasPrefix(w, "=?") || !strings.HasSuffix(w, "?=") {
+		return "", "", false
+	}
+	fields := strings.Split(w[2:len(w)-2], "?")
+	if len(fields) != 3 || fields[2] == "" {
+		return "", "", false
+	}
+	charset, text := fields[0], fields[2]
+	prefix := "=?" + charset + "?" + fields[1] + "?"
+	utf8 := strings.EqualFold(charset, "UTF-8")
+
+	switch strings.ToLower(fields[1]) {
+	case "q":
+		// Find the last token boundary keeping the first word short enough.
+		split := 0
+		for i := 0; i < len(text); {
+			n, b := 1, text[i]
+			if b == '=' && i+2 < len(text) {
+				n = 3
+				if v, err := strconv.ParseUint(text[i+1:i+3], 16, 8); err == nil {
+					b = byte(v)
+				}
+			}
+			if i > 0 && (!utf8 || b < 0x80 || b >= 0xc0) {
+				if len(prefix)+i+len("?=") > max {
+					break
+				}
+				split = i
+			}
+			i += n
+		}
+		if split == 0 {
+			return "", "", false
+		}
+		return prefix + text[:split] + "?=", prefix + text[split:] + "?=", true
+	case "b":
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return "", "", false
+		}
+		split := 0
+		for i := 1; i < len(b); i++ {
+			if len(prefix)+base64.StdEncoding.EncodedLen(i)+len("?=") > max {
+				break
+			}
+			if !utf8 || b[i] < 0x80 || b[i] >= 0xc0 {
+				split = i
+			}
+		}
+		if split == 0 {
+			return "", "", false
+		}
+		return prefix + base64.StdEncoding.EncodeToString(b[:split]) + "?=",
+			prefix + base64.StdEncoding.EncodeToString(b[split:]) + "?=", true
+	}
+
+	return "", "", false
+}
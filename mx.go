@@ -0,0 +1,117 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// MXSender is a SendCloser delivering messages directly to the mail exchangers
+// of the recipient domains instead of a relay. The MX records of each domain
+// are looked up with the Resolver of the Dialer and tried by order of
+// preference until a connection is established, the domain itself is used
+// when it has no MX record.
+type MXSender struct {
+	// Dialer connects to the mail exchangers, its Host is replaced by the
+	// host of each exchanger. Its Port should usually be 25.
+	Dialer *Dialer
+}
+
+// NewMXSender returns an MXSender connecting to the mail exchangers with d.
+func NewMXSender(d *Dialer) *MXSender {
+	return &MXSender{Dialer: d}
+}
+
+// Send implements Sender. A connection is opened for each recipient domain,
+// the returned error joins the errors of the domains that failed.
+//
+// The message is written once per domain: a *Message with recipients in
+// several domains is rejected before any connection is opened if it has
+// content read from an io.Reader that does not implement io.Seeker.
+func (s *MXSender) Send(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	var domains []string
+	rcpts := make(map[string][]string)
+	for _, addr := range to {
+		domain := strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+		if _, ok := rcpts[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		rcpts[domain] = append(rcpts[domain], addr)
+	}
+	if m, ok := msg.(*Message); ok && len(domains) > 1 && m.oneShot() {
+		return errOneShot
+	}
+
+	var errs []error
+	for _, domain := range domains {
+		if err := s.sendDomain(ctx, domain, from, rcpts[domain], msg); err != nil {
+			errs = append(errs, fmt.Errorf("gomail: could not deliver to %s: %w", domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MXSender) sendDomain(ctx context.Context, domain, from string, to []string, msg io.WriterTo) error {
+	hosts, err := lookupMXHosts(ctx, s.Dialer.resolver(), domain)
+	if err != nil {
+		return err
+	}
+
+	var dialErr error
+	for _, host := range hosts {
+		d := s.Dialer.clone()
+		d.Host = host
+		sc, err := d.Dial(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dialErr == nil {
+				dialErr = err
+			}
+			continue
+		}
+
+		err = sc.Send(ctx, from, to, msg)
+		if cerr := sc.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return dialErr
+}
+
+// lookupMXHosts returns the hosts of the MX records of domain sorted by
+// preference, or the domain itself when it has no MX record.
+func lookupMXHosts(ctx context.Context, r Resolver, domain string) ([]string, error) {
+	mxs, err := r.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound || err == nil && len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// A null MX record, see RFC 7505.
+			return nil, fmt.Errorf("gomail: %s does not accept email", domain)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// Close implements SendCloser, it does nothing as a connection is opened for
+// each message.
+func (s *MXSender) Close() error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func getMXDialer(t *testing.T, dialed *[]string, live string, mx func(string) ([]*net.MX, error)) *Dialer {
+	old := smtpNewClient
+	t.Cleanup(func() { smtpNewClient = old })
+
+	d := &Dialer{Port: 25, StartTLSPolicy: NoStartTLS, Resolver: &stubResolver{t: t, mx: mx}}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		*dialed = append(*dialed, address)
+		if address != live {
+			return nil, errors.New("connection refused")
+		}
+		return testConn, nil
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		if want := strings.TrimSuffix(live, ":25"); host != want {
+			t.Errorf("invalid host, got %q, want %q", host, want)
+		}
+		return &mockClient{t: t, want: []string{
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+			"Close",
+		}}, nil
+	}
+	return d
+}
+
+func TestMXSender(t *testing.T) {
+	var dialed []string
+	s := NewMXSender(getMXDialer(t, &dialed, "mx2.example.com:25", func(domain string) ([]*net.MX, error) {
+		if domain != "example.com" {
+			t.Errorf("invalid domain, got %q", domain)
+		}
+		return []*net.MX{
+			{Host: "mx3.example.com.", Pref: 30},
+			{Host: "mx1.example.com.", Pref: 10},
+			{Host: "mx2.example.com.", Pref: 20},
+		}, nil
+	}))
+	if err := Send(context.Background(), s, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "mx1.example.com:25 mx2.example.com:25"; strings.Join(dialed, " ") != want {
+		t.Errorf("invalid hosts dialed, got %v, want %s", dialed, want)
+	}
+}
+
+func TestMXSenderNoMX(t *testing.T) {
+	var dialed []string
+	s := NewMXSender(getMXDialer(t, &dialed, "example.com:25", func(domain string) ([]*net.MX, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}))
+	if err := Send(context.Background(), s, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("the domain should be dialed when it has no MX record, got %v", dialed)
+	}
+}
+
+func TestMXSenderErrors(t *testing.T) {
+	var dialed []string
+	s := NewMXSender(getMXDialer(t, &dialed, "none", func(domain string) ([]*net.MX, error) {
+		if domain == "null.example.com" {
+			return []*net.MX{{Host: ".", Pref: 0}}, nil
+		}
+		return []*net.MX{{Host: "mx1.example.com.", Pref: 10}}, nil
+	}))
+	err := s.Send(context.Background(), testFrom, []string{"a@example.com", "b@null.example.com"}, getTestMessage())
+	if err == nil || !strings.Contains(err.Error(), "connection refused") ||
+		!strings.Contains(err.Error(), "null.example.com does not accept email") {
+		t.Errorf("the error should contain the error of each domain, got %v", err)
+	}
+
+	m := getTestMessage()
+	m.AttachReader("test.txt", struct{ io.Reader }{strings.NewReader("Test")})
+	dialed = nil
+	if err := s.Send(context.Background(), testFrom, []string{"a@example.com", "b@example.org"}, m); !errors.Is(err, errOneShot) {
+		t.Errorf("expected an error with a reader that cannot be rewound, got %v", err)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("no connection should be opened, dialed %v", dialed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Send(ctx, testFrom, []string{"a@example.com"}, getTestMessage()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the error of the context, got %v", err)
+	}
+}
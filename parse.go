@@ -0,0 +1,225 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	stdmail "net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ReadMessage reads and parses an RFC 5322 message from r, for example a .eml
+// file. It is the inverse of Message.WriteTo: the returned message can be
+// modified and written again.
+//
+// Unknown header fields are preserved. Text parts become the body of the
+// message, multipart/alternative parts become alternatives, multipart/related
+// parts become embedded files and the other parts become attachments. The
+// content of each part is decoded and held in memory.
+func ReadMessage(r io.Reader, settings ...MessageSetting) (*Message, error) {
+	m := NewMessage(settings...)
+
+	br := bufio.NewReader(r)
+	tp := textproto.NewReader(br)
+	content := make(textproto.MIMEHeader)
+	for {
+		line, err := tp.ReadContinuedLine()
+		if err != nil {
+			return nil, fmt.Errorf("gomail: could not read message header: %w", err)
+		}
+		if line == "" {
+			break
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("gomail: malformed message header line %q", line)
+		}
+		k, v := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch ck := textproto.CanonicalMIMEHeaderKey(k); {
+		case ck == "Content-Language":
+			m.setField(k, append(m.header[k], v))
+		case strings.HasPrefix(ck, "Content-"):
+			content.Add(ck, v)
+		case ck == "Mime-Version":
+		case isAddressField(ck):
+			m.setField(k, append(m.header[k], m.parseAddressList(v)...))
+		default:
+			m.addField(k, []string{v})
+		}
+	}
+
+	if err := m.readEntity(content, br, roleBody); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func isAddressField(k string) bool {
+	switch k {
+	case "From", "Sender", "Reply-To", "To", "Cc", "Bcc":
+		return true
+	}
+	return false
+}
+
+// parseAddressList splits an address header field so each address is stored
+// as a single value.
+func (m *Message) parseAddressList(v string) []string {
+	list, err := stdmail.ParseAddressList(v)
+	if err != nil {
+		return []string{v}
+	}
+
+	values := make([]string, len(list))
+	for i, a := range list {
+		values[i] = m.FormatAddress(a.Address, a.Name)
+	}
+	return values
+}
+
+type entityRole int
+
+const (
+	roleBody entityRole = iota
+	roleEmbedded
+	roleAttachment
+)
+
+func (m *Message) readEntity(h textproto.MIMEHeader, r io.Reader, role entityRole) error {
+	mediaType, params := "text/plain", map[string]string{}
+	if ct := h.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return fmt.Errorf("gomail: invalid Content-Type %q: %w", ct, err)
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return m.readMultipart(strings.TrimPrefix(mediaType, "multipart/"), params["boundary"], r, role)
+	}
+
+	content, err := ioutil.ReadAll(decodeTransferEncoding(h.Get("Content-Transfer-Encoding"), r))
+	if err != nil {
+		return fmt.Errorf("gomail: could not decode %s part: %w", mediaType, err)
+	}
+
+	if role == roleBody && (isAttachment(h) || !strings.HasPrefix(mediaType, "text/")) {
+		role = roleAttachment
+	}
+
+	if role == roleBody {
+		if cs, ok := params["charset"]; ok {
+			m.charset = cs
+			delete(params, "charset")
+		}
+		m.parts = append(m.parts, &part{
+			contentType: mime.FormatMediaType(mediaType, params),
+			copier:      newCopier(string(content)),
+			encoding:    bodyEncoding(h.Get("Content-Transfer-Encoding")),
+			static:      true,
+		})
+		return nil
+	}
+
+	f := fileFromReader(fileName(h, params), bytes.NewReader(content))
+	for k, v := range h {
+		if k == "Content-Transfer-Encoding" {
+			continue
+		}
+		if k == "Content-Id" {
+			k = "Content-ID"
+		}
+		f.Header[k] = v
+	}
+	if mediaType == "message/rfc822" {
+		f.Encoding = Unencoded
+	}
+	if role == roleEmbedded {
+		m.embedded = append(m.embedded, f)
+	} else {
+		m.attachments = append(m.attachments, f)
+	}
+
+	return nil
+}
+
+func (m *Message) readMultipart(subtype, boundary string, r io.Reader, role entityRole) error {
+	if boundary == "" {
+		return fmt.Errorf("gomail: multipart/%s without boundary", subtype)
+	}
+
+	mr := multipart.NewReader(r, boundary)
+	for i := 0; ; i++ {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("gomail: could not read multipart/%s part: %w", subtype, err)
+		}
+
+		partRole := role
+		if role == roleBody {
+			switch {
+			case subtype == "alternative":
+			case subtype == "related":
+				if i > 0 {
+					partRole = roleEmbedded
+				}
+			case i > 0 || isAttachment(p.Header):
+				partRole = roleAttachment
+			}
+		}
+
+		if err := m.readEntity(p.Header, p, partRole); err != nil {
+			return err
+		}
+	}
+}
+
+func isAttachment(h textproto.MIMEHeader) bool {
+	disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	return err == nil && disp == "attachment"
+}
+
+func fileName(h textproto.MIMEHeader, params map[string]string) string {
+	if _, p, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && p["filename"] != "" {
+		return p["filename"]
+	}
+	if params["name"] != "" {
+		return params["name"]
+	}
+	return "attachment"
+}
+
+func decodeTransferEncoding(cte string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+func bodyEncoding(cte string) Encoding {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return Base64
+	case "quoted-printable":
+		return QuotedPrintable
+	default:
+		return Unencoded
+	}
+}
@@ -0,0 +1,198 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// normalizeBoundaries replaces the random boundaries of a serialized message
+// so two serializations can be compared.
+func normalizeBoundaries(s string) string {
+	for i, match := range boundaryRegExp.FindAllStringSubmatch(s, -1) {
+		s = strings.Replace(s, match[1], "_BOUNDARY_"+strconv.Itoa(i+1)+"_", -1)
+	}
+	return s
+}
+
+func TestReadMessageRoundTrip(t *testing.T) {
+	m := NewMessage()
+	m.SetAddressHeader("From", "from@example.com", "Señor From")
+	m.SetHeader("To", "to1@example.com", "to2@example.com")
+	m.SetAddressHeader("Cc", "cc@example.com", "A, B")
+	m.SetHeader("Subject", "¡Hola, señor!")
+	m.SetHeader("X-Custom", "kept")
+	m.AddHeader("Received", "from a.example.com", "from b.example.com")
+	if err := m.SetContentLanguage("es"); err != nil {
+		t.Fatal(err)
+	}
+	m.SetBody("text/plain; format=flowed", "¡Hola, señor!")
+	m.AddAlternative("text/html", "<p>¡Hola, <img src=\"cid:image.jpg\"> señor!</p>")
+	m.Embed(mockCopyFile("image.jpg"))
+	m.Attach(mockCopyFile("test.pdf"))
+	m.Attach(mockCopyFile("notes.txt"))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := buf.String()
+
+	r, err := ReadMessage(strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantTo := []string{"to1@example.com", "to2@example.com", "cc@example.com"}
+	if got, err := r.Recipients(); err != nil || strings.Join(got, ",") != strings.Join(wantTo, ",") {
+		t.Errorf("invalid recipients, got %v (%v), want %v", got, err, wantTo)
+	}
+
+	buf.Reset()
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	compareBodies(t, normalizeBoundaries(buf.String()), normalizeBoundaries(want))
+}
+
+const testEML = "Return-Path: <alice@example.org>\r\n" +
+	"Received: from mail.example.org (mail.example.org [192.0.2.1])\r\n" +
+	"\tby mx.example.com with ESMTPS id 1234\r\n" +
+	"\tfor <bob@example.com>; Tue, 13 Oct 2026 10:00:00 +0000\r\n" +
+	"Message-ID: <abc@example.org>\r\n" +
+	"Date: Tue, 13 Oct 2026 12:00:00 +0200\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"User-Agent: Mozilla Thunderbird\r\n" +
+	"Subject: =?UTF-8?Q?Rapport_trimestriel_=e2=80=93_Q3?=\r\n" +
+	"From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>, carol@example.com\r\n" +
+	"Content-Type: multipart/mixed;\r\n" +
+	" boundary=\"------------3bOVQSH8ITk0c7f5KD6b0b18\"\r\n" +
+	"\r\n" +
+	"This is a multi-part message in MIME format.\r\n" +
+	"--------------3bOVQSH8ITk0c7f5KD6b0b18\r\n" +
+	"Content-Type: text/plain; charset=UTF-8; format=flowed\r\n" +
+	"Content-Transfer-Encoding: 8bit\r\n" +
+	"\r\n" +
+	"Hi Bob,\r\n" +
+	"\r\n" +
+	"please find the report attached – Alice\r\n" +
+	"\r\n" +
+	"--------------3bOVQSH8ITk0c7f5KD6b0b18\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQKJcOkw7zDtsOfCjIgMCBvYmoKPDwvTGVuZ3RoIDMgMCBSPj4Kc3RyZWFtCg==\r\n" +
+	"\r\n" +
+	"--------------3bOVQSH8ITk0c7f5KD6b0b18\r\n" +
+	"Content-Type: text/plain; charset=UTF-8; name=\"=?UTF-8?B?w6l0w6kudHh0?=\"\r\n" +
+	"Content-Disposition: attachment; filename*=UTF-8''%C3%A9t%C3%A9.txt\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"L'=C3=A9t=C3=A9\r\n" +
+	"--------------3bOVQSH8ITk0c7f5KD6b0b18--\r\n"
+
+func TestReadMessage(t *testing.T) {
+	m, err := ReadMessage(strings.NewReader(testEML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]string{
+		"Message-ID": "<abc@example.org>",
+		"Subject":    "=?UTF-8?Q?Rapport_trimestriel_=e2=80=93_Q3?=",
+		"User-Agent": "Mozilla Thunderbird",
+		"Received": "from mail.example.org (mail.example.org [192.0.2.1]) " +
+			"by mx.example.com with ESMTPS id 1234 " +
+			"for <bob@example.com>; Tue, 13 Oct 2026 10:00:00 +0000",
+	} {
+		if got := m.GetHeader(k); len(got) != 1 || got[0] != want {
+			t.Errorf("invalid %s header, got %q, want %q", k, got, want)
+		}
+	}
+	if got := m.GetHeader("To"); len(got) != 2 || got[0] != `"Bob" <bob@example.com>` || got[1] != "carol@example.com" {
+		t.Errorf("invalid To header, got %q", got)
+	}
+	if len(m.GetHeader("Content-Type")) != 0 || len(m.GetHeader("MIME-Version")) != 0 {
+		t.Error("MIME headers should not be kept as message headers")
+	}
+
+	if len(m.parts) != 1 {
+		t.Fatalf("invalid number of parts, got %d, want 1", len(m.parts))
+	}
+	if p := m.parts[0]; p.contentType != "text/plain; format=flowed" || p.encoding != Unencoded {
+		t.Errorf("invalid part, got %q %q", p.contentType, p.encoding)
+	}
+	var body bytes.Buffer
+	if err := m.parts[0].copier(&body); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hi Bob,\r\n\r\nplease find the report attached – Alice\r\n"; body.String() != want {
+		t.Errorf("invalid body, got %q, want %q", body.String(), want)
+	}
+
+	if len(m.attachments) != 2 {
+		t.Fatalf("invalid number of attachments, got %d, want 2", len(m.attachments))
+	}
+	for i, want := range []struct{ name, content string }{
+		{"report.pdf", "%PDF-1.4\n%äüöß\n2 0 obj\n<</Length 3 0 R>>\nstream\n"},
+		{"été.txt", "L'été"},
+	} {
+		f := m.attachments[i]
+		if f.Name != want.name {
+			t.Errorf("invalid attachment name, got %q, want %q", f.Name, want.name)
+		}
+		if _, ok := f.Header["Content-Transfer-Encoding"]; ok {
+			t.Error("Content-Transfer-Encoding should be dropped from attachments")
+		}
+		var b bytes.Buffer
+		if err := f.CopyFunc(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want.content {
+			t.Errorf("invalid attachment content, got %q, want %q", b.String(), want.content)
+		}
+	}
+
+	if _, err := m.WriteTo(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadMessageSinglePart(t *testing.T) {
+	m, err := ReadMessage(strings.NewReader("From: from@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"Subject: Hello\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"Hello!",
+	}
+	testMessage(t, m, 0, want)
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	for _, raw := range []string{
+		"From from@example.com\r\n\r\n",
+		"From: from@example.com\r\n" +
+			"Content-Type: multipart/mixed\r\n" +
+			"\r\n",
+		"From: from@example.com",
+	} {
+		if _, err := ReadMessage(strings.NewReader(raw)); err == nil {
+			t.Errorf("expected an error for %q", raw)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+)
+
+// OpenPGP provides the cryptographic operations used by PGPEncryptor. Gomail
+// does not implement OpenPGP itself, OpenPGP is typically implemented on top
+// of a library such as github.com/ProtonMail/go-crypto/openpgp which manages
+// the recipient public keys and the signing key.
+type OpenPGP interface {
+	// Encrypt writes the ASCII armored encryption of plaintext to w. When a
+	// signing key is configured the plaintext should also be signed.
+	Encrypt(w io.Writer, plaintext []byte) error
+	// DetachSign writes an ASCII armored detached signature of data to w.
+	DetachSign(w io.Writer, data []byte) error
+}
+
+// PGPMode represents how PGPEncryptor protects a message.
+type PGPMode int
+
+const (
+	// PGPEncrypt encrypts the message into a multipart/encrypted entity.
+	PGPEncrypt PGPMode = iota
+	// PGPSign signs the message into a multipart/signed entity without
+	// encrypting it.
+	PGPSign
+)
+
+// PGPEncryptor is a Transformer that protects messages with OpenPGP/MIME as
+// defined in RFC 3156. It operates on the fully serialized message content so
+// every body part, attachment and embedded file is protected.
+type PGPEncryptor struct {
+	// PGP performs the OpenPGP operations.
+	PGP OpenPGP
+	// Mode defines whether the message is encrypted or only signed.
+	Mode PGPMode
+	// Micalg is the hash algorithm used for signatures in PGPSign mode, as
+	// expected by the "micalg" parameter. Defaults to "pgp-sha256".
+	Micalg string
+}
+
+// NewPGPEncryptor returns a PGPEncryptor encrypting messages with pgp.
+func NewPGPEncryptor(pgp OpenPGP) *PGPEncryptor {
+	return &PGPEncryptor{PGP: pgp, Mode: PGPEncrypt}
+}
+
+// NewPGPSigner returns a PGPEncryptor only signing messages with pgp.
+func NewPGPSigner(pgp OpenPGP) *PGPEncryptor {
+	return &PGPEncryptor{PGP: pgp, Mode: PGPSign}
+}
+
+// Transform implements Transformer.
+func (e *PGPEncryptor) Transform(w io.Writer, entity []byte) error {
+	if e.PGP == nil {
+		return errors.New("gomail: PGPEncryptor requires an OpenPGP implementation")
+	}
+
+	if e.Mode == PGPSign {
+		micalg := e.Micalg
+		if micalg == "" {
+			micalg = "pgp-sha256"
+		}
+		return writeMultipartSigned(w, entity, "application/pgp-signature", micalg,
+			"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n"+
+				"Content-Description: OpenPGP digital signature\r\n"+
+				"Content-Disposition: attachment; filename=\"signature.asc\"\r\n",
+			func(w io.Writer) error {
+				return e.PGP.DetachSign(&crlfWriter{w: w}, entity)
+			})
+	}
+
+	boundary := multipart.NewWriter(nil).Boundary()
+
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: multipart/encrypted;\r\n" +
+		" protocol=\"application/pgp-encrypted\";\r\n" +
+		" boundary=" + boundary + "\r\n\r\n")
+	buf.WriteString("--" + boundary + "\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n" +
+		"Content-Description: PGP/MIME version identification\r\n" +
+		"\r\n" +
+		"Version: 1\r\n" +
+		"\r\n")
+	buf.WriteString("--" + boundary + "\r\n" +
+		"Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n" +
+		"Content-Description: OpenPGP encrypted message\r\n" +
+		"Content-Disposition: inline; filename=\"encrypted.asc\"\r\n" +
+		"\r\n")
+	if err := e.PGP.Encrypt(&crlfWriter{w: &buf}, entity); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
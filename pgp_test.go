@@ -0,0 +1,290 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hexPGP is a fake OpenPGP implementation which "encrypts" with hex encoding.
+type hexPGP struct{}
+
+func (hexPGP) Encrypt(w io.Writer, plaintext []byte) error {
+	_, err := io.WriteString(w, "-----BEGIN PGP MESSAGE-----\n\n"+hex.EncodeToString(plaintext)+"\n-----END PGP MESSAGE-----\n")
+	return err
+}
+
+func (hexPGP) DetachSign(w io.Writer, data []byte) error {
+	_, err := io.WriteString(w, "-----BEGIN PGP SIGNATURE-----\n\n"+hex.EncodeToString(data[:8])+"\n-----END PGP SIGNATURE-----\n")
+	return err
+}
+
+// gpgPGP implements OpenPGP with the gpg binary.
+type gpgPGP struct {
+	home      string
+	recipient string
+	signer    string
+}
+
+func (g *gpgPGP) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("gpg", append([]string{"--homedir", g.home, "--batch", "--yes", "--quiet", "--trust-model", "always"}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, stderr.Bytes())
+	}
+	return out, nil
+}
+
+func (g *gpgPGP) Encrypt(w io.Writer, plaintext []byte) error {
+	args := []string{"--armor", "--encrypt", "--recipient", g.recipient}
+	if g.signer != "" {
+		args = append(args, "--sign", "--local-user", g.signer)
+	}
+	out, err := g.run(plaintext, args...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func (g *gpgPGP) DetachSign(w io.Writer, data []byte) error {
+	out, err := g.run(data, "--armor", "--detach-sign", "--local-user", g.signer)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func newGPG(t *testing.T) *gpgPGP {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not found")
+	}
+	home, err := ioutil.TempDir("", "mailgo-gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(home) })
+
+	g := &gpgPGP{home: home, recipient: "to@example.com", signer: "from@example.com"}
+	for _, uid := range []string{"To <to@example.com>", "From <from@example.com>"} {
+		if _, err := g.run(nil, "--passphrase", "", "--quick-gen-key", uid, "future-default", "default", "never"); err != nil {
+			t.Skipf("could not generate a gpg key: %v", err)
+		}
+	}
+	return g
+}
+
+func getMultipart(t *testing.T, raw []byte, wantType string) (map[string]string, *multipart.Reader) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != wantType {
+		t.Fatalf("invalid media type, got %q, want %q", mediaType, wantType)
+	}
+	return params, multipart.NewReader(msg.Body, params["boundary"])
+}
+
+func getEncryptedPart(t *testing.T, raw []byte) []byte {
+	t.Helper()
+	params, mr := getMultipart(t, raw, "multipart/encrypted")
+	if params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("invalid protocol, got %q", params["protocol"])
+	}
+
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := p.Header.Get("Content-Type"); ct != "application/pgp-encrypted" {
+		t.Errorf("invalid control part Content-Type, got %q", ct)
+	}
+	if b, _ := ioutil.ReadAll(p); !strings.HasPrefix(string(b), "Version: 1") {
+		t.Errorf("invalid control part, got %q", b)
+	}
+
+	p, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := p.Header.Get("Content-Type"); ct != `application/octet-stream; name="encrypted.asc"` {
+		t.Errorf("invalid encrypted part Content-Type, got %q", ct)
+	}
+	ciphertext, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Error("expected exactly two parts")
+	}
+	return ciphertext
+}
+
+func getTestPGPMessage(t Transformer) *Message {
+	m := NewMessage(SetTransformers(t))
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Subject", "Secret")
+	m.SetBody("text/plain", "¡Hola, señor!")
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
+	return m
+}
+
+func TestPGPEncryptor(t *testing.T) {
+	m := getTestPGPMessage(NewPGPEncryptor(hexPGP{}))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Subject: Secret\r\n") {
+		t.Error("message headers should be left unencrypted")
+	}
+
+	ciphertext := getEncryptedPart(t, buf.Bytes())
+	lines := strings.Split(strings.TrimSpace(string(ciphertext)), "\r\n")
+	if len(lines) != 4 {
+		t.Fatalf("armored message should use CRLF line endings, got %q", ciphertext)
+	}
+	plaintext, err := hex.DecodeString(lines[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(plaintext), "Content-Type: multipart/mixed;") {
+		t.Errorf("invalid plaintext, got %q", plaintext)
+	}
+}
+
+func TestPGPSigner(t *testing.T) {
+	m := getTestPGPMessage(NewPGPSigner(hexPGP{}))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	params, mr := getMultipart(t, buf.Bytes(), "multipart/signed")
+	if params["protocol"] != "application/pgp-signature" || params["micalg"] != "pgp-sha256" {
+		t.Errorf("invalid multipart/signed parameters: %v", params)
+	}
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := p.Header.Get("Content-Type"); ct != `application/pgp-signature; name="signature.asc"` {
+		t.Errorf("invalid signature Content-Type, got %q", ct)
+	}
+}
+
+func TestPGPEncryptorMissingImplementation(t *testing.T) {
+	m := getTestPGPMessage(&PGPEncryptor{})
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error without an OpenPGP implementation")
+	}
+}
+
+func TestPGPEncryptorGPG(t *testing.T) {
+	g := newGPG(t)
+	m := getTestPGPMessage(NewPGPEncryptor(g))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := getEncryptedPart(t, buf.Bytes())
+	plaintext, err := g.run(ciphertext, "--decrypt")
+	if err != nil {
+		t.Fatalf("gpg --decrypt failed: %v", err)
+	}
+
+	inner, err := mail.ReadMessage(bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(inner.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("invalid decrypted entity: %q, %v", mediaType, err)
+	}
+	mr := multipart.NewReader(inner.Body, params["boundary"])
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(p); string(body) != "¡Hola, señor!" {
+		t.Errorf("invalid decrypted body, got %q", body)
+	}
+}
+
+func TestPGPSignerGPG(t *testing.T) {
+	g := newGPG(t)
+	m := getTestPGPMessage(NewPGPSigner(g))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+
+	params, mr := getMultipart(t, raw, "multipart/signed")
+	delim := "--" + params["boundary"] + "\r\n"
+	start := bytes.Index(raw, []byte(delim)) + len(delim)
+	end := bytes.Index(raw[start:], []byte("\r\n--"+params["boundary"])) + start
+	content := raw[start:end]
+
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ioutil.ReadAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigFile := filepath.Join(g.home, "signature.asc")
+	if err := ioutil.WriteFile(sigFile, sig, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.run(content, "--verify", sigFile, "-"); err != nil {
+		t.Fatalf("gpg --verify failed: %v", err)
+	}
+}
+
+func TestCRLFWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &crlfWriter{w: &buf}
+	for _, s := range []string{"a\nb\r\n", "c\r", "\nd\n", "\n", "e\rf\r", "\r"} {
+		if n, err := io.WriteString(w, s); err != nil || n != len(s) {
+			t.Fatal(n, err)
+		}
+	}
+	if want := "a\r\nb\r\nc\r\nd\r\n\r\ne\r\nf\r\n\r\n"; buf.String() != want {
+		t.Errorf("invalid output, got %q, want %q", buf.String(), want)
+	}
+}
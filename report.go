@@ -0,0 +1,201 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeliveryReport holds the content of a delivery status notification, as
+// defined in RFC 3464.
+type DeliveryReport struct {
+	// ReportingMTA is the name of the MTA reporting the delivery status, for
+	// example "dns; mx.example.com". The "dns" type is used when the value has
+	// no type. Required.
+	ReportingMTA string
+	// EnvelopeID is the envelope identifier given by the sender with the
+	// ENVID parameter of the MAIL command. Optional.
+	EnvelopeID string
+	// ReceivedFromMTA is the name of the MTA the message was received from.
+	// Optional.
+	ReceivedFromMTA string
+	// ArrivalDate is the date the message arrived at the reporting MTA.
+	// Optional.
+	ArrivalDate time.Time
+	// Recipients are the delivery statuses of the recipients, at least one is
+	// required.
+	Recipients []RecipientStatus
+	// Returned is the message the report is about, or only its header when
+	// ReturnHeadersOnly is set. Optional.
+	Returned []byte
+	// ReturnHeadersOnly includes only the header of the returned message, as
+	// a text/rfc822-headers part.
+	ReturnHeadersOnly bool
+}
+
+// RecipientStatus is the delivery status of a recipient in a DeliveryReport.
+type RecipientStatus struct {
+	// OriginalRecipient is the recipient given by the sender with the ORCPT
+	// parameter of the RCPT command. Optional.
+	OriginalRecipient string
+	// FinalRecipient is the recipient the delivery status applies to, for
+	// example "rfc822; user@example.com". The "rfc822" type is used when the
+	// value has no type. Required.
+	FinalRecipient string
+	// Action is the action performed by the reporting MTA: "failed",
+	// "delayed", "delivered", "relayed" or "expanded". Required.
+	Action string
+	// Status is the enhanced status code of the delivery, as defined in RFC
+	// 3463, for example "5.1.1". Required.
+	Status string
+	// RemoteMTA is the name of the MTA which returned the diagnostic.
+	// Optional.
+	RemoteMTA string
+	// DiagnosticCode is the diagnostic returned by the remote MTA, for
+	// example "smtp; 550 5.1.1 User unknown". The "smtp" type is used when the
+	// value has no type. Optional.
+	DiagnosticCode string
+	// LastAttemptDate is the date of the last delivery attempt. Optional.
+	LastAttemptDate time.Time
+	// WillRetryUntil is the date the reporting MTA stops retrying the
+	// delivery, for the "delayed" action. Optional.
+	WillRetryUntil time.Time
+}
+
+// reportContent is the content of the parts of a delivery report following
+// its human-readable explanation.
+type reportContent struct {
+	status       string
+	returnedType string
+	returned     string
+}
+
+// SetDeliveryReport makes the message a delivery status notification: a
+// multipart/report entity, as defined in RFC 6522, made of the body of the
+// message as the human-readable explanation, a message/delivery-status part
+// holding the fields of r and, if r.Returned is not empty, the returned
+// message.
+//
+// The header fields are set as usual, the report being sent to the envelope
+// sender of the returned message. The message must not have attachments or
+// embedded files.
+func (m *Message) SetDeliveryReport(r *DeliveryReport) error {
+	status, err := m.formatDeliveryStatus(r)
+	if err != nil {
+		return err
+	}
+	c := &reportContent{status: status, returnedType: "message/rfc822", returned: string(r.Returned)}
+	if r.ReturnHeadersOnly {
+		c.returnedType = "text/rfc822-headers"
+		if i := strings.Index(c.returned, "\n\r\n"); i != -1 {
+			c.returned = c.returned[:i+1]
+		} else if i := strings.Index(c.returned, "\n\n"); i != -1 {
+			c.returned = c.returned[:i+1]
+		}
+	}
+	m.report = c
+	return nil
+}
+
+// formatDeliveryStatus returns the content of the message/delivery-status part
+// of r: the per-message fields followed by a block of fields per recipient.
+func (m *Message) formatDeliveryStatus(r *DeliveryReport) (string, error) {
+	if r.ReportingMTA == "" {
+		return "", errors.New("gomail: a delivery report requires a reporting MTA")
+	}
+	if len(r.Recipients) == 0 {
+		return "", errors.New("gomail: a delivery report requires at least one recipient")
+	}
+
+	var buf bytes.Buffer
+	fields := [][2]string{
+		{"Original-Envelope-Id", r.EnvelopeID},
+		{"Reporting-MTA", typedValue("dns", r.ReportingMTA)},
+		{"Received-From-MTA", typedValue("dns", r.ReceivedFromMTA)},
+		{"Arrival-Date", m.formatReportDate(r.ArrivalDate)},
+	}
+	if err := writeStatusFields(&buf, fields); err != nil {
+		return "", err
+	}
+
+	for _, rcpt := range r.Recipients {
+		if rcpt.FinalRecipient == "" {
+			return "", errors.New("gomail: a recipient of a delivery report requires a final recipient")
+		}
+		switch rcpt.Action {
+		case "failed", "delayed", "delivered", "relayed", "expanded":
+		default:
+			return "", fmt.Errorf("gomail: invalid delivery report action %q", rcpt.Action)
+		}
+		if !isStatusCode(rcpt.Status) {
+			return "", fmt.Errorf("gomail: invalid delivery report status %q", rcpt.Status)
+		}
+
+		buf.WriteString("\r\n")
+		fields = [][2]string{
+			{"Original-Recipient", typedValue("rfc822", rcpt.OriginalRecipient)},
+			{"Final-Recipient", typedValue("rfc822", rcpt.FinalRecipient)},
+			{"Action", rcpt.Action},
+			{"Status", rcpt.Status},
+			{"Remote-MTA", typedValue("dns", rcpt.RemoteMTA)},
+			{"Diagnostic-Code", typedValue("smtp", rcpt.DiagnosticCode)},
+			{"Last-Attempt-Date", m.formatReportDate(rcpt.LastAttemptDate)},
+			{"Will-Retry-Until", m.formatReportDate(rcpt.WillRetryUntil)},
+		}
+		if err := writeStatusFields(&buf, fields); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// writeStatusFields writes the fields with a non-empty value.
+func writeStatusFields(buf *bytes.Buffer, fields [][2]string) error {
+	for _, f := range fields {
+		if f[1] == "" {
+			continue
+		}
+		if err := checkHeader(f[0], []string{f[1]}); err != nil {
+			return err
+		}
+		buf.WriteString(f[0] + ": " + f[1] + "\r\n")
+	}
+	return nil
+}
+
+// typedValue prefixes v with typ when it has no type.
+func typedValue(typ, v string) string {
+	if v == "" || strings.Contains(v, ";") {
+		return v
+	}
+	return typ + "; " + v
+}
+
+func (m *Message) formatReportDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return m.FormatDate(t)
+}
+
+// isStatusCode reports whether s is an enhanced status code as defined in RFC
+// 3463: class "." subject "." detail.
+func isStatusCode(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if len(p) == 0 || len(p) > 3 {
+			return false
+		}
+		for _, c := range p {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readDSN parses the delivery status notification msg and returns the content
+// types of its parts, its per-message fields and its per-recipient fields.
+func readDSN(t *testing.T, msg []byte) ([]string, textproto.MIMEHeader, []textproto.MIMEHeader, []string) {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("invalid Content-Type %q", m.Header.Get("Content-Type"))
+	}
+
+	var types, bodies []string
+	var fields textproto.MIMEHeader
+	var rcpts []textproto.MIMEHeader
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		types = append(types, p.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, string(body))
+		if p.Header.Get("Content-Type") != "message/delivery-status" {
+			continue
+		}
+		tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(body)))
+		if fields, err = tr.ReadMIMEHeader(); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			h, err := tr.ReadMIMEHeader()
+			if len(h) > 0 {
+				rcpts = append(rcpts, h)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	return types, fields, rcpts, bodies
+}
+
+func TestDeliveryReport(t *testing.T) {
+	returned := "From: from@example.com\r\nTo: to@example.com\r\nSubject: Hello\r\n\r\nHello!\r\n"
+
+	m := NewMessage()
+	m.SetHeader("From", "MAILER-DAEMON@mx.example.org")
+	m.SetHeader("To", "from@example.com")
+	m.SetHeader("Subject", "Undelivered Mail Returned to Sender")
+	m.SetBody("text/plain", "Your message could not be delivered.")
+	err := m.SetDeliveryReport(&DeliveryReport{
+		ReportingMTA: "mx.example.org",
+		ArrivalDate:  time.Date(2014, 6, 25, 17, 40, 0, 0, time.UTC),
+		Recipients: []RecipientStatus{{
+			FinalRecipient: "to@example.com",
+			Action:         "failed",
+			Status:         "5.1.1",
+			RemoteMTA:      "dns; mx.example.com",
+			DiagnosticCode: "smtp; 550 5.1.1 User unknown",
+		}, {
+			OriginalRecipient: "rfc822; other@example.com",
+			FinalRecipient:    "rfc822; other@example.net",
+			Action:            "delayed",
+			Status:            "4.4.1",
+			WillRetryUntil:    time.Date(2014, 6, 30, 17, 40, 0, 0, time.UTC),
+		}},
+		Returned: []byte(returned),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types, fields, rcpts, bodies := readDSN(t, msg)
+	if want := []string{"text/plain; charset=UTF-8", "message/delivery-status", "message/rfc822"}; strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Fatalf("invalid parts, got %q, want %q", types, want)
+	}
+	if bodies[0] != "Your message could not be delivered." {
+		t.Errorf("invalid human-readable part, got %q", bodies[0])
+	}
+	if bodies[2] != returned {
+		t.Errorf("invalid returned message, got %q", bodies[2])
+	}
+	if got := fields.Get("Reporting-MTA"); got != "dns; mx.example.org" {
+		t.Errorf("invalid Reporting-MTA, got %q", got)
+	}
+	if got := fields.Get("Arrival-Date"); got != "Wed, 25 Jun 2014 17:40:00 +0000" {
+		t.Errorf("invalid Arrival-Date, got %q", got)
+	}
+	if len(rcpts) != 2 {
+		t.Fatalf("expected 2 per-recipient blocks, got %d", len(rcpts))
+	}
+	want := []map[string]string{{
+		"Final-Recipient": "rfc822; to@example.com",
+		"Action":          "failed",
+		"Status":          "5.1.1",
+		"Remote-Mta":      "dns; mx.example.com",
+		"Diagnostic-Code": "smtp; 550 5.1.1 User unknown",
+	}, {
+		"Original-Recipient": "rfc822; other@example.com",
+		"Final-Recipient":    "rfc822; other@example.net",
+		"Action":             "delayed",
+		"Status":             "4.4.1",
+		"Will-Retry-Until":   "Mon, 30 Jun 2014 17:40:00 +0000",
+	}}
+	for i, h := range rcpts {
+		if len(h) != len(want[i]) {
+			t.Errorf("invalid fields of recipient %d, got %v", i, h)
+		}
+		for k, v := range want[i] {
+			if got := h.Get(k); got != v {
+				t.Errorf("invalid %s of recipient %d, got %q, want %q", k, i, got, v)
+			}
+		}
+	}
+}
+
+func TestDeliveryReportHeadersOnly(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "MAILER-DAEMON@mx.example.org")
+	m.SetHeader("To", "from@example.com")
+	m.SetBody("text/plain", "Your message was delivered.")
+	m.AddAlternative("text/html", "<p>Your message was delivered.</p>")
+	err := m.SetDeliveryReport(&DeliveryReport{
+		ReportingMTA: "dns; mx.example.org",
+		Recipients: []RecipientStatus{
+			{FinalRecipient: "to@example.com", Action: "delivered", Status: "2.0.0"},
+		},
+		Returned:          []byte("Subject: Héllo\nTo: to@example.com\n\nHello!\n"),
+		ReturnHeadersOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types, _, rcpts, bodies := readDSN(t, msg)
+	if len(types) != 3 || !strings.HasPrefix(types[0], "multipart/alternative;") || types[2] != "text/rfc822-headers" {
+		t.Fatalf("invalid parts, got %q", types)
+	}
+	if want := "Subject: Héllo\r\nTo: to@example.com\r\n"; bodies[2] != want {
+		t.Errorf("the returned header should not include the body, got %q, want %q", bodies[2], want)
+	}
+	if !bytes.Contains(msg, []byte("Content-Transfer-Encoding: 8bit\r\nContent-Type: text/rfc822-headers\r\n")) {
+		t.Errorf("the returned header should be sent as 8bit, got:\n%s", msg)
+	}
+	if len(rcpts) != 1 || rcpts[0].Get("Action") != "delivered" {
+		t.Errorf("invalid per-recipient fields, got %v", rcpts)
+	}
+
+	m.Attach("file.txt", SetCopyFunc(func(w io.Writer) error {
+		_, err := io.WriteString(w, "Content")
+		return err
+	}))
+	if _, err := m.Bytes(); err == nil {
+		t.Error("expected an error with an attachment")
+	}
+}
+
+func TestDeliveryReportError(t *testing.T) {
+	rcpt := RecipientStatus{FinalRecipient: "to@example.com", Action: "failed", Status: "5.1.1"}
+	tests := []struct {
+		name string
+		r    DeliveryReport
+	}{
+		{"no reporting MTA", DeliveryReport{Recipients: []RecipientStatus{rcpt}}},
+		{"no recipient", DeliveryReport{ReportingMTA: "mx.example.org"}},
+		{"no final recipient", DeliveryReport{ReportingMTA: "mx.example.org", Recipients: []RecipientStatus{{Action: "failed", Status: "5.1.1"}}}},
+		{"invalid action", DeliveryReport{ReportingMTA: "mx.example.org", Recipients: []RecipientStatus{{FinalRecipient: "to@example.com", Action: "bounced", Status: "5.1.1"}}}},
+		{"invalid status", DeliveryReport{ReportingMTA: "mx.example.org", Recipients: []RecipientStatus{{FinalRecipient: "to@example.com", Action: "failed", Status: "550"}}}},
+		{"invalid class", DeliveryReport{ReportingMTA: "mx.example.org", Recipients: []RecipientStatus{{FinalRecipient: "to@example.com", Action: "failed", Status: "3.1.1"}}}},
+		{"header injection", DeliveryReport{ReportingMTA: "mx.example.org\r\nBcc: x@example.com", Recipients: []RecipientStatus{rcpt}}},
+	}
+	for _, test := range tests {
+		if err := NewMessage().SetDeliveryReport(&test.r); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
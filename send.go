@@ -2,10 +2,15 @@ package mail
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	stdmail "net/mail"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Sender is the interface that wraps the Send method.
@@ -21,6 +26,81 @@ type SendCloser interface {
 	Close() error
 }
 
+// Resettable is implemented by the SendClosers whose mail transaction can be
+// reset, for example so a connection pool can reuse a connection after a
+// failed Send without closing it.
+type Resettable interface {
+	// Reset aborts the current mail transaction, the next Send starts a new
+	// one on the same connection.
+	Reset() error
+}
+
+// Verifier is implemented by the SendClosers that can check whether a
+// recipient would be accepted without sending a message.
+type Verifier interface {
+	// VerifyRecipient starts a mail transaction from the given address to
+	// the given recipient and aborts it before any content is sent.
+	VerifyRecipient(ctx context.Context, from, to string) error
+}
+
+// StatsSender is implemented by the SendClosers reporting statistics about
+// each message sent.
+type StatsSender interface {
+	// SendWithStats sends the message like Send and returns its statistics,
+	// also when it fails.
+	SendWithStats(ctx context.Context, from string, to []string, msg io.WriterTo) (SendStats, error)
+}
+
+// SendStats are the statistics of a message returned by StatsSender.
+type SendStats struct {
+	// Bytes is the number of bytes of the message written to the server,
+	// including the Received header field added by the Dialer. When the
+	// message is sent again after a failure, only the last attempt is
+	// counted.
+	Bytes int64
+	// Duration is the time spent sending the message, the time waited for
+	// the rate limiter is not included.
+	Duration time.Duration
+	// Retried reports whether the connection had to be reopened to send the
+	// message: after being idle, after Dialer.MaxMessagesPerConnection
+	// messages or to send it again after a failure.
+	Retried bool
+	// Suppressed are the recipients removed from the envelope by
+	// Dialer.SuppressionList.
+	Suppressed []string
+}
+
+// Commander is implemented by the SendClosers connected to an SMTP server
+// accepting raw commands.
+type Commander interface {
+	// Command sends the command line, without its trailing CRLF, and returns
+	// the reply of the server. The error is only set when the command could
+	// not be sent or the reply could not be read: a reply with a 4xx or 5xx
+	// code is returned as is.
+	//
+	// Command is meant for advanced uses like HELP or proprietary
+	// extensions. It is unsafe: a command starting a mail transaction, a
+	// command expecting more data than its reply, like DATA or AUTH, or a
+	// command changing the state of the session, like STARTTLS, leaves the
+	// connection in a state the Sender does not expect.
+	Command(cmd string) (code int, message string, err error)
+}
+
+// ConnectionInspector is implemented by the SendClosers connected to a server,
+// for example to log the peer address or the negotiated TLS cipher suite.
+type ConnectionInspector interface {
+	// NetConn returns the connection to the server. It is meant for
+	// inspection only: reading, writing or changing its deadlines corrupts
+	// the SMTP session. After STARTTLS it carries the encrypted stream.
+	NetConn() net.Conn
+	// ConnectionState returns the state of the TLS connection, false when
+	// TLS is not used.
+	ConnectionState() (tls.ConnectionState, bool)
+	// UsedTLS reports whether the connection is encrypted, either with SSL
+	// or after STARTTLS.
+	UsedTLS() bool
+}
+
 // A SendFunc is a function that sends emails to the given addresses.
 //
 // The SendFunc type is an adapter to allow the use of ordinary functions as
@@ -33,23 +113,141 @@ func (f SendFunc) Send(ctx context.Context, from string, to []string, msg io.Wri
 	return f(ctx, from, to, msg)
 }
 
-// Send sends emails using the given Sender.
+// Send sends emails using the given Sender. It stops at the first message that
+// could not be sent and returns a SendError.
 func Send(ctx context.Context, s Sender, msg ...*Message) error {
 	for i, m := range msg {
 		if err := send(ctx, s, m); err != nil {
-			return fmt.Errorf("gomail: could not send email, Index:%d: %w", i, err)
+			return newSendError(i, m, err)
+		}
+	}
+	return nil
+}
+
+// SendAll sends emails using the given Sender like Send, but it goes on with
+// the next messages when a message could not be sent. It returns the SendErrors
+// of the messages that could not be sent, nil if all of them were sent.
+func SendAll(ctx context.Context, s Sender, msg ...*Message) error {
+	var errs SendErrors
+	for i, m := range msg {
+		if err := send(ctx, s, m); err != nil {
+			errs = append(errs, newSendError(i, m, err))
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+// SendError is returned by Send when a message could not be sent.
+type SendError struct {
+	// Index is the index of the message in the messages given to Send.
+	Index int
+	// To holds the recipients of the message, it is nil if they could not
+	// be read.
+	To  []string
+	Err error
+}
+
+func newSendError(i int, m *Message, err error) SendError {
+	to, _ := m.Recipients()
+	return SendError{Index: i, To: to, Err: err}
+}
+
+func (e SendError) Error() string {
+	return fmt.Sprintf("gomail: could not send email, Index:%d: %v", e.Index, e.Err)
+}
+
+func (e SendError) Unwrap() error {
+	return e.Err
+}
+
+// SendErrors is returned by SendAll when messages could not be sent, the errors
+// are ordered by message index.
+type SendErrors []SendError
+
+func (e SendErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the SendError of each message, so errors.Is and errors.As
+// look into all of them.
+func (e SendErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// A PersonalizeFunc returns the envelope sender and the header fields of the
+// copy of a message sent to the recipient to. An empty envelopeFrom means the
+// envelope sender of the message is used.
+type PersonalizeFunc func(to string) (envelopeFrom string, headerOverrides map[string]string)
+
+// SendPersonalized sends a copy of each message to each of its recipients in a
+// separate transaction, for example to use a VERP envelope sender or a
+// per-recipient List-Unsubscribe header field. The copy sent to a recipient
+// has the envelope sender and header fields returned by personalize, the other
+// header fields like To and Cc are kept. Unless it is set, the Message-ID
+// header field is generated for each copy.
+//
+// A message with several recipients is rejected before any copy is sent if it
+// has content read by AttachReader, EmbedReader or SetRaw from an io.Reader
+// that does not implement io.Seeker, since the content could only be sent to
+// the first recipient.
+func SendPersonalized(ctx context.Context, s Sender, personalize PersonalizeFunc, msg ...*Message) error {
+	for i, m := range msg {
+		if err := sendPersonalized(ctx, s, personalize, m); err != nil {
+			return newSendError(i, m, err)
 		}
 	}
 	return nil
 }
 
+func sendPersonalized(ctx context.Context, s Sender, personalize PersonalizeFunc, m *Message) error {
+	from, err := m.getFrom()
+	if err != nil {
+		return fmt.Errorf("gomail: getFrom failed: %w", err)
+	}
+
+	to, err := m.Recipients()
+	if err != nil {
+		return fmt.Errorf("gomail: getRecipients failed: %w", err)
+	}
+	if len(to) > 1 && m.oneShot() {
+		return errOneShot
+	}
+
+	for _, addr := range to {
+		envelopeFrom, headers := personalize(addr)
+		if envelopeFrom == "" {
+			envelopeFrom = from
+		}
+		c := m.Copy()
+		for field, value := range headers {
+			c.SetHeader(field, value)
+		}
+		if err := s.Send(ctx, envelopeFrom, []string{addr}, c); err != nil {
+			return fmt.Errorf("send.Send to %q failed: %w", addr, err)
+		}
+	}
+
+	return nil
+}
+
 func send(ctx context.Context, s Sender, m *Message) error {
 	from, err := m.getFrom()
 	if err != nil {
 		return fmt.Errorf("gomail: getFrom failed: %w", err)
 	}
 
-	to, err := m.getRecipients()
+	to, err := m.Recipients()
 	if err != nil {
 		return fmt.Errorf("gomail: getRecipients failed: %w", err)
 	}
@@ -62,6 +260,10 @@ func send(ctx context.Context, s Sender, m *Message) error {
 }
 
 func (m *Message) getFrom() (string, error) {
+	if err := m.checkSender(); err != nil {
+		return "", err
+	}
+
 	from := m.header["Sender"]
 	if len(from) == 0 {
 		from = m.header["From"]
@@ -73,23 +275,28 @@ func (m *Message) getFrom() (string, error) {
 	return parseAddress(from[0])
 }
 
-func (m *Message) getRecipients() ([]string, error) {
-	n := 0
-	for _, field := range []string{"To", "Cc", "Bcc"} {
-		if addresses, ok := m.header[field]; ok {
-			n += len(addresses)
-		}
+// checkSender returns an error if the Sender header field does not contain
+// exactly one address.
+func (m *Message) checkSender() error {
+	if sender, ok := m.header["Sender"]; ok && len(sender) != 1 {
+		return errors.New(`gomail: invalid message, "Sender" field must contain a single address`)
 	}
-	list := make([]string, 0, n)
+	return nil
+}
 
+// Recipients returns the addresses of the To, Cc and Bcc header fields without
+// their display names. The domains are lowercased and duplicate addresses are
+// removed. These are the addresses Send delivers the message to.
+func (m *Message) Recipients() ([]string, error) {
+	var list []string
 	for _, field := range []string{"To", "Cc", "Bcc"} {
-		if addresses, ok := m.header[field]; ok {
-			for _, a := range addresses {
-				addr, err := parseAddress(a)
-				if err != nil {
-					return nil, fmt.Errorf("gomail: getRecipients.parseAddress failed: %w", err)
-				}
-				list = addAddress(list, addr)
+		for _, a := range m.fieldValues(field) {
+			addrs, err := parseGroup(a)
+			if err != nil {
+				return nil, fmt.Errorf("gomail: getRecipients.parseAddress failed: %w", err)
+			}
+			for _, addr := range addrs {
+				list = addAddress(list, normalizeAddress(addr))
 			}
 		}
 	}
@@ -97,6 +304,27 @@ func (m *Message) getRecipients() ([]string, error) {
 	return list, nil
 }
 
+// fieldValues returns the values of the header field, the field name is case
+// insensitive.
+func (m *Message) fieldValues(field string) []string {
+	if len(m.header) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 1)
+	for k := range m.header {
+		if strings.EqualFold(k, field) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var values []string
+	for _, k := range keys {
+		values = append(values, m.header[k]...)
+	}
+	return values
+}
+
 func addAddress(list []string, addr string) []string {
 	for _, a := range list {
 		if addr == a {
@@ -107,6 +335,15 @@ func addAddress(list []string, addr string) []string {
 	return append(list, addr)
 }
 
+// normalizeAddress lowercases the domain of addr, the local part is case
+// sensitive.
+func normalizeAddress(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i != -1 {
+		return addr[:i] + strings.ToLower(addr[i:])
+	}
+	return addr
+}
+
 func parseAddress(field string) (string, error) {
 	addr, err := stdmail.ParseAddress(field)
 	if err != nil {
@@ -114,3 +351,24 @@ func parseAddress(field string) (string, error) {
 	}
 	return addr.Address, nil
 }
+
+// parseGroup parses an address or a group of addresses written with
+// FormatGroup and returns the addresses of its members.
+func parseGroup(field string) ([]string, error) {
+	if !strings.HasSuffix(strings.TrimSpace(field), ";") {
+		addr, err := parseAddress(field)
+		if err != nil {
+			return nil, err
+		}
+		return []string{addr}, nil
+	}
+	list, err := stdmail.ParseAddressList(field)
+	if err != nil {
+		return nil, fmt.Errorf("gomail: invalid group %q: %w", field, err)
+	}
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.Address
+	}
+	return addrs, nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -18,6 +19,7 @@ const (
 		"From: " + testFrom + "\r\n" +
 		"MIME-Version: 1.0\r\n" +
 		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n" +
+		"Message-ID: " + testMessageID + "\r\n" +
 		"Content-Type: text/plain; charset=UTF-8\r\n" +
 		"Content-Transfer-Encoding: quoted-printable\r\n" +
 		"\r\n" +
@@ -64,6 +66,125 @@ func TestSendError(t *testing.T) {
 	}
 }
 
+func TestSendErrorIndex(t *testing.T) {
+	msgs := []*Message{getTestMessage(), getTestMessage(), getTestMessage()}
+	msgs[1].SetHeader("To", "fail@example.com")
+	var sent []string
+	s := mockSender(func(_ context.Context, _ string, to []string, _ io.WriterTo) error {
+		if to[0] == "fail@example.com" {
+			return errors.New("kaboom")
+		}
+		sent = append(sent, to[0])
+		return nil
+	})
+
+	err := Send(context.Background(), s, msgs...)
+	var serr SendError
+	if !errors.As(err, &serr) || serr.Index != 1 || !reflect.DeepEqual(serr.To, []string{"fail@example.com"}) {
+		t.Fatalf("invalid SendError, got %#v", err)
+	}
+	if len(sent) != 1 {
+		t.Errorf("Send should stop at the failed message, %d messages sent", len(sent))
+	}
+
+	sent = nil
+	err = SendAll(context.Background(), s, msgs...)
+	var errs SendErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Index != 1 {
+		t.Fatalf("invalid SendErrors, got %#v", err)
+	}
+	if !errors.As(err, &serr) || serr.Index != 1 {
+		t.Errorf("SendErrors should unwrap to its SendErrors, got %#v", serr)
+	}
+	if len(sent) != 2 {
+		t.Errorf("SendAll should send the messages after the failed one, %d messages sent", len(sent))
+	}
+	if err := SendAll(context.Background(), s, getTestMessage()); err != nil {
+		t.Errorf("SendAll should return nil when all messages are sent, got %v", err)
+	}
+}
+
+func TestSendPersonalized(t *testing.T) {
+	type delivery struct {
+		from, to, unsubscribe string
+	}
+	var got []delivery
+	s := mockSender(func(_ context.Context, from string, to []string, msg io.WriterTo) error {
+		if len(to) != 1 {
+			t.Fatalf("each transaction should have a single recipient, got %q", to)
+		}
+		var buf bytes.Buffer
+		if _, err := msg.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := m.GetHeader("To"); len(h) != 2 {
+			t.Errorf("the To header field should be kept, got %q", h)
+		}
+		got = append(got, delivery{from, to[0], m.GetHeader("List-Unsubscribe")[0]})
+		return nil
+	})
+
+	err := SendPersonalized(context.Background(), s, func(to string) (string, map[string]string) {
+		id := strings.Replace(to, "@", "=", 1)
+		return "bounces+" + id + "@example.com", map[string]string{
+			"List-Unsubscribe": "<https://example.com/unsubscribe?id=" + id + ">",
+		}
+	}, getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []delivery{
+		{"bounces+to1=example.com@example.com", testTo1, "<https://example.com/unsubscribe?id=to1=example.com>"},
+		{"bounces+to2=example.com@example.com", testTo2, "<https://example.com/unsubscribe?id=to2=example.com>"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid deliveries, got %q, want %q", got, want)
+	}
+
+	got = nil
+	if err := SendPersonalized(context.Background(), s, func(string) (string, map[string]string) {
+		return "", map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@example.com>"}
+	}, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].from != testFrom {
+		t.Errorf("the envelope sender of the message should be used, got %q", got)
+	}
+
+	got = nil
+	m := getTestMessage()
+	m.AttachReader("test.txt", struct{ io.Reader }{strings.NewReader("Test")})
+	if err := SendPersonalized(context.Background(), s, func(string) (string, map[string]string) {
+		return "", map[string]string{"List-Unsubscribe": "<mailto:unsubscribe@example.com>"}
+	}, m); !errors.Is(err, errOneShot) {
+		t.Errorf("expected an error with a reader that cannot be rewound, got %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("no copy should be sent, got %q", got)
+	}
+
+	m = getTestMessage()
+	m.SetHeader("To", testTo1)
+	m.AttachReader("test.txt", struct{ io.Reader }{strings.NewReader("Test")})
+	var content []byte
+	single := mockSender(func(_ context.Context, from string, to []string, msg io.WriterTo) error {
+		var buf bytes.Buffer
+		_, err := msg.WriteTo(&buf)
+		content = buf.Bytes()
+		return err
+	})
+	if err := SendPersonalized(context.Background(), single, func(string) (string, map[string]string) {
+		return "", nil
+	}, m); err != nil || !bytes.Contains(content, []byte("VGVzdA==")) {
+		t.Errorf("a single recipient should be accepted, got %v:\n%s", err, content)
+	}
+}
+
 func getTestMessage() *Message {
 	m := NewMessage()
 	m.SetHeader("From", testFrom)
@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// SendmailSender is a SendCloser piping messages to a local sendmail binary
+// instead of connecting to an SMTP server.
+type SendmailSender struct {
+	// Path is the path of the sendmail binary. Defaults to
+	// "/usr/sbin/sendmail".
+	Path string
+	// Args are the arguments passed to the binary before the recipients.
+	// Defaults to "-i", so a line with a single dot does not end the message.
+	Args []string
+	// UseHeaders reads the recipients from the message header with the -t
+	// flag instead of passing the envelope recipients as arguments. Since
+	// the Bcc header field is never written, Bcc recipients do not receive
+	// the message in this mode.
+	UseHeaders bool
+}
+
+// NewSendmailSender returns a SendmailSender using the sendmail binary at
+// path.
+func NewSendmailSender(path string) *SendmailSender {
+	return &SendmailSender{Path: path}
+}
+
+// Send implements Sender. The process is killed if ctx is done before the
+// message is sent.
+func (s *SendmailSender) Send(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	path := s.Path
+	if path == "" {
+		path = "/usr/sbin/sendmail"
+	}
+	args := s.Args
+	if args == nil {
+		args = []string{"-i"}
+	}
+	args = append(append([]string(nil), args...), "-f", from)
+	if s.UseHeaders {
+		args = append(args, "-t")
+	} else {
+		args = append(append(args, "--"), to...)
+	}
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("gomail: sendmail failed: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("gomail: could not start sendmail: %w", err)
+	}
+
+	_, werr := msg.WriteTo(stdin)
+	if err := stdin.Close(); werr == nil {
+		werr = err
+	}
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("gomail: sendmail failed: %w: %s", err, msg)
+		}
+		return fmt.Errorf("gomail: sendmail failed: %w", err)
+	}
+	if werr != nil {
+		return fmt.Errorf("gomail: could not write to sendmail: %w", werr)
+	}
+
+	return nil
+}
+
+// Close implements SendCloser, it does nothing as a process is started for
+// each message.
+func (s *SendmailSender) Close() error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package mail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeSendmail writes a shell script acting as sendmail: it saves its
+// arguments and its input in dir.
+func newFakeSendmail(t *testing.T, script string) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported")
+	}
+	dir, err := ioutil.TempDir("", "mailgo-sendmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "sendmail")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path, dir
+}
+
+func TestSendmailSender(t *testing.T) {
+	path, dir := newFakeSendmail(t, `echo "$@" > "$(dirname "$0")/args"
+cat > "$(dirname "$0")/stdin"
+`)
+
+	s := NewSendmailSender(path)
+	if err := Send(context.Background(), s, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-i -f " + testFrom + " -- " + testTo1 + " " + testTo2 + "\n"; string(args) != want {
+		t.Errorf("invalid arguments, got %q, want %q", args, want)
+	}
+	stdin, err := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareBodies(t, string(stdin), testMsg)
+
+	s.UseHeaders = true
+	s.Args = []string{"-oi"}
+	if err := Send(context.Background(), s, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if args, _ = ioutil.ReadFile(filepath.Join(dir, "args")); string(args) != "-oi -f "+testFrom+" -t\n" {
+		t.Errorf("invalid arguments with UseHeaders, got %q", args)
+	}
+}
+
+func TestSendmailSenderError(t *testing.T) {
+	path, _ := newFakeSendmail(t, `cat > /dev/null
+echo "recipient rejected" >&2
+exit 67
+`)
+
+	err := Send(context.Background(), NewSendmailSender(path), getTestMessage())
+	if err == nil || !strings.Contains(err.Error(), "recipient rejected") {
+		t.Errorf("the error should contain the standard error of sendmail, got %v", err)
+	}
+
+	if err := Send(context.Background(), NewSendmailSender(path+".missing"), getTestMessage()); err == nil {
+		t.Error("expected an error with a missing binary")
+	}
+}
+
+func TestSendmailSenderCancel(t *testing.T) {
+	path, _ := newFakeSendmail(t, `cat > /dev/null
+exec sleep 10
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := Send(ctx, NewSendmailSender(path), getTestMessage()); err == nil {
+		t.Error("expected an error when the context is done")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the process should be killed, took %v", elapsed)
+	}
+}
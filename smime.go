@@ -0,0 +1,241 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// SMIMESigner is a Transformer that signs messages with S/MIME as defined in
+// RFC 8551. The message content is wrapped in a multipart/signed entity
+// together with a detached PKCS #7 signature.
+//
+// Only the content is signed, the message headers are not protected by the
+// signature. Parts using the Unencoded encoding must only contain CRLF line
+// endings or the signature will not verify.
+type SMIMESigner struct {
+	// Certificate is the signing certificate.
+	Certificate *x509.Certificate
+	// PrivateKey is the private key of Certificate. RSA and ECDSA keys are
+	// supported.
+	PrivateKey crypto.Signer
+	// Intermediates are the certificates added to the signature, besides
+	// Certificate, so the recipient can build the full chain.
+	Intermediates []*x509.Certificate
+}
+
+// NewSMIMESigner returns a new SMIMESigner using the given certificate and
+// private key. The intermediates are included in the signature.
+func NewSMIMESigner(cert *x509.Certificate, key crypto.Signer, intermediates ...*x509.Certificate) *SMIMESigner {
+	return &SMIMESigner{
+		Certificate:   cert,
+		PrivateKey:    key,
+		Intermediates: intermediates,
+	}
+}
+
+// Transform implements Transformer. The signing time is the current time, or
+// the time of the clock of the message set with SetClock when the SMIMESigner
+// is used with SetTransformers.
+func (s *SMIMESigner) Transform(w io.Writer, entity []byte) error {
+	return s.transformAt(w, entity, now())
+}
+
+func (s *SMIMESigner) transformAt(w io.Writer, entity []byte, t time.Time) error {
+	sig, err := s.sign(entity, t)
+	if err != nil {
+		return err
+	}
+
+	return writeMultipartSigned(w, entity, "application/pkcs7-signature", "sha-256",
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n",
+		func(w io.Writer) error {
+			enc := base64.NewEncoder(base64.StdEncoding, newBase64LineWriter(w, maxLineLen))
+			if _, err := enc.Write(sig); err != nil {
+				return err
+			}
+			return enc.Close()
+		})
+}
+
+var (
+	oidData                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256        = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkcs7AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7AlgorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkcs7AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional"`
+	DigestEncryptionAlgorithm pkcs7AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type pkcs7Attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+func (s *SMIMESigner) sign(content []byte, t time.Time) ([]byte, error) {
+	if s.Certificate == nil || s.PrivateKey == nil {
+		return nil, errors.New("gomail: S/MIME signer requires a certificate and a private key")
+	}
+
+	var sigAlg asn1.ObjectIdentifier
+	switch s.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = oidRSAEncryption
+	case *ecdsa.PublicKey:
+		sigAlg = oidECDSAWithSHA256
+	default:
+		return nil, fmt.Errorf("gomail: unsupported S/MIME key type %T", s.PrivateKey.Public())
+	}
+
+	digest := sha256.Sum256(content)
+	attrs, err := marshalAttributes(
+		attribute(oidAttributeContentType, oidData),
+		attribute(oidAttributeSigningTime, t.UTC()),
+		attribute(oidAttributeMessageDigest, digest[:]),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("gomail: could not encode S/MIME attributes: %w", err)
+	}
+
+	// The signature is computed over the DER encoding of the attributes as a
+	// SET OF, while they are stored with an implicit [0] tag.
+	signed, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(signed)
+	signature, err := s.PrivateKey.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("gomail: S/MIME signing failed: %w", err)
+	}
+
+	var certs []byte
+	certs = append(certs, s.Certificate.Raw...)
+	for _, c := range s.Intermediates {
+		certs = append(certs, c.Raw...)
+	}
+
+	sha256Alg := pkcs7AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	encAlg := pkcs7AlgorithmIdentifier{Algorithm: sigAlg}
+	if sigAlg.Equal(oidRSAEncryption) {
+		encAlg.Parameters = asn1.NullRawValue
+	}
+
+	sd := pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkcs7AlgorithmIdentifier{sha256Alg},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: pkcs7IssuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: s.Certificate.RawIssuer},
+				SerialNumber: s.Certificate.SerialNumber,
+			},
+			DigestAlgorithm:           sha256Alg,
+			AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			DigestEncryptionAlgorithm: encAlg,
+			EncryptedDigest:           signature,
+		}},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("gomail: could not encode S/MIME signature: %w", err)
+	}
+
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+type pkcs7AttributeValue struct {
+	oid   asn1.ObjectIdentifier
+	value interface{}
+}
+
+func attribute(oid asn1.ObjectIdentifier, value interface{}) pkcs7AttributeValue {
+	return pkcs7AttributeValue{oid: oid, value: value}
+}
+
+// marshalAttributes encodes the attributes sorted by their encoding, as
+// required for a DER SET OF.
+func marshalAttributes(values ...pkcs7AttributeValue) ([]byte, error) {
+	encoded := make([][]byte, 0, len(values))
+	for _, v := range values {
+		var (
+			b   []byte
+			err error
+		)
+		if t, ok := v.value.(time.Time); ok {
+			b, err = asn1.MarshalWithParams(t, "utc")
+		} else {
+			b, err = asn1.Marshal(v.value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(pkcs7Attribute{
+			Type:  v.oid,
+			Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: b},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, attr)
+	}
+
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+
+	return bytes.Join(encoded, nil), nil
+}
@@ -0,0 +1,285 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, cn string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		EmailAddresses:        []string{"from@example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newTestSigner(t *testing.T) (*SMIMESigner, *x509.Certificate) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCertificate(t, "Test CA", caKey, nil, nil)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := newTestCertificate(t, "from@example.com", key, ca, caKey)
+
+	return NewSMIMESigner(leaf, key, ca), ca
+}
+
+func getSignedParts(t *testing.T, raw []byte) (content, sig []byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/signed" {
+		t.Fatalf("invalid media type, got %q, want multipart/signed", mediaType)
+	}
+	if params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatalf("invalid multipart/signed parameters: %v", params)
+	}
+
+	// The signed content must be extracted verbatim, multipart.Reader would
+	// parse its headers.
+	delim := []byte("--" + params["boundary"] + "\r\n")
+	start := bytes.Index(raw, delim) + len(delim)
+	end := bytes.Index(raw[start:], []byte("\r\n--"+params["boundary"])) + start
+	content = raw[start:end]
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := p.Header.Get("Content-Type"); ct != `application/pkcs7-signature; name="smime.p7s"` {
+		t.Fatalf("invalid signature Content-Type, got %q", ct)
+	}
+	sig, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content, sig
+}
+
+func verifySignature(t *testing.T, content, der []byte, roots *x509.CertPool) {
+	t.Helper()
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("invalid content type %v", ci.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+
+	var certs []*x509.Certificate
+	for rest := sd.Certificates.Bytes; len(rest) > 0; {
+		var raw asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &raw); err != nil {
+			t.Fatal(err)
+		}
+		c, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("invalid certificate chain length, got %d, want 2", len(certs))
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}); err != nil {
+		t.Fatalf("invalid certificate chain: %v", err)
+	}
+
+	si := sd.SignerInfos[0]
+	if si.IssuerAndSerialNumber.SerialNumber.Cmp(certs[0].SerialNumber) != 0 {
+		t.Fatal("signer info does not reference the signing certificate")
+	}
+
+	var attrs []pkcs7Attribute
+	signed, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: si.AuthenticatedAttributes.Bytes})
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(content)
+	found := false
+	for _, a := range attrs {
+		if a.Type.Equal(oidAttributeMessageDigest) {
+			var got []byte
+			if _, err := asn1.Unmarshal(a.Value.Bytes, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, digest[:]) {
+				t.Fatal("message digest does not match the signed content")
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("message digest attribute is missing")
+	}
+
+	if err := certs[0].CheckSignature(x509.SHA256WithRSA, signed, si.EncryptedDigest); err != nil {
+		t.Fatalf("invalid signature: %v", err)
+	}
+}
+
+func TestSMIMESigner(t *testing.T) {
+	signer, ca := newTestSigner(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	m := NewMessage(SetTransformers(signer))
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Subject", "Signed")
+	m.SetBody("text/plain", "¡Hola, señor!")
+	m.AddAlternative("text/html", "<p>¡Hola, señor!</p>")
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+
+	content, sig := getSignedParts(t, raw)
+	if !bytes.HasPrefix(content, []byte("Content-Type: multipart/mixed;")) {
+		t.Errorf("signed content should start with the original entity, got:\n%s", content)
+	}
+	verifySignature(t, content, sig, roots)
+
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not found, skipping verification")
+	}
+	dir, err := ioutil.TempDir("", "mailgo-smime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	msgFile := filepath.Join(dir, "msg.eml")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(msgFile, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("openssl", "smime", "-verify", "-in", msgFile, "-CAfile", caFile, "-out", os.DevNull).CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl smime -verify failed: %v\n%s", err, out)
+	}
+}
+
+func TestSMIMESignerClock(t *testing.T) {
+	signer, _ := newTestSigner(t)
+	clock := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := NewMessage(SetClock(func() time.Time { return clock }), SetTransformers(signer))
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Signed")
+
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sig := getSignedParts(t, raw)
+	signingTime, err := asn1.Marshal(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(sig, signingTime) {
+		t.Errorf("the signing time should be the time of the clock of the message")
+	}
+}
+
+func TestSMIMESignerECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCertificate(t, "from@example.com", key, nil, nil)
+
+	m := NewMessage(SetTransformers(NewSMIMESigner(cert, key)))
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Test")
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := getSignedParts(t, buf.Bytes())
+	want := "Content-Type: text/plain; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Test"
+	compareBodies(t, string(content), want)
+}
+
+func TestSMIMESignerMissingKey(t *testing.T) {
+	m := NewMessage(SetTransformers(&SMIMESigner{}))
+	m.SetHeader("From", "from@example.com")
+	m.SetBody("text/plain", "Test")
+
+	if _, err := m.WriteTo(ioutil.Discard); err == nil {
+		t.Error("expected an error when the signer has no key")
+	}
+}
@@ -3,19 +3,31 @@ package mail
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// A Dialer is a dialer to an SMTP server.
+// A Dialer is a dialer to an SMTP server. A Dialer must not be copied after
+// first use.
 type Dialer struct {
 	// ProxyDial specifies the optional dial function for
 	// establishing the transport connection.
 	DialProxy func(ctx context.Context, network, address string) (net.Conn, error)
+	// Network is the network passed to DialProxy, "tcp" when empty. With
+	// "unix", Host is the path of the socket of a local SMTP server and Port
+	// is ignored. HappyEyeballs only applies to the default network.
+	Network string
 	// Host represents the host of the SMTP server.
 	Host string
 	// Port represents the port of the SMTP server.
@@ -27,6 +39,19 @@ type Dialer struct {
 	// Auth represents the authentication mechanism used to authenticate to the
 	// SMTP server.
 	Auth smtp.Auth
+	// PreferredAuthMechanisms lists the SASL mechanisms to choose from, in
+	// order of preference, when Auth is nil. The first one advertised by the
+	// server is used, "CRAM-MD5", "LOGIN", "PLAIN" and "EXTERNAL" are
+	// supported. When none of them is advertised, EXTERNAL is used if a
+	// client certificate is set in TLSConfig, then CRAM-MD5 is preferred to
+	// LOGIN and PLAIN.
+	PreferredAuthMechanisms []string
+	// AuthSelector, if not nil, returns the authentication to use when Auth
+	// is nil, given the mechanisms advertised by the server, instead of
+	// choosing one from PreferredAuthMechanisms and the credentials. No
+	// authentication is done if it returns nil, and Dial fails if it
+	// returns an error.
+	AuthSelector func(mechanisms []string) (smtp.Auth, error)
 	// SSL defines whether an SSL connection is used. It should be false in
 	// most cases since the authentication mechanism should use the STARTTLS
 	// extension instead.
@@ -34,6 +59,11 @@ type Dialer struct {
 	// TLSConfig represents the TLS configuration used for the TLS (when the
 	// STARTTLS extension is used) or SSL connection.
 	TLSConfig *tls.Config
+	// TLSSessionCache caches the TLS sessions so the connections resume
+	// them instead of doing a full handshake. Defaults to an LRU cache
+	// shared by the connections of the Dialer. It is not used when TLSConfig
+	// has a ClientSessionCache.
+	TLSSessionCache tls.ClientSessionCache
 	// StartTLSPolicy represents the TLS security level required to
 	// communicate with the SMTP server.
 	//
@@ -42,6 +72,18 @@ type Dialer struct {
 	//
 	// This option has no effect if SSL is set to true.
 	StartTLSPolicy StartTLSPolicy
+	// LocalAddr, if not nil, is the local address of the connection to the
+	// server, for example to send from the source IP matching the reverse
+	// DNS of a multi-homed host. The connection is then opened with a
+	// net.Dialer bound to it and DialProxy is not used.
+	LocalAddr net.Addr
+	// HappyEyeballs resolves Host and races connections to its IPv6 and IPv4
+	// addresses as described in RFC 8305, instead of dialing Host with
+	// DialProxy, so an unreachable address does not stall Dial.
+	HappyEyeballs bool
+	// Resolver is used for the DNS lookups of HappyEyeballs and MXSender,
+	// net.DefaultResolver when nil.
+	Resolver Resolver
 	// LocalName is the hostname sent to the SMTP server with the HELO command.
 	// By default, "localhost" is sent.
 	LocalName string
@@ -50,9 +92,143 @@ type Dialer struct {
 	Timeout      time.Duration
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake of SSL connections and the
+	// STARTTLS command independently of Timeout. Zero means Timeout is used.
+	TLSHandshakeTimeout time.Duration
+	// QuitTimeout bounds the QUIT command sent by Close, the connection is
+	// closed anyway when it expires. Defaults to 2 seconds.
+	QuitTimeout time.Duration
+	// OnPlaintext, if not nil, is called by Dial with a
+	// StartTLSUnsupportedError when the server does not support STARTTLS
+	// under the OpportunisticStartTLS policy, so the downgrade can be logged.
+	// If it returns an error, the connection is closed and Dial returns it.
+	OnPlaintext func(err error) error
+	// BinaryMIME sends the attachments and embedded files using the default
+	// encoding as binary instead of base64 when the server supports the
+	// CHUNKING and BINARYMIME extensions defined in RFC 3030. The message is
+	// then sent with BDAT commands instead of DATA.
+	BinaryMIME bool
+	// AddReceivedHeader prepends a Received header field to each message
+	// sent, describing its transfer to the server as defined in RFC 5321,
+	// with the ESMTPS protocol when the connection is encrypted.
+	AddReceivedHeader bool
+	// Clock returns the current time, used for the date of the Received
+	// header field. Defaults to time.Now. The clock of a message is set with
+	// SetClock.
+	Clock func() time.Time
+	// RequireMTPriority makes sending a message with a priority set by
+	// Message.SetMTPriority fail when the server does not support the
+	// MT-PRIORITY extension, instead of sending it without priority.
+	RequireMTPriority bool
+	// ContinueOnError makes DialAndSend send the next messages when a message
+	// could not be sent, like SendAll, instead of stopping like Send.
+	ContinueOnError bool
 	// Whether we should retry mailing if the connection returned an error,
 	// defaults to true.
 	RetryFailure bool
+	// RetryClassifier, if not nil, decides whether a message that failed in
+	// the given phase is sent again on a new connection when RetryFailure is
+	// set. By default timeouts and closed connections are retried until the
+	// content of the message is sent, since the server may then have accepted
+	// it already.
+	RetryClassifier func(phase SendPhase, err error) bool
+	// IdleTimeout closes the connections returned by Dial after not sending
+	// any message for this duration. The next Send then reconnects when
+	// RetryFailure is set and otherwise returns ErrConnectionIdle. Zero
+	// means connections are kept open until closed.
+	IdleTimeout time.Duration
+	// MaxRcptPerMessage is the maximum number of recipients of a mail
+	// transaction. A message with more recipients is sent in several
+	// transactions on the same connection, with the same content. Zero
+	// means no limit.
+	MaxRcptPerMessage int
+	// MaxMessagesPerConnection is the number of messages sent on a
+	// connection returned by Dial before it is closed, the next Send then
+	// opens a new connection. Zero means no limit.
+	MaxMessagesPerConnection int
+	// RateLimit is the maximum number of messages sent per second, shared by
+	// all the connections of the Dialer. Zero means no limit. It is read
+	// when the first message is sent and must not be changed afterwards.
+	RateLimit float64
+	// Limiter, if not nil, is waited on before sending each message instead
+	// of RateLimit. It is implemented by golang.org/x/time/rate.Limiter.
+	Limiter Limiter
+	// Metrics, if not nil, records the connections and the messages sent.
+	Metrics Metrics
+	// SuppressionList, if not nil, removes the suppressed recipients from
+	// the envelope of each message before the RCPT commands. The message is
+	// not sent when all its recipients are suppressed. The suppressed
+	// recipients are returned in SendStats by SendWithStats, they are not
+	// an error.
+	SuppressionList SuppressionList
+	// Logger, if not nil, logs each SMTP command and the reply code of the
+	// server at the debug level, with the reply text when the command fails.
+	// The credentials sent with AUTH are never logged.
+	Logger *slog.Logger
+
+	rateLimiterOnce  sync.Once
+	rateLimiter      *intervalLimiter
+	sessionCacheOnce sync.Once
+	sessionCache     tls.ClientSessionCache
+}
+
+// A SuppressionList holds the addresses no message must be sent to, for
+// example because they bounced or unsubscribed.
+type SuppressionList interface {
+	// IsSuppressed reports whether addr is suppressed. It is called
+	// concurrently when several connections are used.
+	IsSuppressed(addr string) bool
+}
+
+// A Limiter delays the sending of messages.
+type Limiter interface {
+	// Wait blocks until a message can be sent or ctx is done.
+	Wait(ctx context.Context) error
+}
+
+// Metrics records the activity of a Dialer, for example to export it to
+// Prometheus or statsd. Its methods are called concurrently when several
+// connections are used.
+type Metrics interface {
+	// ObserveDial is called after each call to Dial with its duration and
+	// its error, nil when the connection was opened.
+	ObserveDial(d time.Duration, err error)
+	// IncSent is called after each message accepted by the server.
+	IncSent()
+	// IncFailed is called after each message that could not be sent.
+	IncFailed()
+	// ObserveSendDuration is called after each message with the time spent
+	// sending it, the time waited for the rate limiter is not included.
+	ObserveSendDuration(d time.Duration)
+	// IncBytes is called after each message accepted by the server with the
+	// number of bytes of the message.
+	IncBytes(n int64)
+}
+
+// NopMetrics is a Metrics that does nothing. It can be embedded to implement
+// only some of the methods of Metrics.
+type NopMetrics struct{}
+
+// ObserveDial implements Metrics.
+func (NopMetrics) ObserveDial(time.Duration, error) {}
+
+// IncSent implements Metrics.
+func (NopMetrics) IncSent() {}
+
+// IncFailed implements Metrics.
+func (NopMetrics) IncFailed() {}
+
+// ObserveSendDuration implements Metrics.
+func (NopMetrics) ObserveSendDuration(time.Duration) {}
+
+// IncBytes implements Metrics.
+func (NopMetrics) IncBytes(int64) {}
+
+func (d *Dialer) metrics() Metrics {
+	if d.Metrics == nil {
+		return NopMetrics{}
+	}
+	return d.Metrics
 }
 
 // NewDialer returns a new SMTP Dialer. The given parameters are used to connect
@@ -70,6 +246,22 @@ func NewDialer(host string, port int, username, password string) *Dialer {
 	}
 }
 
+// NewUnixDialer returns a new SMTP Dialer connecting to the Unix socket at
+// path, for example the submission socket of a local server. STARTTLS is not
+// used since the connection does not leave the machine.
+func NewUnixDialer(path, username, password string) *Dialer {
+	return &Dialer{
+		DialProxy:      (&net.Dialer{}).DialContext,
+		Network:        "unix",
+		Host:           path,
+		Username:       username,
+		Password:       password,
+		StartTLSPolicy: NoStartTLS,
+		Timeout:        10 * time.Second,
+		RetryFailure:   true,
+	}
+}
+
 // NewPlainDialer returns a new SMTP Dialer. The given parameters are used to
 // connect to the SMTP server.
 //
@@ -81,30 +273,52 @@ func NewPlainDialer(host string, port int, username, password string) *Dialer {
 // Dial dials and authenticates to an SMTP server. The returned SendCloser
 // should be closed when done using it.
 func (d *Dialer) Dial(ctx context.Context) (SendCloser, error) {
-	conn, err := d.DialProxy(ctx, "tcp", addr(d.Host, d.Port))
+	s, err := d.dialSender(ctx)
 	if err != nil {
 		return nil, err
 	}
+	s.mu.Lock()
+	s.resetIdleTimer()
+	s.mu.Unlock()
+	return s, nil
+}
 
-	tn := time.Now()
-	if d.Timeout > 0 {
-		conn.SetDeadline(tn.Add(d.Timeout))
-	}
-	if d.ReadTimeout > 0 {
-		conn.SetReadDeadline(tn.Add(d.Timeout))
-	}
-	if d.WriteTimeout > 0 {
-		conn.SetWriteDeadline(tn.Add(d.Timeout))
+// dialSender opens a connection and records it in the metrics.
+func (d *Dialer) dialSender(ctx context.Context) (*smtpSender, error) {
+	start := time.Now()
+	s, err := d.dial(ctx)
+	d.metrics().ObserveDial(time.Since(start), err)
+	return s, err
+}
+
+func (d *Dialer) dial(ctx context.Context) (*smtpSender, error) {
+	conn, err := d.dialConn(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	d.setDeadlines(conn)
+
 	if d.SSL {
-		conn = tlsClient(conn, d.tlsConfig())
+		tlsConn := tlsClient(conn, d.tlsConfig())
+		if d.TLSHandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(d.TLSHandshakeTimeout))
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("gomail: TLS handshake failed: %w", err)
+			}
+			d.setDeadlines(conn)
+		}
+		conn = tlsConn
 	}
 
-	c, err := smtpNewClient(conn, d.Host)
+	c, err := smtpNewClient(conn, d.serverName())
 	if err != nil {
 		return nil, err
 	}
+	if d.Logger != nil {
+		c = &loggingClient{sc: c, logger: d.Logger}
+	}
 
 	if d.LocalName != "" {
 		if err := c.Hello(d.LocalName); err != nil {
@@ -120,50 +334,241 @@ func (d *Dialer) Dial(ctx context.Context) (SendCloser, error) {
 			}
 			return nil, err
 		}
+		if !ok && d.OnPlaintext != nil {
+			if err := d.OnPlaintext(StartTLSUnsupportedError{
+				Policy: d.StartTLSPolicy,
+			}); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
 
 		if ok {
+			if d.TLSHandshakeTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(d.TLSHandshakeTimeout))
+			}
 			if err := c.StartTLS(d.tlsConfig()); err != nil {
 				c.Close()
 				return nil, fmt.Errorf("StartTLS failed: %w", err)
 			}
+			if d.TLSHandshakeTimeout > 0 {
+				d.setDeadlines(conn)
+			}
 		}
 	}
 
-	if d.Auth == nil && d.Username != "" {
+	// The selected authentication is only used for this connection, so Dial
+	// can be called concurrently.
+	auth := d.Auth
+	if auth == nil && d.AuthSelector != nil {
 		if ok, auths := c.Extension("AUTH"); ok {
-			if strings.Contains(auths, "CRAM-MD5") {
-				d.Auth = smtp.CRAMMD5Auth(d.Username, d.Password)
-			} else if strings.Contains(auths, "LOGIN") &&
-				!strings.Contains(auths, "PLAIN") {
-				d.Auth = &loginAuth{
-					username: d.Username,
-					password: d.Password,
-					host:     d.Host,
-				}
-			} else {
-				d.Auth = smtp.PlainAuth("", d.Username, d.Password, d.Host)
+			if auth, err = d.AuthSelector(strings.Fields(auths)); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("gomail: AuthSelector failed: %w", err)
 			}
 		}
+	} else if auth == nil && (d.Username != "" || d.hasClientCertificate()) {
+		if ok, auths := c.Extension("AUTH"); ok {
+			auth = d.selectAuth(auths)
+		}
 	}
 
-	if d.Auth != nil {
-		if err = c.Auth(d.Auth); err != nil {
+	if auth != nil {
+		if err = c.Auth(auth); err != nil {
 			c.Close()
 			return nil, fmt.Errorf("gomail Auth failed: %w", err)
 		}
 	}
 
-	return &smtpSender{c, conn, d}, nil
+	return &smtpSender{sc: c, conn: conn, d: d}, nil
+}
+
+// selectAuth returns the authentication to use with a server advertising the
+// auths mechanisms, nil if none can be used.
+func (d *Dialer) selectAuth(auths string) smtp.Auth {
+	if a := d.preferredAuth(auths); a != nil {
+		return a
+	}
+	if d.hasClientCertificate() && hasMechanism(auths, "EXTERNAL") {
+		return ExternalAuth("")
+	}
+	if d.Username == "" {
+		return nil
+	}
+
+	if hasMechanism(auths, "CRAM-MD5") {
+		return smtp.CRAMMD5Auth(d.Username, d.Password)
+	}
+	if hasMechanism(auths, "LOGIN") && !hasMechanism(auths, "PLAIN") {
+		return &loginAuth{
+			username: d.Username,
+			password: d.Password,
+			host:     d.serverName(),
+		}
+	}
+	return &plainAuth{
+		username: d.Username,
+		password: d.Password,
+		host:     d.serverName(),
+	}
+}
+
+// preferredAuth returns the authentication of the first mechanism of
+// d.PreferredAuthMechanisms advertised by the server, nil if there is none.
+func (d *Dialer) preferredAuth(auths string) smtp.Auth {
+	for _, mech := range d.PreferredAuthMechanisms {
+		if !hasMechanism(auths, mech) {
+			continue
+		}
+
+		switch mech = strings.ToUpper(mech); {
+		case mech == "EXTERNAL":
+			return ExternalAuth("")
+		case d.Username == "":
+			// The other mechanisms need a username.
+		case mech == "CRAM-MD5":
+			return smtp.CRAMMD5Auth(d.Username, d.Password)
+		case mech == "LOGIN":
+			return &loginAuth{
+				username: d.Username,
+				password: d.Password,
+				host:     d.serverName(),
+			}
+		case mech == "PLAIN":
+			return &plainAuth{
+				username: d.Username,
+				password: d.Password,
+				host:     d.serverName(),
+			}
+		}
+	}
+	return nil
+}
+
+// hasMechanism reports whether mech is in the auths list of mechanisms.
+func hasMechanism(auths, mech string) bool {
+	for _, a := range strings.Fields(auths) {
+		if strings.EqualFold(a, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasClientCertificate reports whether a TLS client certificate is configured.
+func (d *Dialer) hasClientCertificate() bool {
+	return d.TLSConfig != nil &&
+		(len(d.TLSConfig.Certificates) > 0 || d.TLSConfig.GetClientCertificate != nil)
+}
+
+// setDeadlines sets the deadlines of conn from the timeouts of d.
+func (d *Dialer) setDeadlines(conn net.Conn) {
+	tn := time.Now()
+	if d.Timeout > 0 {
+		conn.SetDeadline(tn.Add(d.Timeout))
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+	if d.ReadTimeout > 0 {
+		conn.SetReadDeadline(tn.Add(d.Timeout))
+	}
+	if d.WriteTimeout > 0 {
+		conn.SetWriteDeadline(tn.Add(d.Timeout))
+	}
+}
+
+func (d *Dialer) quitTimeout() time.Duration {
+	if d.QuitTimeout <= 0 {
+		return 2 * time.Second
+	}
+	return d.QuitTimeout
+}
+
+// serverName returns the name of the SMTP server, localhost for a Unix socket
+// so the credentials can be sent without TLS.
+func (d *Dialer) serverName() string {
+	if d.Network == "unix" {
+		return "localhost"
+	}
+	return d.Host
 }
 
 func (d *Dialer) tlsConfig() *tls.Config {
 	if d.TLSConfig == nil {
 		return &tls.Config{
-			ServerName: d.Host,
-			MinVersion: tls.VersionTLS12,
+			ServerName:         d.serverName(),
+			MinVersion:         tls.VersionTLS12,
+			ClientSessionCache: d.tlsSessionCache(),
 		}
 	}
-	return d.TLSConfig
+	if d.TLSConfig.ClientSessionCache != nil {
+		return d.TLSConfig
+	}
+	c := d.TLSConfig.Clone()
+	c.ClientSessionCache = d.tlsSessionCache()
+	return c
+}
+
+func (d *Dialer) tlsSessionCache() tls.ClientSessionCache {
+	if d.TLSSessionCache != nil {
+		return d.TLSSessionCache
+	}
+	d.sessionCacheOnce.Do(func() {
+		d.sessionCache = tls.NewLRUClientSessionCache(0)
+	})
+	return d.sessionCache
+}
+
+// clone returns a copy of the settings of d. The copy shares the rate limit
+// and the TLS session cache of d.
+func (d *Dialer) clone() *Dialer {
+	c := &Dialer{
+		DialProxy:                d.DialProxy,
+		Network:                  d.Network,
+		Host:                     d.Host,
+		Port:                     d.Port,
+		Username:                 d.Username,
+		Password:                 d.Password,
+		Auth:                     d.Auth,
+		PreferredAuthMechanisms:  d.PreferredAuthMechanisms,
+		AuthSelector:             d.AuthSelector,
+		SSL:                      d.SSL,
+		TLSConfig:                d.TLSConfig,
+		TLSSessionCache:          d.TLSSessionCache,
+		StartTLSPolicy:           d.StartTLSPolicy,
+		LocalAddr:                d.LocalAddr,
+		HappyEyeballs:            d.HappyEyeballs,
+		Resolver:                 d.Resolver,
+		LocalName:                d.LocalName,
+		Timeout:                  d.Timeout,
+		ReadTimeout:              d.ReadTimeout,
+		WriteTimeout:             d.WriteTimeout,
+		TLSHandshakeTimeout:      d.TLSHandshakeTimeout,
+		QuitTimeout:              d.QuitTimeout,
+		OnPlaintext:              d.OnPlaintext,
+		BinaryMIME:               d.BinaryMIME,
+		AddReceivedHeader:        d.AddReceivedHeader,
+		Clock:                    d.Clock,
+		RequireMTPriority:        d.RequireMTPriority,
+		ContinueOnError:          d.ContinueOnError,
+		RetryFailure:             d.RetryFailure,
+		RetryClassifier:          d.RetryClassifier,
+		IdleTimeout:              d.IdleTimeout,
+		MaxRcptPerMessage:        d.MaxRcptPerMessage,
+		MaxMessagesPerConnection: d.MaxMessagesPerConnection,
+		RateLimit:                d.RateLimit,
+		Limiter:                  d.Limiter,
+		Metrics:                  d.Metrics,
+		SuppressionList:          d.SuppressionList,
+		Logger:                   d.Logger,
+	}
+	if c.Limiter == nil {
+		c.Limiter = d.limiter()
+	}
+	if c.TLSSessionCache == nil {
+		c.TLSSessionCache = d.tlsSessionCache()
+	}
+	return c
 }
 
 // StartTLSPolicy constants are valid values for Dialer.StartTLSPolicy.
@@ -196,6 +601,40 @@ func (policy StartTLSPolicy) String() string {
 	}
 }
 
+// SendPhase is the step of a mail transaction, it is passed to
+// Dialer.RetryClassifier.
+type SendPhase int
+
+const (
+	// PhaseMail is the MAIL command starting the transaction.
+	PhaseMail SendPhase = iota
+	// PhaseRcpt is the RCPT command of a recipient.
+	PhaseRcpt
+	// PhaseData is the DATA command, before the content of the message is
+	// sent.
+	PhaseData
+	// PhaseContent is the transmission of the content of the message and
+	// the reply of the server. The message may have been delivered even
+	// when an error is returned. A rejection is returned as a
+	// *textproto.Error holding all the lines of the reply, joined by "\n".
+	PhaseContent
+)
+
+func (phase SendPhase) String() string {
+	switch phase {
+	case PhaseMail:
+		return "PhaseMail"
+	case PhaseRcpt:
+		return "PhaseRcpt"
+	case PhaseData:
+		return "PhaseData"
+	case PhaseContent:
+		return "PhaseContent"
+	default:
+		return fmt.Sprintf("SendPhase:%d", phase)
+	}
+}
+
 // StartTLSUnsupportedError is returned by Dial when connecting to an SMTP
 // server that does not support STARTTLS.
 type StartTLSUnsupportedError struct {
@@ -207,12 +646,28 @@ func (e StartTLSUnsupportedError) Error() string {
 		"SMTP server does not support STARTTLS"
 }
 
+// RequireTLSError is returned by Send when a message set with SetRequireTLS
+// cannot be sent with the REQUIRETLS extension.
+type RequireTLSError struct {
+	// Encrypted is true when the connection uses TLS but the server does not
+	// support REQUIRETLS.
+	Encrypted bool
+}
+
+func (e RequireTLSError) Error() string {
+	if !e.Encrypted {
+		return "gomail: REQUIRETLS required, but the connection is not encrypted"
+	}
+	return "gomail: REQUIRETLS required, but SMTP server does not support REQUIRETLS"
+}
+
 func addr(host string, port int) string {
 	return fmt.Sprintf("%s:%d", host, port)
 }
 
 // DialAndSend opens a connection to the SMTP server, sends the given emails and
-// closes the connection.
+// closes the connection. A message that could not be sent is reported with a
+// SendError, or with SendErrors when ContinueOnError is set.
 func (d *Dialer) DialAndSend(ctx context.Context, m ...*Message) error {
 	s, err := d.Dial(ctx)
 	if err != nil {
@@ -220,19 +675,166 @@ func (d *Dialer) DialAndSend(ctx context.Context, m ...*Message) error {
 	}
 	defer s.Close()
 
+	if d.ContinueOnError {
+		return SendAll(ctx, s, m...)
+	}
 	return Send(ctx, s, m...)
 }
 
+// HealthCheck connects to the SMTP server like Dial, with STARTTLS and the
+// authentication, and closes the connection with the QUIT command without
+// sending any message, for example to check the credentials in a readiness
+// probe. The errors of Dial, like StartTLSUnsupportedError or an
+// authentication failure wrapping the *textproto.Error replied by the server,
+// are returned as is.
+func (d *Dialer) HealthCheck(ctx context.Context) error {
+	s, err := d.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.Close(); err != nil {
+		return fmt.Errorf("gomail: QUIT failed: %w", err)
+	}
+	return nil
+}
+
+// Validate checks that the messages could be sent by DialAndSend without
+// connecting to the server: the envelope addresses and parameters are
+// checked and the messages are serialized, reading the content of their
+// files. The checks depending on the extensions supported by the server are
+// not done.
+//
+// The progress function set with SetProgressFunc is not called. The content
+// given to AttachReader, EmbedReader and SetRaw is only read when the reader
+// implements io.Seeker, so that the messages can still be sent afterwards.
+func (d *Dialer) Validate(ctx context.Context, m ...*Message) error {
+	for i, msg := range m {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := validate(msg); err != nil {
+			return fmt.Errorf("gomail: invalid message, Index:%d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validate(m *Message) error {
+	if _, err := m.getFrom(); err != nil {
+		return fmt.Errorf("gomail: getFrom failed: %w", err)
+	}
+	if _, err := m.Recipients(); err != nil {
+		return fmt.Errorf("gomail: getRecipients failed: %w", err)
+	}
+	if _, err := formatMailParams(m.mailParams); err != nil {
+		return err
+	}
+	for _, params := range m.rcptParams {
+		if _, err := formatParams(params); err != nil {
+			return err
+		}
+	}
+	mw := &messageWriter{w: ioutil.Discard, skipOneShot: true}
+	mw.writeMessage(m)
+	return mw.err
+}
+
 type smtpSender struct {
 	sc   smtpClient
 	conn net.Conn
 	d    *Dialer
+
+	// mu guards the connection against the idle timer.
+	mu        sync.Mutex
+	idleTimer *time.Timer
+	// idleGen identifies the current idle timer, so a timer firing after
+	// being stopped does nothing.
+	idleGen int
+	idle    bool
+	// sent is the number of messages sent on the connection.
+	sent int
+	// redials is the number of attempts to reopen the connection.
+	redials int
+}
+
+// redial replaces the connection of c by a new one.
+func (c *smtpSender) redial(ctx context.Context) error {
+	c.redials++
+	s, err := c.d.dialSender(ctx)
+	if err != nil {
+		return err
+	}
+	c.sc, c.conn, c.idle, c.sent = s.sc, s.conn, false, 0
+	return nil
+}
+
+// ErrConnectionIdle is returned by Send when the connection was closed after
+// Dialer.IdleTimeout and Dialer.RetryFailure is not set.
+var ErrConnectionIdle = errors.New("gomail: connection closed after being idle")
+
+// resetIdleTimer starts the timer closing the connection after
+// Dialer.IdleTimeout, c.mu must be held.
+func (c *smtpSender) resetIdleTimer() {
+	c.stopIdleTimer()
+	if c.d.IdleTimeout <= 0 || c.idle {
+		return
+	}
+	gen := c.idleGen
+	c.idleTimer = time.AfterFunc(c.d.IdleTimeout, func() {
+		c.closeIdle(gen)
+	})
+}
+
+// stopIdleTimer stops the idle timer, c.mu must be held.
+func (c *smtpSender) stopIdleTimer() {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.idleGen++
+}
+
+func (c *smtpSender) closeIdle(gen int) {
+	c.mu.Lock()
+	if gen != c.idleGen || c.idle {
+		c.mu.Unlock()
+		return
+	}
+	c.idleTimer = nil
+	c.idle = true
+	sc, conn := c.sc, c.conn
+	c.mu.Unlock()
+
+	// QUIT is sent without holding c.mu so a slow server does not block Send
+	// and Close, which see the connection as idle and may replace it.
+	quit(sc, conn, c.d.quitTimeout())
+}
+
+// quit sends the QUIT command within Dialer.QuitTimeout, the connection is
+// closed even if it fails.
+func (c *smtpSender) quit() error {
+	return quit(c.sc, c.conn, c.d.quitTimeout())
 }
 
-func (c *smtpSender) retryError(err error) bool {
+func quit(sc smtpClient, conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := sc.Quit(); err != nil {
+		sc.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *smtpSender) retryError(phase SendPhase, err error) bool {
 	if !c.d.RetryFailure {
 		return false
 	}
+	if c.d.RetryClassifier != nil {
+		return c.d.RetryClassifier(phase, err)
+	}
+	if phase == PhaseContent {
+		return false
+	}
 
 	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 		return true
@@ -241,65 +843,852 @@ func (c *smtpSender) retryError(err error) bool {
 	return err == io.EOF
 }
 
+type sendTimeoutKey struct{}
+
+// WithSendTimeout returns a copy of ctx making the senders returned by
+// Dialer.Dial use timeout instead of Dialer.Timeout for the messages sent with
+// it, for example to give more time to a message with a large attachment.
+// The following messages sent on the connection use Dialer.Timeout again.
+// Zero disables the timeout.
+func WithSendTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, sendTimeoutKey{}, timeout)
+}
+
 func (c *smtpSender) Send(ctx context.Context, from string, to []string, msg io.WriterTo) error {
-	if c.d.Timeout > 0 {
-		c.conn.SetDeadline(time.Now().Add(c.d.Timeout))
-	}
+	_, err := c.SendWithStats(ctx, from, to, msg)
+	return err
+}
 
-	if err := c.sc.Mail(from); err != nil {
-		if c.retryError(err) {
-			// This is probably due to a timeout, so reconnect and try again.
-			sc, derr := c.d.Dial(ctx)
-			if derr == nil {
-				if s, ok := sc.(*smtpSender); ok {
-					*c = *s
-					return c.Send(ctx, from, to, msg)
-				}
+// SendWithStats implements StatsSender.
+func (c *smtpSender) SendWithStats(ctx context.Context, from string, to []string, msg io.WriterTo) (SendStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopIdleTimer()
+	defer c.resetIdleTimer()
+
+	var suppressed []string
+	if l := c.d.SuppressionList; l != nil {
+		allowed := make([]string, 0, len(to))
+		for _, addr := range to {
+			if l.IsSuppressed(addr) {
+				suppressed = append(suppressed, addr)
+			} else {
+				allowed = append(allowed, addr)
 			}
 		}
+		if len(allowed) == 0 {
+			return SendStats{Suppressed: suppressed}, nil
+		}
+		to = allowed
+	}
+
+	metrics := c.d.metrics()
+	redials := c.redials
+	if c.idle {
+		if !c.d.RetryFailure {
+			metrics.IncFailed()
+			return SendStats{Suppressed: suppressed}, ErrConnectionIdle
+		}
+		if err := c.redial(ctx); err != nil {
+			metrics.IncFailed()
+			return SendStats{Retried: true, Suppressed: suppressed}, fmt.Errorf("gomail: could not reconnect after being idle: %w", err)
+		}
+	}
+	if max := c.d.MaxMessagesPerConnection; max > 0 && c.sent >= max {
+		c.quit()
+		if err := c.redial(ctx); err != nil {
+			metrics.IncFailed()
+			return SendStats{Retried: true, Suppressed: suppressed}, fmt.Errorf("gomail: could not reconnect after %d messages: %w", max, err)
+		}
+	}
 
-		return err
+	if l := c.d.limiter(); l != nil {
+		if err := l.Wait(ctx); err != nil {
+			metrics.IncFailed()
+			return SendStats{Retried: c.redials != redials, Suppressed: suppressed}, fmt.Errorf("gomail: rate limit: %w", err)
+		}
+	}
+
+	start := time.Now()
+	n, err := c.send(ctx, from, to, msg)
+	c.sent++
+	stats := SendStats{Bytes: n, Duration: time.Since(start), Retried: c.redials != redials, Suppressed: suppressed}
+	metrics.ObserveSendDuration(stats.Duration)
+	if err != nil {
+		metrics.IncFailed()
+		return stats, err
+	}
+	metrics.IncSent()
+	metrics.IncBytes(n)
+	return stats, nil
+}
+
+func (c *smtpSender) send(ctx context.Context, from string, to []string, msg io.WriterTo) (int64, error) {
+	env, err := c.envelopeParams(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	max := c.d.MaxRcptPerMessage
+	if max <= 0 || len(to) <= max {
+		return c.sendTransaction(ctx, from, to, msg, env)
+	}
+
+	// Write the message once so generated fields like Message-ID are the
+	// same in each transaction.
+	msg = c.encodedMessage(msg, env.mail)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for len(to) > 0 {
+		chunk := to
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		to = to[len(chunk):]
+		n, err := c.sendTransaction(ctx, from, chunk, rawMessage(buf.Bytes()), env)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (c *smtpSender) sendTransaction(ctx context.Context, from string, to []string, msg io.WriterTo, env envelope) (int64, error) {
+	n, phase, err := c.transaction(ctx, from, to, msg, env)
+	if err != nil && ctx.Err() != nil {
+		return n, fmt.Errorf("gomail: transaction aborted: %w", ctx.Err())
 	}
+	if err != nil && c.retryError(phase, err) {
+		// This is probably due to a timeout, so reconnect and try again.
+		c.sc.Close()
+		if derr := c.redial(ctx); derr == nil {
+			n, _, err = c.transaction(ctx, from, to, msg, env)
+		}
+	}
+	return n, err
+}
+
+// transaction runs a mail transaction and returns the phase it failed in.
+func (c *smtpSender) transaction(ctx context.Context, from string, to []string, msg io.WriterTo, env envelope) (int64, SendPhase, error) {
+	timeout := c.d.Timeout
+	t, override := ctx.Value(sendTimeoutKey{}).(time.Duration)
+	if override {
+		timeout = t
+		// Restore the deadlines of the Dialer for the next commands.
+		defer c.d.setDeadlines(c.conn)
+	}
+	if timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+	} else if override {
+		c.conn.SetDeadline(time.Time{})
+	}
+	// Closing the connection when ctx is done aborts the transaction, also
+	// when the server accepts the content but never replies.
+	conn := c.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := c.sc.Mail(from, env.mail...); err != nil {
+		return 0, PhaseMail, err
+	}
+
+	msg = c.encodedMessage(msg, env.mail)
 
 	for _, addr := range to {
-		if err := c.sc.Rcpt(addr); err != nil {
-			return fmt.Errorf("gomail: Send.to.Rcpt failed: %w", err)
+		if err := c.sc.Rcpt(addr, env.rcpt[normalizeAddress(addr)]...); err != nil {
+			return 0, PhaseRcpt, fmt.Errorf("gomail: Send.to.Rcpt failed: %w", err)
 		}
 	}
 
-	w, err := c.sc.Data()
+	// BINARYMIME content must be sent with BDAT.
+	data := c.sc.Data
+	bdat := hasParam(env.mail, bodyBinaryMIME)
+	if bdat {
+		data = c.sc.Bdat
+	}
+	w, err := data()
 	if err != nil {
-		return fmt.Errorf("gomail: Send.Data failed: %w", err)
+		return 0, PhaseData, fmt.Errorf("gomail: Send.Data failed: %w", err)
 	}
 
-	if _, err = msg.WriteTo(w); err != nil {
+	var n int64
+	if c.d.AddReceivedHeader {
+		received, err := c.receivedHeader()
+		if err != nil {
+			w.Close()
+			return 0, PhaseContent, err
+		}
+		hn, err := io.WriteString(w, received)
+		n += int64(hn)
+		if err != nil {
+			w.Close()
+			return n, PhaseContent, err
+		}
+	}
+
+	mn, err := msg.WriteTo(w)
+	n += mn
+	if err != nil {
 		w.Close()
+	} else {
+		err = w.Close()
+	}
+	// Unlike after the final dot of DATA, the transaction is still open when
+	// a chunk other than the last one is rejected, RSET discards it so the
+	// connection can be reused. RFC 3030, section 2.
+	var terr *textproto.Error
+	if bdat && errors.As(err, &terr) {
+		c.sc.Reset()
+	}
+	return n, PhaseContent, err
+}
+
+func (d *Dialer) now() time.Time {
+	if d.Clock != nil {
+		return d.Clock()
+	}
+	return now()
+}
+
+// receivedHeader returns the Received header field describing the transfer
+// of a message on the connection, as defined in RFC 5321, section 4.4.
+func (c *smtpSender) receivedHeader() (string, error) {
+	from := c.d.LocalName
+	if from == "" {
+		from = "localhost"
+	}
+	if a, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		if a.IP.To4() != nil {
+			from += " ([" + a.IP.String() + "])"
+		} else {
+			from += " ([IPv6:" + a.IP.String() + "])"
+		}
+	}
+	with := "ESMTP"
+	if _, ok := c.sc.TLSConnectionState(); ok {
+		with = "ESMTPS"
+	}
+
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(randReader, id); err != nil {
+		return "", fmt.Errorf("gomail: could not generate Received id: %w", err)
+	}
+
+	return fmt.Sprintf("Received: from %s\r\n by %s with %s id %x;\r\n %s\r\n",
+		from, c.d.serverName(), with, id, c.d.now().Format(time.RFC1123Z)), nil
+}
+
+// bodyBinaryMIME is the MAIL parameter of messages sent as binary.
+const bodyBinaryMIME = "BODY=BINARYMIME"
+
+// encodedMessage returns msg allowing the encodings supported by the server
+// for a transaction with the given MAIL parameters.
+func (c *smtpSender) encodedMessage(msg io.WriterTo, params []string) io.WriterTo {
+	m, ok := msg.(*Message)
+	switch {
+	case !ok:
+	case hasParam(params, bodyBinaryMIME):
+		return binaryMessage{m}
+	case m.hasAutoPart():
+		if ok, _ := c.sc.Extension("8BITMIME"); ok {
+			return eightBitMessage{m}
+		}
+	}
+	return msg
+}
+
+// binaryMIME reports whether the files of m are sent as binary.
+func (c *smtpSender) binaryMIME(m *Message) bool {
+	if !c.d.BinaryMIME || len(m.attachments)+len(m.embedded) == 0 {
+		return false
+	}
+	ok, _ := c.sc.Extension("CHUNKING")
+	if ok {
+		ok, _ = c.sc.Extension("BINARYMIME")
+	}
+	return ok
+}
+
+func hasParam(params []string, param string) bool {
+	for _, p := range params {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+// envelope holds the parameters of the MAIL and RCPT commands of a message.
+type envelope struct {
+	mail []string
+	// rcpt are the parameters of each recipient.
+	rcpt map[string][]string
+}
+
+// envelopeParams returns the parameters of the MAIL and RCPT commands of msg.
+func (c *smtpSender) envelopeParams(msg io.WriterTo) (envelope, error) {
+	mail, err := c.mailParams(msg)
+	if err != nil {
+		return envelope{}, err
+	}
+	env := envelope{mail: mail}
+	if m, ok := msg.(*Message); ok && len(m.rcptParams) > 0 {
+		env.rcpt = make(map[string][]string, len(m.rcptParams))
+		for addr, params := range m.rcptParams {
+			if env.rcpt[addr], err = formatParams(params); err != nil {
+				return envelope{}, err
+			}
+		}
+	}
+	return env, nil
+}
+
+// mailParams returns the parameters of the MAIL command required by msg.
+func (c *smtpSender) mailParams(msg io.WriterTo) ([]string, error) {
+	m, ok := msg.(*Message)
+	if !ok {
+		return nil, nil
+	}
+
+	var params []string
+	if m.requireTLS {
+		if _, ok := c.sc.TLSConnectionState(); !ok {
+			return nil, RequireTLSError{}
+		}
+		if ok, _ := c.sc.Extension("REQUIRETLS"); !ok {
+			return nil, RequireTLSError{Encrypted: true}
+		}
+		params = append(params, "REQUIRETLS")
+	}
+	if m.deliverBy != 0 {
+		p, err := c.deliverByParam(m.deliverBy, m.deliverByMode)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, p)
+	}
+	if m.hasMTPriority {
+		if m.mtPriority < -9 || m.mtPriority > 9 {
+			return nil, fmt.Errorf("gomail: invalid MT-PRIORITY %d, it must be between -9 and 9", m.mtPriority)
+		}
+		if ok, _ := c.sc.Extension("MT-PRIORITY"); ok {
+			params = append(params, "MT-PRIORITY="+strconv.Itoa(m.mtPriority))
+		} else if c.d.RequireMTPriority {
+			return nil, errors.New("gomail: MT-PRIORITY required, but SMTP server does not support MT-PRIORITY")
+		}
+	}
+	if m.hasAuthSubmitter {
+		if ok, _ := c.sc.Extension("AUTH"); ok {
+			submitter := "<>"
+			if m.authSubmitter != "" {
+				submitter = xtext(m.authSubmitter)
+			}
+			params = append(params, "AUTH="+submitter)
+		}
+	}
+	if c.binaryMIME(m) {
+		params = append(params, bodyBinaryMIME)
+	}
+	custom, err := formatMailParams(m.mailParams)
+	if err != nil {
+		return nil, err
+	}
+	return append(params, custom...), nil
+}
+
+// reservedMailParams are the parameters of the MAIL command sent by the
+// package itself, they cannot be set with Message.SetMailParam.
+var reservedMailParams = []string{"AUTH", "BODY", "BY", "MT-PRIORITY", "REQUIRETLS", "SMTPUTF8"}
+
+// formatMailParams works like formatParams for the parameters set with
+// Message.SetMailParam, rejecting the reserved ones.
+func formatMailParams(params []esmtpParam) ([]string, error) {
+	for _, p := range params {
+		for _, key := range reservedMailParams {
+			if strings.EqualFold(p.key, key) {
+				return nil, fmt.Errorf("gomail: the ESMTP parameter %q is set by the package and cannot be set with SetMailParam", p.key)
+			}
+		}
+	}
+	return formatParams(params)
+}
+
+// xtext encodes s as defined in RFC 3461, section 4.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= '!' && c <= '~' && c != '+' && c != '=' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "+%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// formatParams returns the params as sent in a command, after checking
+// their syntax as defined in RFC 5321, section 4.1.2.
+func formatParams(params []esmtpParam) ([]string, error) {
+	formatted := make([]string, len(params))
+	for i, p := range params {
+		invalid := strings.ContainsFunc(p.value, func(r rune) bool {
+			return r < '!' || r > '~' || r == '='
+		})
+		if invalid || !isESMTPKeyword(p.key) {
+			return nil, fmt.Errorf("gomail: invalid ESMTP parameter %q=%q", p.key, p.value)
+		}
+		formatted[i] = p.key
+		if p.value != "" {
+			formatted[i] += "=" + p.value
+		}
+	}
+	return formatted, nil
+}
+
+func isESMTPKeyword(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case r == '-' && i > 0:
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// deliverByParam returns the BY parameter of the DELIVERBY extension.
+func (c *smtpSender) deliverByParam(d time.Duration, mode ByMode) (string, error) {
+	ok, minTime := c.sc.Extension("DELIVERBY")
+	if !ok {
+		return "", errors.New("gomail: DELIVERBY required, but SMTP server does not support DELIVERBY")
+	}
+	if mode != ByReturn && mode != ByNotify {
+		return "", fmt.Errorf("gomail: invalid DELIVERBY mode %q", mode)
+	}
+
+	seconds := int64(d / time.Second)
+	if mode == ByReturn {
+		if seconds <= 0 {
+			return "", errors.New("gomail: DELIVERBY time must be positive in return mode")
+		}
+		if min, err := strconv.ParseInt(minTime, 10, 64); err == nil && seconds < min {
+			return "", fmt.Errorf("gomail: DELIVERBY time of %ds is shorter than the minimum of %ds supported by the server", seconds, min)
+		}
+	}
+	return "BY=" + strconv.FormatInt(seconds, 10) + ";" + string(mode), nil
+}
+
+// Reset implements Resettable, it aborts the current mail transaction with the
+// RSET command.
+func (c *smtpSender) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle {
+		return ErrConnectionIdle
+	}
+	if err := c.sc.Reset(); err != nil {
+		return fmt.Errorf("gomail: RSET failed: %w", err)
+	}
+	return nil
+}
+
+// VerifyRecipient implements Verifier with the MAIL and RCPT commands followed
+// by RSET, since the VRFY command is disabled by most servers. The error wraps
+// the *textproto.Error holding the reply code of the server when the
+// recipient is rejected.
+//
+// The result is not authoritative: many servers accept any recipient and
+// reject the message later, others reject it temporarily, for example when
+// greylisting.
+//
+// When ctx is done the connection is closed and the context error is
+// returned.
+func (c *smtpSender) VerifyRecipient(ctx context.Context, from, to string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopIdleTimer()
+	defer c.resetIdleTimer()
+	if c.idle {
+		return ErrConnectionIdle
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	if c.d.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.d.Timeout))
+	}
+	// Like in a transaction, closing the connection when ctx is done aborts
+	// the commands waiting for a reply.
+	conn := c.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := c.sc.Mail(from); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("gomail: VerifyRecipient aborted: %w", ctx.Err())
+		}
+		return fmt.Errorf("gomail: VerifyRecipient.Mail failed: %w", err)
+	}
+	rerr := c.sc.Rcpt(to)
+	err := c.sc.Reset()
+	if ctx.Err() != nil && (rerr != nil || err != nil) {
+		return fmt.Errorf("gomail: VerifyRecipient aborted: %w", ctx.Err())
+	}
+	if err != nil && rerr == nil {
+		return fmt.Errorf("gomail: RSET failed: %w", err)
+	}
+	if rerr != nil {
+		return fmt.Errorf("gomail: recipient %q rejected: %w", to, rerr)
+	}
+	return nil
+}
+
+// Command implements Commander.
+func (c *smtpSender) Command(cmd string) (int, string, error) {
+	if strings.ContainsAny(cmd, "\r\n") {
+		return 0, "", fmt.Errorf("gomail: invalid command %q, it must not contain CR or LF", cmd)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopIdleTimer()
+	defer c.resetIdleTimer()
+	if c.idle {
+		return 0, "", ErrConnectionIdle
+	}
+	if c.d.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.d.Timeout))
+	}
+
+	code, msg, err := c.sc.Command(cmd)
+	if err != nil {
+		return code, msg, fmt.Errorf("gomail: command %q failed: %w", cmd, err)
+	}
+	return code, msg, nil
+}
+
+// NetConn implements ConnectionInspector.
+func (c *smtpSender) NetConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
 
-	return w.Close()
+// ConnectionState implements ConnectionInspector.
+func (c *smtpSender) ConnectionState() (tls.ConnectionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sc.TLSConnectionState()
+}
+
+// UsedTLS implements ConnectionInspector.
+func (c *smtpSender) UsedTLS() bool {
+	_, ok := c.ConnectionState()
+	return ok
+}
+
+func (d *Dialer) limiter() Limiter {
+	if d.Limiter != nil {
+		return d.Limiter
+	}
+	d.rateLimiterOnce.Do(func() {
+		if d.RateLimit > 0 {
+			d.rateLimiter = &intervalLimiter{interval: time.Duration(float64(time.Second) / d.RateLimit)}
+		}
+	})
+	if d.rateLimiter == nil {
+		return nil
+	}
+	return d.rateLimiter
+}
+
+// intervalLimiter lets one message be sent per interval.
+type intervalLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *intervalLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	t := time.Now()
+	if t.Before(l.next) {
+		t = l.next
+	}
+	end := t.Add(l.interval)
+	l.next = end
+	l.mu.Unlock()
+
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The slot is released unless a later one was reserved meanwhile,
+		// which must keep its interval with the previous ones.
+		l.mu.Lock()
+		if l.next.Equal(end) {
+			l.next = t
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
 }
 
 func (c *smtpSender) Close() error {
-	return c.sc.Quit()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopIdleTimer()
+	if c.idle {
+		return nil
+	}
+	return c.quit()
 }
 
 // Stubbed out for tests.
 var (
 	tlsClient     = tls.Client
-	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
-		return smtp.NewClient(conn, host)
-	}
+	smtpNewClient = newSMTPClient
 )
 
+func newSMTPClient(conn net.Conn, host string) (smtpClient, error) {
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return nil, err
+	}
+	return netClient{c, host}, nil
+}
+
+// netClient is an *smtp.Client supporting parameters for the MAIL command.
+type netClient struct {
+	*smtp.Client
+	host string
+}
+
+// obsoleteAuthMechanisms are the mechanisms looked up in the obsolete AUTH=
+// form of the AUTH extension.
+var obsoleteAuthMechanisms = []string{"PLAIN", "LOGIN", "CRAM-MD5", "XOAUTH2", "EXTERNAL"}
+
+// Extension works like smtp.Client.Extension. Servers only advertising the
+// obsolete "AUTH=LOGIN PLAIN" form, which smtp.Client parses as a "AUTH=LOGIN"
+// extension, are also reported to support the AUTH extension with the listed
+// mechanisms.
+func (c netClient) Extension(ext string) (bool, string) {
+	ok, param := c.Client.Extension(ext)
+	if ok || !strings.EqualFold(ext, "AUTH") {
+		return ok, param
+	}
+	for _, mech := range obsoleteAuthMechanisms {
+		if ok, param := c.Client.Extension("AUTH=" + mech); ok {
+			return true, strings.TrimSpace(mech + " " + param)
+		}
+	}
+	return false, ""
+}
+
+// Auth works like smtp.Client.Auth. With the PLAIN mechanism the credentials
+// are sent as the initial response of the AUTH command, saving a round trip,
+// only if the server advertises the AUTH extension of RFC 4954 and the command
+// fits in an SMTP line. Otherwise they are sent after the server challenge.
+func (c netClient) Auth(a smtp.Auth) error {
+	pa, ok := a.(*plainAuth)
+	if !ok {
+		return c.Client.Auth(a)
+	}
+
+	// Extension sends the EHLO command if it was not sent yet.
+	ok, auths := c.Client.Extension("AUTH")
+	if !ok {
+		_, auths = c.Extension("AUTH")
+	}
+	_, encrypted := c.TLSConnectionState()
+	_, resp, err := pa.Start(&smtp.ServerInfo{Name: c.host, TLS: encrypted, Auth: strings.Fields(auths)})
+	if err != nil {
+		c.Quit()
+		return err
+	}
+
+	cmd := "AUTH PLAIN"
+	if ir := cmd + " " + base64.StdEncoding.EncodeToString(resp); ok && len(ir)+2 <= maxAuthLine {
+		cmd = ir
+	}
+	code, msg, err := c.cmd(0, "%s", cmd)
+	for err == nil && code == 334 {
+		var challenge []byte
+		if challenge, err = base64.StdEncoding.DecodeString(msg); err != nil {
+			break
+		}
+		if resp, err = pa.Next(challenge, true); err != nil {
+			break
+		}
+		code, msg, err = c.cmd(0, "%s", base64.StdEncoding.EncodeToString(resp))
+	}
+	if err == nil && code != 235 {
+		err = &textproto.Error{Code: code, Msg: msg}
+	}
+	if err != nil {
+		// Abort the exchange like smtp.Client.Auth.
+		c.cmd(501, "*")
+		c.Quit()
+	}
+	return err
+}
+
+// maxAuthLine is the maximum length of the AUTH command, including CRLF,
+// defined in RFC 4954.
+const maxAuthLine = 512
+
+// cmd sends a command and reads its response, the response code must be
+// expectCode.
+func (c netClient) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	return c.Text.ReadResponse(expectCode)
+}
+
+// Command sends the command line and reads the reply of the server, whatever
+// its code.
+func (c netClient) Command(line string) (int, string, error) {
+	// Extension sends the EHLO command if it was not sent yet.
+	c.Extension("")
+	return c.cmd(0, "%s", line)
+}
+
+// Mail works like smtp.Client.Mail and adds the given parameters to the
+// command.
+func (c netClient) Mail(from string, params ...string) error {
+	if len(params) == 0 {
+		return c.Client.Mail(from)
+	}
+
+	cmd := "MAIL FROM:<" + from + ">"
+	// Extension sends the EHLO command if it was not sent yet.
+	if ok, _ := c.Extension("8BITMIME"); ok && !hasParam(params, bodyBinaryMIME) {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	cmd += " " + strings.Join(params, " ")
+	if strings.ContainsAny(cmd, "\r\n") {
+		return errors.New("gomail: a line must not contain CR or LF")
+	}
+
+	_, _, err := c.cmd(250, "%s", cmd)
+	return err
+}
+
+// Rcpt works like smtp.Client.Rcpt and adds the given parameters to the
+// command.
+func (c netClient) Rcpt(to string, params ...string) error {
+	if len(params) == 0 {
+		return c.Client.Rcpt(to)
+	}
+
+	cmd := "RCPT TO:<" + to + "> " + strings.Join(params, " ")
+	if strings.ContainsAny(cmd, "\r\n") {
+		return errors.New("gomail: a line must not contain CR or LF")
+	}
+	_, _, err := c.cmd(25, "%s", cmd)
+	return err
+}
+
+// bdatChunkSize is the size of the chunks of a message sent with BDAT.
+const bdatChunkSize = 64 << 10
+
+// Bdat returns a writer sending the message content in chunks with BDAT
+// commands, as defined in RFC 3030. Closing it sends the last chunk.
+func (c netClient) Bdat() (io.WriteCloser, error) {
+	return &bdatWriter{c: c}, nil
+}
+
+type bdatWriter struct {
+	c   netClient
+	buf []byte
+	// err is the error of a previous chunk, no other chunk is sent then.
+	err error
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= bdatChunkSize {
+		if err := w.send(w.buf[:bdatChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[:copy(w.buf, w.buf[bdatChunkSize:])]
+	}
+	return len(p), nil
+}
+
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.send(w.buf, true)
+}
+
+func (w *bdatWriter) send(chunk []byte, last bool) error {
+	cmd := "BDAT " + strconv.Itoa(len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+
+	text := w.c.Text
+	id := text.Next()
+	text.StartRequest(id)
+	err := text.PrintfLine("%s", cmd)
+	if err == nil {
+		if _, err = text.W.Write(chunk); err == nil {
+			err = text.W.Flush()
+		}
+	}
+	text.EndRequest(id)
+	if err != nil {
+		w.err = err
+		return err
+	}
+
+	text.StartResponse(id)
+	_, _, err = text.ReadResponse(250)
+	text.EndResponse(id)
+	if err == nil {
+		return nil
+	}
+	w.err = err
+	return err
+}
+
 type smtpClient interface {
 	Hello(string) error
 	Extension(string) (bool, string)
 	StartTLS(*tls.Config) error
 	Auth(smtp.Auth) error
-	Mail(string) error
-	Rcpt(string) error
+	Mail(from string, params ...string) error
+	Rcpt(to string, params ...string) error
 	Data() (io.WriteCloser, error)
+	Bdat() (io.WriteCloser, error)
+	Reset() error
+	Command(line string) (int, string, error)
 	Quit() error
 	Close() error
+	TLSConnectionState() (tls.ConnectionState, bool)
 }
@@ -3,13 +3,26 @@ package mail
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/smtp"
+	"net/textproto"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -21,7 +34,7 @@ var (
 	testConn    = &net.TCPConn{}
 	testTLSConn = tls.Client(testConn, &tls.Config{InsecureSkipVerify: true})
 	testConfig  = &tls.Config{InsecureSkipVerify: true}
-	testAuth    = smtp.PlainAuth("", testUser, testPwd, testHost)
+	testAuth    = &plainAuth{username: testUser, password: testPwd, host: testHost}
 )
 
 func TestDialer(t *testing.T) {
@@ -204,6 +217,51 @@ func TestDialerMandatoryStartTLSUnsupported(t *testing.T) {
 	}
 }
 
+func TestDialerHealthCheck(t *testing.T) {
+	d := NewDialer(testHost, testPort, "user", "pwd")
+	testClient := &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+	}
+	stubDial(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Quit",
+		"Close",
+	})
+	if err := d.HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	authErr := &textproto.Error{Code: 535, Msg: "5.7.8 Authentication credentials invalid"}
+	testClient = &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+		authErr:  authErr,
+	}
+	stubDial(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Close",
+	})
+	var terr *textproto.Error
+	if err := d.HealthCheck(context.Background()); !errors.As(err, &terr) || terr.Code != 535 {
+		t.Errorf("the authentication failure should be returned, got %v", err)
+	}
+
+	d.StartTLSPolicy = MandatoryStartTLS
+	stubDial(t, d, &mockClient{t: t, addr: addr(d.Host, d.Port)}, []string{"Extension STARTTLS"})
+	if err := d.HealthCheck(context.Background()); !errors.As(err, new(StartTLSUnsupportedError)) {
+		t.Errorf("expected a StartTLSUnsupportedError, got %v", err)
+	}
+}
+
 func TestDialerNoAuth(t *testing.T) {
 	d := &Dialer{
 		Host: testHost,
@@ -233,6 +291,7 @@ func TestDialerTimeout(t *testing.T) {
 		"Extension STARTTLS",
 		"StartTLS",
 		"Mail " + testFrom,
+		"Close",
 		"Extension STARTTLS",
 		"StartTLS",
 		"Mail " + testFrom,
@@ -272,14 +331,311 @@ func TestDialerTimeoutNoRetry(t *testing.T) {
 	}
 }
 
+func TestDialerNoRetryAfterContent(t *testing.T) {
+	d := &Dialer{
+		Host:         testHost,
+		Port:         testPort,
+		RetryFailure: true,
+	}
+	testClient := &mockClient{
+		t:            t,
+		addr:         addr(d.Host, d.Port),
+		startTLS:     true,
+		writeTimeout: true,
+	}
+
+	err := doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+	})
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("the message should not be sent again once its content was written, got %v", err)
+	}
+}
+
+func TestDialerRetryClassifier(t *testing.T) {
+	var phases []SendPhase
+	d := &Dialer{
+		Host:         testHost,
+		Port:         testPort,
+		RetryFailure: true,
+		RetryClassifier: func(phase SendPhase, err error) bool {
+			phases = append(phases, phase)
+			return errors.Is(err, io.EOF)
+		},
+	}
+	testClient := &mockClient{
+		t:            t,
+		addr:         addr(d.Host, d.Port),
+		startTLS:     true,
+		writeTimeout: true,
+	}
+
+	if err := doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Close",
+		"Extension STARTTLS",
+		"StartTLS",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+	}); err != nil {
+		t.Error(err)
+	}
+	if len(phases) != 1 || phases[0] != PhaseContent || phases[0].String() != "PhaseContent" {
+		t.Errorf("invalid phases, got %v", phases)
+	}
+
+	d.RetryClassifier = func(SendPhase, error) bool { return false }
+	testClient = &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+		timeout:  true,
+	}
+	if err := doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Mail " + testFrom,
+		"Quit",
+	}); !errors.Is(err, io.EOF) {
+		t.Errorf("the classifier should prevent the retry, got %v", err)
+	}
+}
+
+func TestDialerBcc(t *testing.T) {
+	m := getTestMessage()
+	m.SetHeader("Bcc", "bcc1@example.com", "bcc2@example.com")
+	m.SetHeader("BCC", "bcc3@example.com")
+
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(raw)), "bcc") {
+		t.Errorf("the Bcc header field should not be written:\n%s", raw)
+	}
+
+	d := NewDialer(testHost, testPort, "user", "pwd")
+	testClient := &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+		data:     testMsg,
+	}
+	if err := doTestSendMessage(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Rcpt bcc3@example.com",
+		"Rcpt bcc1@example.com",
+		"Rcpt bcc2@example.com",
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	}, m); err != nil {
+		t.Error(err)
+	}
+}
+
+func getRateLimitedSender(t *testing.T, d *Dialer, n int) *smtpSender {
+	var want []string
+	for i := 0; i < n; i++ {
+		want = append(want,
+			"Mail "+testFrom,
+			"Rcpt "+testTo1,
+			"Rcpt "+testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+		)
+	}
+	return &smtpSender{sc: &mockClient{t: t, want: want}, conn: testConn, d: d}
+}
+
+func TestDialerRateLimit(t *testing.T) {
+	d := &Dialer{Host: testHost, RateLimit: 20}
+	s := getRateLimitedSender(t, d, 5)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := Send(context.Background(), s, getTestMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("5 messages at 20/s should take at least 200ms, took %v", elapsed)
+	}
+
+	d = &Dialer{Host: testHost, RateLimit: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s = getRateLimitedSender(t, d, 1)
+	if err := Send(ctx, s, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if err := Send(ctx, s, getTestMessage()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waiting should stop when the context is done, took %v", elapsed)
+	}
+}
+
+func TestDialerRateLimitCancel(t *testing.T) {
+	l := (&Dialer{RateLimit: 10}).limiter()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+
+	// The cancelled wait released its slot, the next message waits for the
+	// end of the first interval only.
+	start := time.Now()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("a cancelled wait should not consume an interval, waited %v", elapsed)
+	}
+}
+
+func TestDialerClone(t *testing.T) {
+	impls := []interface{}{
+		smtp.CRAMMD5Auth("user", "pwd"), tls.NewLRUClientSessionCache(1), &stubResolver{t: t},
+		new(countingLimiter), NopMetrics{}, suppressionMap{}, &net.TCPAddr{},
+	}
+	d := &Dialer{}
+	v := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f, typ := v.Field(i), v.Type().Field(i)
+		if !typ.IsExported() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			f.SetInt(1)
+		case reflect.Float64:
+			f.SetFloat(1)
+		case reflect.String:
+			f.SetString("x")
+		case reflect.Slice:
+			f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+		case reflect.Ptr:
+			f.Set(reflect.New(f.Type().Elem()))
+		case reflect.Func:
+			f.Set(reflect.MakeFunc(f.Type(), func(args []reflect.Value) []reflect.Value {
+				out := make([]reflect.Value, f.Type().NumOut())
+				for i := range out {
+					out[i] = reflect.Zero(f.Type().Out(i))
+				}
+				return out
+			}))
+		case reflect.Interface:
+			for _, impl := range impls {
+				if reflect.TypeOf(impl).Implements(f.Type()) {
+					f.Set(reflect.ValueOf(impl))
+					break
+				}
+			}
+		}
+		if f.IsZero() {
+			t.Fatalf("the test does not set the field %s", typ.Name)
+		}
+	}
+
+	c := reflect.ValueOf(d.clone()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f, typ := v.Field(i), v.Type().Field(i)
+		if !typ.IsExported() {
+			continue
+		}
+		got := c.Field(i)
+		if f.Kind() == reflect.Func || f.Kind() == reflect.Slice {
+			if got.Pointer() != f.Pointer() {
+				t.Errorf("the field %s is not copied", typ.Name)
+			}
+		} else if !reflect.DeepEqual(got.Interface(), f.Interface()) {
+			t.Errorf("the field %s is not copied", typ.Name)
+		}
+	}
+}
+
+type countingLimiter int
+
+func (l *countingLimiter) Wait(ctx context.Context) error {
+	*l++
+	return nil
+}
+
+func TestDialerLimiter(t *testing.T) {
+	l := new(countingLimiter)
+	d := &Dialer{Host: testHost, RateLimit: 1, Limiter: l}
+	s := getRateLimitedSender(t, d, 3)
+	if err := Send(context.Background(), s, getTestMessage(), getTestMessage(), getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if *l != 3 {
+		t.Errorf("the limiter should be called for each message, got %d calls", *l)
+	}
+}
+
 type mockClient struct {
-	t        *testing.T
+	t *testing.T
+	// mu guards i, the idle timer sends QUIT from its own goroutine.
+	mu       sync.Mutex
 	i        int
 	want     []string
 	addr     string
 	config   *tls.Config
 	startTLS bool
 	timeout  bool
+	data     string
+	// writeTimeout fails the first write of the message content.
+	writeTimeout bool
+	// tls is returned by TLSConnectionState.
+	tls bool
+	// ext holds the parameters of the extensions returned by Extension and
+	// noExt the extensions it reports as unsupported.
+	ext   map[string]string
+	noExt map[string]bool
+	// auths is the list of mechanisms of the AUTH extension and auth the
+	// expected authentication, testAuth when nil.
+	auths string
+	auth  smtp.Auth
+	// authErr is returned by Auth.
+	authErr error
 }
 
 func (c *mockClient) Hello(localName string) error {
@@ -289,29 +645,43 @@ func (c *mockClient) Hello(localName string) error {
 
 func (c *mockClient) Extension(ext string) (bool, string) {
 	c.do("Extension " + ext)
+	if v, ok := c.ext[ext]; ok {
+		return true, v
+	}
+	if c.noExt[ext] {
+		return false, ""
+	}
 	ok := true
 	if ext == "STARTTLS" {
 		ok = c.startTLS
 	}
+	if ext == "AUTH" {
+		return ok, c.auths
+	}
 	return ok, ""
 }
 
 func (c *mockClient) StartTLS(config *tls.Config) error {
 	assertConfig(c.t, config, c.config)
 	c.do("StartTLS")
+	c.tls = true
 	return nil
 }
 
 func (c *mockClient) Auth(a smtp.Auth) error {
-	if !reflect.DeepEqual(a, testAuth) {
-		c.t.Errorf("Invalid auth, got %#v, want %#v", a, testAuth)
+	want := c.auth
+	if want == nil {
+		want = testAuth
+	}
+	if !reflect.DeepEqual(a, want) {
+		c.t.Errorf("Invalid auth, got %#v, want %#v", a, want)
 	}
 	c.do("Auth")
-	return nil
+	return c.authErr
 }
 
-func (c *mockClient) Mail(from string) error {
-	c.do("Mail " + from)
+func (c *mockClient) Mail(from string, params ...string) error {
+	c.do(strings.Join(append([]string{"Mail " + from}, params...), " "))
 	if c.timeout {
 		c.timeout = false
 		return io.EOF
@@ -319,16 +689,37 @@ func (c *mockClient) Mail(from string) error {
 	return nil
 }
 
-func (c *mockClient) Rcpt(to string) error {
-	c.do("Rcpt " + to)
+func (c *mockClient) Rcpt(to string, params ...string) error {
+	c.do(strings.Join(append([]string{"Rcpt " + to}, params...), " "))
 	return nil
 }
 
+func (c *mockClient) Bdat() (io.WriteCloser, error) {
+	c.do("Bdat")
+	if c.data != "" {
+		return &mockWriter{c: c, want: c.data}, nil
+	}
+	return &mockWriter{c: c, want: testMsg}, nil
+}
+
 func (c *mockClient) Data() (io.WriteCloser, error) {
 	c.do("Data")
+	if c.data != "" {
+		return &mockWriter{c: c, want: c.data}, nil
+	}
 	return &mockWriter{c: c, want: testMsg}, nil
 }
 
+func (c *mockClient) Reset() error {
+	c.do("Reset")
+	return nil
+}
+
+func (c *mockClient) Command(line string) (int, string, error) {
+	c.do("Command " + line)
+	return 250, "OK", nil
+}
+
 func (c *mockClient) Quit() error {
 	c.do("Quit")
 	return nil
@@ -339,7 +730,13 @@ func (c *mockClient) Close() error {
 	return nil
 }
 
+func (c *mockClient) TLSConnectionState() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{HandshakeComplete: c.tls}, c.tls
+}
+
 func (c *mockClient) do(cmd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.i >= len(c.want) {
 		c.t.Fatalf("Invalid command %q", cmd)
 	}
@@ -350,22 +747,37 @@ func (c *mockClient) do(cmd string) {
 	c.i++
 }
 
+// done returns the number of commands received.
+func (c *mockClient) done() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.i
+}
+
 type mockWriter struct {
-	want string
-	c    *mockClient
-	buf  bytes.Buffer
+	want   string
+	c      *mockClient
+	buf    bytes.Buffer
+	failed bool
 }
 
 func (w *mockWriter) Write(p []byte) (int, error) {
-	if w.buf.Len() == 0 {
+	if w.buf.Len() == 0 && !w.failed {
 		w.c.do("Write message")
+		if w.c.writeTimeout {
+			w.c.writeTimeout = false
+			w.failed = true
+			return 0, io.EOF
+		}
 	}
 	w.buf.Write(p)
 	return len(p), nil
 }
 
 func (w *mockWriter) Close() error {
-	compareBodies(w.c.t, w.buf.String(), w.want)
+	if !w.failed {
+		compareBodies(w.c.t, w.buf.String(), w.want)
+	}
 	w.c.do("Close writer")
 	return nil
 }
@@ -413,45 +825,1891 @@ func testSendMailTimeout(t *testing.T, d *Dialer, want []string) {
 }
 
 func doTestSendMail(t *testing.T, d *Dialer, testClient *mockClient, want []string) error {
-	testClient.want = want
+	return doTestSendMessage(t, d, testClient, want, getTestMessage())
+}
 
-	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
-		if network != "tcp" {
-			t.Errorf("Invalid network, got %q, want tcp", network)
+func TestSenderSendWithStats(t *testing.T) {
+	d := &Dialer{Host: testHost, Port: testPort, RetryFailure: true}
+	for _, retry := range []bool{false, true} {
+		want := []string{"Extension STARTTLS", "StartTLS", "Mail " + testFrom}
+		if retry {
+			want = append(want, "Close", "Extension STARTTLS", "StartTLS", "Mail "+testFrom)
 		}
-		if address != testClient.addr {
-			t.Errorf("Invalid address, got %q, want %q",
-				address, testClient.addr)
+		testClient := &mockClient{
+			t:        t,
+			addr:     addr(d.Host, d.Port),
+			startTLS: true,
+			timeout:  retry,
 		}
-		return testConn, nil
-	}
+		stubDial(t, d, testClient, append(want,
+			"Rcpt "+testTo1,
+			"Rcpt "+testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+			"Close",
+		))
 
-	tlsClient = func(conn net.Conn, config *tls.Config) *tls.Conn {
-		if conn != testConn {
-			t.Errorf("Invalid conn, got %#v, want %#v", conn, testConn)
+		s, err := d.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := getTestMessage()
+		size, err := m.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := s.(StatsSender).SendWithStats(context.Background(), testFrom, []string{testTo1, testTo2}, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Bytes != size || stats.Retried != retry {
+			t.Errorf("invalid stats %+v, want %d bytes and Retried %v", stats, size, retry)
+		}
+		if err := s.Close(); err != nil {
+			t.Error(err)
 		}
-		assertConfig(t, config, testClient.config)
-		return testTLSConn
 	}
+}
 
-	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
-		if host != testHost {
-			t.Errorf("Invalid host, got %q, want %q", host, testHost)
-		}
-		return testClient, nil
+type suppressionMap map[string]bool
+
+func (m suppressionMap) IsSuppressed(addr string) bool { return m[addr] }
+
+func TestDialerSuppressionList(t *testing.T) {
+	d := &Dialer{Host: testHost, Port: testPort, SuppressionList: suppressionMap{testTo2: true}}
+	testClient := &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+	}
+	stubDial(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	})
+
+	s, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := s.(StatsSender).SendWithStats(context.Background(), testFrom, []string{testTo1, testTo2}, getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Suppressed) != 1 || stats.Suppressed[0] != testTo2 {
+		t.Errorf("invalid suppressed recipients, got %q", stats.Suppressed)
+	}
+
+	// The transaction is skipped when all the recipients are suppressed.
+	stats, err = s.(StatsSender).SendWithStats(context.Background(), testFrom, []string{testTo2}, getTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Suppressed) != 1 || stats.Bytes != 0 {
+		t.Errorf("invalid stats when all the recipients are suppressed, got %+v", stats)
 	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
 
-	return d.DialAndSend(context.Background(), getTestMessage())
+type fakeMetrics struct {
+	dials, dialErrors, sent, failed, durations int
+	bytes                                      int64
 }
 
-func assertConfig(t *testing.T, got, want *tls.Config) {
-	if want == nil {
-		want = &tls.Config{ServerName: testHost}
+func (m *fakeMetrics) ObserveDial(_ time.Duration, err error) {
+	m.dials++
+	if err != nil {
+		m.dialErrors++
 	}
-	if got.ServerName != want.ServerName {
-		t.Errorf("Invalid field ServerName in config, got %q, want %q", got.ServerName, want.ServerName)
+}
+func (m *fakeMetrics) IncSent()                          { m.sent++ }
+func (m *fakeMetrics) IncFailed()                        { m.failed++ }
+func (m *fakeMetrics) ObserveSendDuration(time.Duration) { m.durations++ }
+func (m *fakeMetrics) IncBytes(n int64)                  { m.bytes += n }
+
+func TestDialerAuthMechanisms(t *testing.T) {
+	login := &loginAuth{username: testUser, password: testPwd, host: testHost}
+	tests := []struct {
+		auths string
+		want  smtp.Auth
+	}{
+		{"LOGIN PLAIN XOAUTH2", testAuth},
+		{"LOGIN PLAINX", login},
+		{"login", login},
+		{"XLOGIN", testAuth},
+		{"XCRAM-MD5 LOGIN", login},
+		{"PLAIN  CRAM-MD5", smtp.CRAMMD5Auth(testUser, testPwd)},
 	}
-	if got.InsecureSkipVerify != want.InsecureSkipVerify {
-		t.Errorf("Invalid field InsecureSkipVerify in config, got %v, want %v", got.InsecureSkipVerify, want.InsecureSkipVerify)
+	for _, test := range tests {
+		d := NewDialer(testHost, testPort, testUser, testPwd)
+		testClient := &mockClient{
+			t:        t,
+			addr:     addr(d.Host, d.Port),
+			startTLS: true,
+			auths:    test.auths,
+			auth:     test.want,
+		}
+		if err := doTestSendMail(t, d, testClient, []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension AUTH",
+			"Auth",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+			"Close",
+		}); err != nil {
+			t.Errorf("%q: %v", test.auths, err)
+		}
+	}
+}
+
+func TestDialerPreferredAuthMechanisms(t *testing.T) {
+	tests := []struct {
+		preferred []string
+		want      smtp.Auth
+	}{
+		{nil, smtp.CRAMMD5Auth(testUser, testPwd)},
+		{[]string{"plain"}, testAuth},
+		{[]string{"XOAUTH2", "LOGIN", "PLAIN"}, &loginAuth{username: testUser, password: testPwd, host: testHost}},
+		{[]string{"XOAUTH2"}, smtp.CRAMMD5Auth(testUser, testPwd)},
+	}
+	for _, test := range tests {
+		d := NewDialer(testHost, testPort, testUser, testPwd)
+		d.PreferredAuthMechanisms = test.preferred
+		testClient := &mockClient{
+			t:        t,
+			addr:     addr(d.Host, d.Port),
+			startTLS: true,
+			auths:    "CRAM-MD5 PLAIN LOGIN",
+			auth:     test.want,
+		}
+		if err := doTestSendMail(t, d, testClient, []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension AUTH",
+			"Auth",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+			"Close",
+		}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	d := NewDialer(testHost, testPort, testUser, testPwd)
+	d.PreferredAuthMechanisms = []string{"LOGIN"}
+	d.Auth = testAuth
+	testSendMail(t, d, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Auth",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	})
+}
+
+func TestDialerExternalAuth(t *testing.T) {
+	d := &Dialer{
+		Host:      testHost,
+		Port:      testPort,
+		TLSConfig: &tls.Config{ServerName: testHost, Certificates: []tls.Certificate{{}}},
+	}
+	testClient := &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		config:   d.TLSConfig,
+		startTLS: true,
+		auths:    "PLAIN EXTERNAL",
+		auth:     ExternalAuth(""),
+	}
+	if err := doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+// stallingServer returns the client end of a connection to a server running
+// the given SMTP conversation, then reading its input without answering.
+func stallingServer(t *testing.T, conversation func(*textproto.Conn)) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		conversation(textproto.NewConn(server))
+		io.Copy(ioutil.Discard, server)
+	}()
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func testTLSHandshakeTimeout(t *testing.T, d *Dialer) {
+	defer func(f func(net.Conn, *tls.Config) *tls.Conn) { tlsClient = f }(tlsClient)
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	tlsClient = tls.Client
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return newSMTPClient(conn, host)
+	}
+
+	d.Timeout = 10 * time.Second
+	d.TLSHandshakeTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := d.Dial(context.Background())
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the handshake should time out after TLSHandshakeTimeout, took %v", elapsed)
+	}
+}
+
+func TestDialerTLSHandshakeTimeout(t *testing.T) {
+	d := &Dialer{Host: testHost, Port: testSSLPort, SSL: true}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return stallingServer(t, func(*textproto.Conn) {}), nil
+	}
+	testTLSHandshakeTimeout(t, d)
+
+	d = &Dialer{Host: testHost, Port: testPort}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return stallingServer(t, func(c *textproto.Conn) {
+			c.PrintfLine("220 %s ESMTP", testHost)
+			c.ReadLine()
+			c.PrintfLine("250-%s\r\n250 STARTTLS", testHost)
+			c.ReadLine()
+			c.PrintfLine("220 Ready to start TLS")
+		}), nil
+	}
+	testTLSHandshakeTimeout(t, d)
+}
+
+func TestSenderReset(t *testing.T) {
+	s := getRateLimitedSender(t, NewDialer(testHost, testPort, "user", "pwd"), 1)
+	s.sc.(*mockClient).want = []string{
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Reset",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+	}
+
+	var sc SendCloser = s
+	r, ok := sc.(Resettable)
+	if !ok {
+		t.Fatal("the SMTP sender should implement Resettable")
+	}
+	if err := s.sc.Mail(testFrom); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sc.Rcpt(testTo1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Send(context.Background(), sc, getTestMessage()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSenderVerifyRecipient(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return newSMTPClient(conn, host)
+	}
+
+	commands := make(chan string, 10)
+	d := &Dialer{Host: testHost, Port: testPort, StartTLSPolicy: NoStartTLS}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return stallingServer(t, func(c *textproto.Conn) {
+			c.PrintfLine("220 %s ESMTP", testHost)
+			for _, reply := range []string{
+				"250 " + testHost,
+				"250 OK",
+				"250 Accepted",
+				"250 Reset",
+				"250 OK",
+				"550 5.1.1 No such user",
+				"250 Reset",
+			} {
+				line, err := c.ReadLine()
+				if err != nil {
+					return
+				}
+				commands <- line
+				c.PrintfLine("%s", reply)
+			}
+		}), nil
+	}
+
+	sc, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok := sc.(Verifier)
+	if !ok {
+		t.Fatal("the SMTP sender should implement Verifier")
+	}
+	if err := v.VerifyRecipient(context.Background(), testFrom, testTo1); err != nil {
+		t.Errorf("the recipient should be accepted: %v", err)
+	}
+	err = v.VerifyRecipient(context.Background(), testFrom, "unknown@example.com")
+	var terr *textproto.Error
+	if !errors.As(err, &terr) || terr.Code != 550 {
+		t.Errorf("expected a 550 error, got %v", err)
+	}
+
+	close(commands)
+	var got []string
+	for cmd := range commands {
+		got = append(got, cmd)
+	}
+	want := []string{
+		"EHLO localhost",
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<" + testTo1 + ">",
+		"RSET",
+		"MAIL FROM:<" + testFrom + ">",
+		"RCPT TO:<unknown@example.com>",
+		"RSET",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid commands, got %q, want %q", got, want)
+	}
+}
+
+func TestSenderVerifyRecipientCancel(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	d := &Dialer{Host: testHost, Port: testPort, StartTLSPolicy: NoStartTLS, Timeout: time.Minute}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return stallingServer(t, func(c *textproto.Conn) {
+			c.PrintfLine("220 %s ESMTP", testHost)
+			// Reply to EHLO and MAIL but never to RCPT.
+			for i := 0; i < 2; i++ {
+				if _, err := c.ReadLine(); err != nil {
+					return
+				}
+				c.PrintfLine("250 OK")
+			}
+		}), nil
+	}
+
+	sc, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = sc.(Verifier).VerifyRecipient(ctx, testFrom, testTo1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the verification should be aborted, took %v", elapsed)
+	}
+
+	if err := sc.(Verifier).VerifyRecipient(ctx, testFrom, testTo1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error before any command, got %v", err)
+	}
+}
+
+func TestSenderQuitTimeout(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return newSMTPClient(conn, host)
+	}
+
+	var conn net.Conn
+	d := &Dialer{Host: testHost, Port: testPort, StartTLSPolicy: NoStartTLS, QuitTimeout: 50 * time.Millisecond}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn = stallingServer(t, func(c *textproto.Conn) {
+			c.PrintfLine("220 %s ESMTP", testHost)
+			c.ReadLine()
+			c.PrintfLine("250 %s", testHost)
+		})
+		return conn, nil
+	}
+
+	sc, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var nerr net.Error
+	if err := sc.Close(); !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close should return after QuitTimeout, took %v", elapsed)
+	}
+	if _, err := conn.Write([]byte("NOOP\r\n")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("the connection should be closed, got %v", err)
+	}
+
+	if d.QuitTimeout = 0; d.quitTimeout() != 2*time.Second {
+		t.Errorf("invalid default QuitTimeout %v", d.quitTimeout())
+	}
+}
+
+func TestSenderConnectionState(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return newSMTPClient(conn, host)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCertificate(t, testHost, key, nil, nil)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+
+	var conn net.Conn
+	d := &Dialer{
+		Host:           testHost,
+		Port:           testPort,
+		StartTLSPolicy: MandatoryStartTLS,
+		TLSConfig:      &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12},
+	}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		var server net.Conn
+		conn, server = net.Pipe()
+		go func() {
+			defer server.Close()
+			c := textproto.NewConn(server)
+			c.PrintfLine("220 %s ESMTP", testHost)
+			c.ReadLine()
+			c.PrintfLine("250-%s\r\n250 STARTTLS", testHost)
+			c.ReadLine()
+			c.PrintfLine("220 Ready to start TLS")
+
+			tc := tls.Server(server, serverConfig)
+			if err := tc.Handshake(); err != nil {
+				t.Error(err)
+				return
+			}
+			c = textproto.NewConn(tc)
+			c.ReadLine()
+			c.PrintfLine("250 %s", testHost)
+			c.ReadLine()
+			c.PrintfLine("221 Bye")
+		}()
+		return conn, nil
+	}
+
+	sc, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	ci, ok := sc.(ConnectionInspector)
+	if !ok {
+		t.Fatal("the SMTP sender should implement ConnectionInspector")
+	}
+	if ci.NetConn() != conn {
+		t.Error("NetConn should return the connection to the server")
+	}
+	state, ok := ci.ConnectionState()
+	if !ok || state.Version != tls.VersionTLS12 || !state.HandshakeComplete {
+		t.Errorf("invalid connection state %+v", state)
+	}
+	if len(state.PeerCertificates) != 1 || !state.PeerCertificates[0].Equal(cert) {
+		t.Error("the certificate of the server should be available")
+	}
+}
+
+// countingSessionCache counts the sessions got from and put in the cache.
+type countingSessionCache struct {
+	tls.ClientSessionCache
+	mu         sync.Mutex
+	gets, puts int
+}
+
+func (c *countingSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	c.gets++
+	c.mu.Unlock()
+	return c.ClientSessionCache.Get(key)
+}
+
+func (c *countingSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	c.puts++
+	c.mu.Unlock()
+	c.ClientSessionCache.Put(key, cs)
+}
+
+func TestDialerTLSSessionCache(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+	defer func(f func(net.Conn, *tls.Config) *tls.Conn) { tlsClient = f }(tlsClient)
+	tlsClient = tls.Client
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCertificate(t, testHost, key, nil, nil)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+
+	cache := &countingSessionCache{ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	d := &Dialer{
+		Host:            testHost,
+		Port:            testPort,
+		SSL:             true,
+		TLSConfig:       &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12},
+		TLSSessionCache: cache,
+	}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			tc := tls.Server(server, serverConfig)
+			if err := tc.Handshake(); err != nil {
+				t.Error(err)
+				return
+			}
+			c := textproto.NewConn(tc)
+			c.PrintfLine("220 %s ESMTP", testHost)
+			c.ReadLine()
+			c.PrintfLine("250 %s", testHost)
+			c.ReadLine()
+			c.PrintfLine("221 Bye")
+		}()
+		return conn, nil
+	}
+
+	for i, resumed := range []bool{false, true} {
+		sc, err := d.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, _ := sc.(ConnectionInspector).ConnectionState()
+		if state.DidResume != resumed {
+			t.Errorf("dial %d: DidResume should be %v", i, resumed)
+		}
+		sc.Close()
+	}
+	if cache.gets != 2 || cache.puts == 0 {
+		t.Errorf("the session cache should be used, got %d gets and %d puts", cache.gets, cache.puts)
+	}
+	if d.TLSConfig.ClientSessionCache != nil {
+		t.Error("TLSConfig should not be modified")
+	}
+
+	d = &Dialer{Host: testHost}
+	if c := d.tlsConfig().ClientSessionCache; c == nil || c != d.tlsConfig().ClientSessionCache {
+		t.Error("a default session cache should be shared by the connections")
+	}
+}
+
+func TestSenderUsedTLS(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+
+	for _, startTLS := range []bool{false, true} {
+		var plaintext error
+		d := &Dialer{
+			Host: testHost,
+			Port: testPort,
+			OnPlaintext: func(err error) error {
+				plaintext = err
+				return nil
+			},
+		}
+		d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return testConn, nil
+		}
+		tlsClient = func(conn net.Conn, config *tls.Config) *tls.Conn {
+			return testTLSConn
+		}
+		want := []string{"Extension STARTTLS", "StartTLS"}
+		if !startTLS {
+			want = want[:1]
+		}
+		testClient := &mockClient{
+			t:        t,
+			addr:     addr(d.Host, d.Port),
+			startTLS: startTLS,
+			want:     append(want, "Quit", "Close"),
+		}
+		smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+			return testClient, nil
+		}
+
+		sc, err := d.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sc.(ConnectionInspector).UsedTLS(); got != startTLS {
+			t.Errorf("invalid UsedTLS with STARTTLS support %v, got %v", startTLS, got)
+		}
+		if _, ok := plaintext.(StartTLSUnsupportedError); ok == startTLS {
+			t.Errorf("invalid error passed to OnPlaintext with STARTTLS support %v, got %v", startTLS, plaintext)
+		}
+		sc.Close()
+	}
+}
+
+func TestDialerOnPlaintextError(t *testing.T) {
+	d := NewDialer(testHost, testPort, "user", "pwd")
+	errPlaintext := errors.New("plaintext connection")
+	d.OnPlaintext = func(err error) error {
+		return errPlaintext
+	}
+	testClient := &mockClient{
+		t:    t,
+		addr: addr(d.Host, d.Port),
+	}
+
+	err := doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"Close",
+	})
+	if err != errPlaintext {
+		t.Errorf("Dial should return the error of OnPlaintext, got %v", err)
+	}
+}
+
+// dialMockClients dials with d, each connection uses the next of the given
+// clients.
+func dialMockClients(t *testing.T, d *Dialer, clients ...*mockClient) SendCloser {
+	old := smtpNewClient
+	t.Cleanup(func() { smtpNewClient = old })
+
+	d.Host, d.Port, d.StartTLSPolicy = testHost, testPort, NoStartTLS
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return testConn, nil
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		c := clients[0]
+		clients = clients[1:]
+		return c, nil
+	}
+
+	s, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// dialIdle dials with dialMockClients and waits until the connection is closed
+// for being idle.
+func dialIdle(t *testing.T, d *Dialer, clients ...*mockClient) SendCloser {
+	d.IdleTimeout = 10 * time.Millisecond
+	s := dialMockClients(t, d, clients...)
+	time.Sleep(100 * time.Millisecond)
+	return s
+}
+
+func TestDialerMaxMessagesPerConnection(t *testing.T) {
+	// session returns the commands of a connection sending n messages.
+	session := func(n int) []string {
+		var want []string
+		for i := 0; i < n; i++ {
+			want = append(want,
+				"Mail "+testFrom,
+				"Rcpt "+testTo1,
+				"Rcpt "+testTo2,
+				"Data",
+				"Write message",
+				"Close writer",
+			)
+		}
+		return append(want, "Quit")
+	}
+	clients := []*mockClient{
+		{t: t, want: session(2)},
+		{t: t, want: session(2)},
+		{t: t, want: session(1)},
+	}
+
+	s := dialMockClients(t, &Dialer{MaxMessagesPerConnection: 2}, clients...)
+	msgs := []*Message{getTestMessage(), getTestMessage(), getTestMessage(), getTestMessage(), getTestMessage()}
+	if err := Send(context.Background(), s, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range clients {
+		if c.i != len(c.want) {
+			t.Errorf("connection %d: %d commands sent, want %d", i, c.i, len(c.want))
+		}
+	}
+}
+
+func TestDialerRequireTLS(t *testing.T) {
+	m := getTestMessage()
+	m.SetRequireTLS(true)
+	c := &mockClient{t: t, tls: true, want: []string{
+		"Extension REQUIRETLS",
+		"Mail " + testFrom + " REQUIRETLS",
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+	}}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+		t.Fatal(err)
+	}
+
+	c = &mockClient{t: t}
+	err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m)
+	var rerr RequireTLSError
+	if !errors.As(err, &rerr) || rerr.Encrypted {
+		t.Errorf("expected a RequireTLSError on a plaintext connection, got %v", err)
+	}
+	if c.i != 0 {
+		t.Error("no command should be sent")
+	}
+
+	// The parameters are sent after the ones added by net/smtp.
+	conn := stallingServer(t, func(c *textproto.Conn) {
+		c.PrintfLine("220 %s ESMTP", testHost)
+		c.ReadLine()
+		c.PrintfLine("250-%s\r\n250 8BITMIME", testHost)
+		if line, _ := c.ReadLine(); line != "MAIL FROM:<"+testFrom+"> BODY=8BITMIME REQUIRETLS" {
+			t.Errorf("invalid MAIL command %q", line)
+		}
+		c.PrintfLine("250 OK")
+	})
+	sc, err := newSMTPClient(conn, testHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Mail(testFrom, "REQUIRETLS"); err != nil {
+		t.Error(err)
+	}
+	if err := sc.Mail(testFrom, "BAD\r\nRSET"); err == nil {
+		t.Error("expected an error with a line break in a parameter")
+	}
+}
+
+func TestDialerDeliverBy(t *testing.T) {
+	want := func(param string) []string {
+		return []string{
+			"Extension DELIVERBY",
+			"Mail " + testFrom + " " + param,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+		}
+	}
+	ext := map[string]string{"DELIVERBY": "120"}
+
+	m := getTestMessage()
+	m.SetDeliverBy(time.Hour, ByReturn)
+	c := &mockClient{t: t, ext: ext, want: want("BY=3600;R")}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+		t.Error(err)
+	}
+
+	m.SetDeliverBy(-30*time.Second, ByNotify)
+	c = &mockClient{t: t, ext: ext, want: want("BY=-30;N")}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+		t.Error(err)
+	}
+
+	m.SetDeliverBy(time.Minute, ByReturn)
+	c = &mockClient{t: t, ext: ext, want: []string{"Extension DELIVERBY"}}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err == nil {
+		t.Error("expected an error with a time shorter than the minimum of the server")
+	}
+}
+
+func TestDialerMTPriority(t *testing.T) {
+	want := func(params ...string) []string {
+		return []string{
+			"Extension MT-PRIORITY",
+			strings.Join(append([]string{"Mail " + testFrom}, params...), " "),
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+		}
+	}
+
+	m := getTestMessage()
+	for _, p := range []int{-9, 0, 9} {
+		m.SetMTPriority(p)
+		c := &mockClient{t: t, ext: map[string]string{"MT-PRIORITY": "MIXER"}, want: want("MT-PRIORITY=" + strconv.Itoa(p))}
+		if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+			t.Error(err)
+		}
+	}
+
+	noExt := map[string]bool{"MT-PRIORITY": true}
+	c := &mockClient{t: t, noExt: noExt, want: want()}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+		t.Error(err)
+	}
+	c = &mockClient{t: t, noExt: noExt, want: []string{"Extension MT-PRIORITY"}}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{RequireMTPriority: true}, c), m); err == nil {
+		t.Error("expected an error when MT-PRIORITY is required but not supported")
+	}
+
+	for _, p := range []int{-10, 10} {
+		m.SetMTPriority(p)
+		c = &mockClient{t: t, want: []string{}}
+		if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err == nil {
+			t.Errorf("expected an error with priority %d", p)
+		}
+	}
+}
+
+func TestDialerMaxRcptPerMessage(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", testFrom)
+	var to []string
+	for i := 0; i < 250; i++ {
+		to = append(to, "to"+strconv.Itoa(i)+"@example.com")
+	}
+	m.SetHeader("Bcc", to...)
+	m.SetBody("text/plain", testBody)
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for i := 0; i < len(to); i += 100 {
+		want = append(want, "Mail "+testFrom)
+		for _, addr := range to[i:min(i+100, len(to))] {
+			want = append(want, "Rcpt "+addr)
+		}
+		want = append(want, "Data", "Write message", "Close writer")
+	}
+	c := &mockClient{t: t, want: append(want, "Quit"), data: string(raw)}
+
+	s := dialMockClients(t, &Dialer{MaxRcptPerMessage: 100}, c)
+	if err := Send(context.Background(), s, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.i != len(c.want) {
+		t.Errorf("%d commands sent, want %d", c.i, len(c.want))
+	}
+}
+
+func TestDialerIdleTimeout(t *testing.T) {
+	sentMessage := []string{
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+	}
+
+	idle := &mockClient{t: t, want: []string{"Quit"}}
+	s := dialIdle(t, &Dialer{}, idle)
+	if err := Send(context.Background(), s, getTestMessage()); !errors.Is(err, ErrConnectionIdle) {
+		t.Errorf("expected ErrConnectionIdle, got %v", err)
+	}
+	if idle.done() != 1 {
+		t.Error("the idle connection should be closed with QUIT")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("closing an idle connection should do nothing, got %v", err)
+	}
+
+	idle = &mockClient{t: t, want: []string{"Quit"}}
+	redialed := &mockClient{t: t, want: append(sentMessage, "Quit")}
+	s = dialIdle(t, &Dialer{RetryFailure: true}, idle, redialed)
+	if err := Send(context.Background(), s, getTestMessage()); err != nil {
+		t.Errorf("the connection should be reopened, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if idle.done() != 1 || redialed.i != len(redialed.want) {
+		t.Error("the idle connection should be replaced by a new one")
+	}
+}
+
+func TestDialerIdleSlowQuit(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	quit := make(chan struct{})
+	d := &Dialer{Host: testHost, Port: testPort, StartTLSPolicy: NoStartTLS, IdleTimeout: 10 * time.Millisecond, QuitTimeout: time.Minute}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return stallingServer(t, func(c *textproto.Conn) {
+			c.PrintfLine("220 %s ESMTP", testHost)
+			c.ReadLine()
+			c.PrintfLine("250 OK")
+			// Never reply to QUIT.
+			c.ReadLine()
+			close(quit)
+		}), nil
+	}
+
+	s, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connection should be closed with QUIT")
+	}
+
+	start := time.Now()
+	if err := Send(context.Background(), s, getTestMessage()); !errors.Is(err, ErrConnectionIdle) {
+		t.Errorf("expected ErrConnectionIdle, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("closing an idle connection should do nothing, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Send and Close should not wait for the reply to QUIT, took %v", elapsed)
+	}
+}
+
+func TestDialerMetrics(t *testing.T) {
+	metrics := new(fakeMetrics)
+	d := NewDialer(testHost, testPort, "user", "pwd")
+	d.Metrics = metrics
+	testSendMail(t, d, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	})
+
+	want := fakeMetrics{dials: 1, sent: 1, durations: 1, bytes: int64(len(testMsg))}
+	if *metrics != want {
+		t.Errorf("invalid metrics after a message was sent, got %+v, want %+v", *metrics, want)
+	}
+
+	metrics = new(fakeMetrics)
+	d = &Dialer{Host: testHost, Port: testPort, Metrics: metrics}
+	testClient := &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+		timeout:  true,
+	}
+	if err := doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Mail " + testFrom,
+		"Quit",
+	}); err == nil {
+		t.Error("expected an error")
+	}
+	want = fakeMetrics{dials: 1, failed: 1, durations: 1}
+	if *metrics != want {
+		t.Errorf("invalid metrics after a failure, got %+v, want %+v", *metrics, want)
+	}
+
+	metrics = new(fakeMetrics)
+	d = &Dialer{Host: testHost, Port: testPort, Metrics: metrics}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	if _, err := d.Dial(context.Background()); err == nil {
+		t.Error("expected a dial error")
+	}
+	if want = (fakeMetrics{dials: 1, dialErrors: 1}); *metrics != want {
+		t.Errorf("invalid metrics after a dial error, got %+v, want %+v", *metrics, want)
+	}
+}
+
+func TestDialerLogger(t *testing.T) {
+	var buf bytes.Buffer
+	d := NewDialer(testHost, testPort, testUser, testPwd)
+	d.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	testSendMail(t, d, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	})
+	lc := &loggingClient{logger: d.Logger}
+	lc.log("RCPT TO:<"+testTo1+">", 250, time.Now(), &textproto.Error{Code: 550, Msg: "no such user"})
+
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Level    string
+			Command  string
+			Code     int
+			Duration *time.Duration
+			Error    string
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Level != "DEBUG" || record.Duration == nil {
+			t.Errorf("invalid record %s", line)
+		}
+		commands = append(commands, fmt.Sprintf("%s %d", record.Command, record.Code))
+	}
+	want := []string{
+		"STARTTLS 220",
+		"AUTH 235",
+		"MAIL FROM:<" + testFrom + "> 250",
+		"RCPT TO:<" + testTo1 + "> 250",
+		"RCPT TO:<" + testTo2 + "> 250",
+		"DATA 354",
+		". 250",
+		"QUIT 221",
+		"RCPT TO:<" + testTo1 + "> 550",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("invalid commands logged, got %q, want %q", commands, want)
+	}
+	if strings.Contains(buf.String(), testPwd) {
+		t.Errorf("the credentials should not be logged:\n%s", buf.String())
+	}
+}
+
+func TestDialerLoggerAuth(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	session := serveSMTP(t, l)
+
+	var buf bytes.Buffer
+	d := NewDialer("127.0.0.1", l.Addr().(*net.TCPAddr).Port, testUser, testPwd)
+	d.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err := d.DialAndSend(context.Background(), getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + testUser + "\x00" + testPwd))
+	if commands := (<-session).commands; len(commands) < 2 || commands[1] != "AUTH PLAIN "+credentials {
+		t.Fatalf("the credentials should be sent, got %q", commands)
+	}
+	if !strings.Contains(buf.String(), `"command":"AUTH","duration"`) {
+		t.Errorf("the AUTH command should be logged:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), credentials) || strings.Contains(buf.String(), testPwd) {
+		t.Errorf("the credentials should not be logged:\n%s", buf.String())
+	}
+}
+
+func TestDialer8BitMIME(t *testing.T) {
+	m := getTestMessage()
+	m.SetBody("text/plain", "Héllo", SetPartEncoding(Auto))
+
+	d := NewDialer(testHost, testPort, "user", "pwd")
+	testClient := &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+		data: strings.Replace(strings.TrimSuffix(testMsg, testBody), "quoted-printable", "8bit", 1) +
+			"Héllo",
+	}
+	if err := doTestSendMessage(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Mail " + testFrom,
+		"Extension 8BITMIME",
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	}, m); err != nil {
+		t.Error(err)
+	}
+}
+
+func doTestSendMessage(t *testing.T, d *Dialer, testClient *mockClient, want []string, m *Message) error {
+	stubDial(t, d, testClient, want)
+	return d.DialAndSend(context.Background(), m)
+}
+
+// stubDial makes d connect to testClient, which expects the want commands.
+func stubDial(t *testing.T, d *Dialer, testClient *mockClient, want []string) {
+	testClient.want = want
+
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network != "tcp" {
+			t.Errorf("Invalid network, got %q, want tcp", network)
+		}
+		if address != testClient.addr {
+			t.Errorf("Invalid address, got %q, want %q",
+				address, testClient.addr)
+		}
+		return testConn, nil
+	}
+
+	tlsClient = func(conn net.Conn, config *tls.Config) *tls.Conn {
+		if conn != testConn {
+			t.Errorf("Invalid conn, got %#v, want %#v", conn, testConn)
+		}
+		assertConfig(t, config, testClient.config)
+		return testTLSConn
+	}
+
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		if host != testHost {
+			t.Errorf("Invalid host, got %q, want %q", host, testHost)
+		}
+		return testClient, nil
+	}
+}
+
+func assertConfig(t *testing.T, got, want *tls.Config) {
+	if want == nil {
+		want = &tls.Config{ServerName: testHost}
+	}
+	if got.ServerName != want.ServerName {
+		t.Errorf("Invalid field ServerName in config, got %q, want %q", got.ServerName, want.ServerName)
+	}
+	if got.InsecureSkipVerify != want.InsecureSkipVerify {
+		t.Errorf("Invalid field InsecureSkipVerify in config, got %v, want %v", got.InsecureSkipVerify, want.InsecureSkipVerify)
+	}
+}
+
+func TestDialerReceivedHeader(t *testing.T) {
+	for _, encrypted := range []bool{true, false} {
+		with := "ESMTP"
+		if encrypted {
+			with = "ESMTPS"
+		}
+		received := "Received: from localhost\r\n" +
+			" by " + testHost + " with " + with + " id 0000000000000000;\r\n" +
+			" Wed, 25 Jun 2014 17:46:00 +0000\r\n"
+
+		d := NewDialer(testHost, testPort, testUser, testPwd)
+		d.AddReceivedHeader = true
+		testClient := &mockClient{
+			t:        t,
+			addr:     addr(d.Host, d.Port),
+			startTLS: encrypted,
+			data:     received + testMsg,
+		}
+		want := []string{"Extension STARTTLS", "StartTLS"}
+		if !encrypted {
+			want = want[:1]
+		}
+		err := doTestSendMail(t, d, testClient, append(want,
+			"Extension AUTH",
+			"Auth",
+			"Mail "+testFrom,
+			"Rcpt "+testTo1,
+			"Rcpt "+testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+			"Close",
+		))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := &Dialer{Host: testHost, LocalName: "client.example.com", Clock: func() time.Time { return date }}
+	c := &smtpSender{sc: &mockClient{t: t}, conn: conn, d: d}
+	received, err := c.receivedHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Received: from client.example.com ([127.0.0.1])\r\n by " + testHost + " with ESMTP"; !strings.HasPrefix(received, want) {
+		t.Errorf("invalid Received header, got %q, want prefix %q", received, want)
+	}
+	if want := ";\r\n Thu, 02 Jan 2020 03:04:05 +0000\r\n"; !strings.HasSuffix(received, want) {
+		t.Errorf("the Received header should use the clock of the Dialer, got %q", received)
+	}
+}
+
+func TestSenderCommand(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	session := serveSMTP(t, l)
+
+	d := NewDialer("127.0.0.1", l.Addr().(*net.TCPAddr).Port, "", "")
+	s, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.(Commander)
+
+	if code, msg, err := c.Command("NOOP"); err != nil || code != 250 || msg != "OK" {
+		t.Errorf("invalid NOOP reply, got %d %q %v", code, msg, err)
+	}
+	want := "Commands supported:\nEHLO MAIL RCPT DATA QUIT"
+	if code, msg, err := c.Command("HELP"); err != nil || code != 214 || msg != want {
+		t.Errorf("invalid HELP reply, got %d %q %v", code, msg, err)
+	}
+	if _, _, err := c.Command("NOOP\r\nRSET"); err == nil {
+		t.Error("expected an error with a command containing CRLF")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := (<-session).commands
+	if got := strings.Join(commands[1:], "\n"); got != "NOOP\nHELP\nQUIT" {
+		t.Errorf("invalid commands, got:\n%s", got)
+	}
+}
+
+func TestDialerDataRejected(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	reply := "554-5.7.1 Message rejected as spam\r\n" +
+		"554-5.7.1 Score: 12.5 (required: 5.0)\r\n" +
+		"554 5.7.1 Tests: BAYES_99, URIBL_BLACK"
+	d := &Dialer{Host: testHost, Port: testPort, StartTLSPolicy: NoStartTLS}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			c := textproto.NewConn(server)
+			c.PrintfLine("220 %s ESMTP", testHost)
+			for {
+				line, err := c.ReadLine()
+				if err != nil {
+					return
+				}
+				switch strings.Fields(line)[0] {
+				case "EHLO":
+					c.PrintfLine("250 %s", testHost)
+				case "DATA":
+					c.PrintfLine("354 Go ahead")
+					if _, err := c.ReadDotBytes(); err != nil {
+						return
+					}
+					c.PrintfLine("%s", reply)
+				case "QUIT":
+					c.PrintfLine("221 Bye")
+					return
+				default:
+					c.PrintfLine("250 OK")
+				}
+			}
+		}()
+		return conn, nil
+	}
+
+	err := d.DialAndSend(context.Background(), getTestMessage())
+	var terr *textproto.Error
+	if !errors.As(err, &terr) {
+		t.Fatalf("expected a *textproto.Error, got %v", err)
+	}
+	want := "5.7.1 Message rejected as spam\n5.7.1 Score: 12.5 (required: 5.0)\n5.7.1 Tests: BAYES_99, URIBL_BLACK"
+	if terr.Code != 554 || terr.Msg != want {
+		t.Errorf("the whole reply should be returned, got %d %q", terr.Code, terr.Msg)
+	}
+	if !strings.Contains(err.Error(), "Score: 12.5") {
+		t.Errorf("the error message should contain the whole reply, got %q", err)
+	}
+}
+
+func TestSenderCancelData(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	d := &Dialer{Host: testHost, Port: testPort, StartTLSPolicy: NoStartTLS}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			c := textproto.NewConn(server)
+			c.PrintfLine("220 %s ESMTP", testHost)
+			for {
+				line, err := c.ReadLine()
+				if err != nil {
+					return
+				}
+				if args := strings.Fields(line); args[0] == "DATA" {
+					// Read the content but never reply to the final dot.
+					c.PrintfLine("354 Go ahead")
+					c.ReadDotBytes()
+					io.Copy(ioutil.Discard, server)
+					return
+				}
+				c.PrintfLine("250 OK")
+			}
+		}()
+		return conn, nil
+	}
+
+	s, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = Send(ctx, s, getTestMessage())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the transaction should be aborted, took %v", elapsed)
+	}
+}
+
+func TestDialerBinaryMIME(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	content := make([]byte, bdatChunkSize+1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	copy(content, "\r\n.\r\nbare\nlines\r\n.")
+
+	for _, binary := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var session <-chan smtpSession
+		if binary {
+			session = serveSMTP(t, l, "8BITMIME", "CHUNKING", "BINARYMIME")
+		} else {
+			session = serveSMTP(t, l, "8BITMIME")
+		}
+
+		d := NewDialer("127.0.0.1", l.Addr().(*net.TCPAddr).Port, "", "")
+		d.BinaryMIME = true
+		m := getTestMessage()
+		m.Attach("data.bin", SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		}))
+		if err := d.DialAndSend(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		s := <-session
+		commands := strings.Join(s.commands, "\n")
+		if binary {
+			if !strings.Contains(commands, "MAIL FROM:<"+testFrom+"> BODY=BINARYMIME\n") {
+				t.Errorf("MAIL should declare a binary body, got:\n%s", commands)
+			}
+			if !strings.Contains(commands, "\nBDAT 65536\n") || !strings.Contains(commands, " LAST\nQUIT") {
+				t.Errorf("the message should be sent in chunks, got:\n%s", commands)
+			}
+			if !bytes.Contains(s.data, []byte("Content-Transfer-Encoding: binary\r\n")) || !bytes.Contains(s.data, content) {
+				t.Error("the attachment should be transmitted verbatim")
+			}
+		} else {
+			if !strings.Contains(commands, "MAIL FROM:<"+testFrom+"> BODY=8BITMIME\n") || !strings.Contains(commands, "\nDATA\n") {
+				t.Errorf("the message should be sent with DATA, got:\n%s", commands)
+			}
+			if !bytes.Contains(s.data, []byte("Content-Transfer-Encoding: base64")) {
+				t.Error("the attachment should be base64 encoded")
+			}
+		}
+	}
+}
+
+func TestDialerBdatRejected(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	commands := make(chan string, 20)
+	d := &Dialer{Host: testHost, Port: testPort, StartTLSPolicy: NoStartTLS, BinaryMIME: true}
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return stallingServer(t, func(c *textproto.Conn) {
+			c.PrintfLine("220 %s ESMTP", testHost)
+			rejected := false
+			for {
+				line, err := c.ReadLine()
+				if err != nil {
+					return
+				}
+				args := strings.Fields(line)
+				if args[0] != "BDAT" {
+					commands <- line
+				}
+				switch args[0] {
+				case "EHLO":
+					c.PrintfLine("250-%s\r\n250-CHUNKING\r\n250 BINARYMIME", testHost)
+				case "BDAT":
+					n, _ := strconv.Atoi(args[1])
+					if _, err := io.CopyN(ioutil.Discard, c.R, int64(n)); err != nil {
+						return
+					}
+					if !rejected {
+						rejected = true
+						commands <- line
+						c.PrintfLine("552 5.3.4 Message too big")
+					} else if len(args) == 3 {
+						commands <- "BDAT LAST"
+						c.PrintfLine("250 Queued")
+					} else {
+						c.PrintfLine("250 OK")
+					}
+				case "QUIT":
+					c.PrintfLine("221 Bye")
+					return
+				default:
+					c.PrintfLine("250 OK")
+				}
+			}
+		}), nil
+	}
+
+	newMessage := func() *Message {
+		m := getTestMessage()
+		m.Attach("data.bin", SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(make([]byte, 3*bdatChunkSize))
+			return err
+		}))
+		return m
+	}
+	s, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var terr *textproto.Error
+	if err := Send(context.Background(), s, newMessage()); !errors.As(err, &terr) || terr.Code != 552 {
+		t.Errorf("expected the 552 reply to BDAT, got %v", err)
+	}
+	if err := Send(context.Background(), s, newMessage()); err != nil {
+		t.Errorf("the connection should be reusable after a rejected chunk: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	close(commands)
+	var got []string
+	for cmd := range commands {
+		got = append(got, cmd)
+	}
+	rcpts := []string{"RCPT TO:<" + testTo1 + ">", "RCPT TO:<" + testTo2 + ">"}
+	mail := "MAIL FROM:<" + testFrom + "> BODY=BINARYMIME"
+	want := []string{"EHLO localhost", mail}
+	want = append(want, rcpts...)
+	want = append(want, "BDAT 65536", "RSET", mail)
+	want = append(want, rcpts...)
+	want = append(want, "BDAT LAST", "QUIT")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid commands, got %q, want %q", got, want)
+	}
+}
+
+func TestDialerAuthSelector(t *testing.T) {
+	d := NewDialer(testHost, testPort, testUser, testPwd)
+	var got []string
+	d.AuthSelector = func(mechanisms []string) (smtp.Auth, error) {
+		got = mechanisms
+		return ExternalAuth(""), nil
+	}
+	testClient := &mockClient{
+		t:        t,
+		addr:     addr(d.Host, d.Port),
+		startTLS: true,
+		auths:    "PLAIN LOGIN EXTERNAL",
+		auth:     ExternalAuth(""),
+	}
+	err := doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := []string{"PLAIN", "LOGIN", "EXTERNAL"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid mechanisms, got %q, want %q", got, want)
+	}
+
+	d = NewDialer(testHost, testPort, testUser, testPwd)
+	d.AuthSelector = func(mechanisms []string) (smtp.Auth, error) {
+		return nil, errors.New("no suitable mechanism")
+	}
+	testClient = &mockClient{t: t, addr: addr(d.Host, d.Port), startTLS: true}
+	err = doTestSendMail(t, d, testClient, []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Close",
+	})
+	if err == nil || !strings.Contains(err.Error(), "no suitable mechanism") {
+		t.Errorf("expected the error of the selector, got %v", err)
+	}
+}
+
+// deadlineConn is a net.Conn recording the deadlines set on it.
+type deadlineConn struct {
+	net.Conn
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestSenderSendTimeout(t *testing.T) {
+	d := NewDialer(testHost, testPort, testUser, testPwd)
+	conn := &deadlineConn{}
+	sc := &mockClient{t: t, want: []string{
+		"Mail " + testFrom, "Rcpt " + testTo1, "Rcpt " + testTo2, "Data", "Write message", "Close writer",
+		"Mail " + testFrom, "Rcpt " + testTo1, "Rcpt " + testTo2, "Data", "Write message", "Close writer",
+	}}
+	s := &smtpSender{sc: sc, conn: conn, d: d}
+
+	start := time.Now()
+	if err := Send(WithSendTimeout(context.Background(), time.Hour), s, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Send(context.Background(), s, getTestMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conn.deadlines) != 3 {
+		t.Fatalf("invalid number of deadlines, got %d, want 3", len(conn.deadlines))
+	}
+	if dl := conn.deadlines[0].Sub(start); dl < time.Hour-time.Minute || dl > time.Hour+time.Minute {
+		t.Errorf("the first message should have an extended deadline, got %v", dl)
+	}
+	for _, deadline := range conn.deadlines[1:] {
+		if dl := deadline.Sub(start); dl < d.Timeout-time.Second || dl > d.Timeout+time.Second {
+			t.Errorf("the default deadline should be used again, got %v", dl)
+		}
+	}
+}
+
+func TestDialerLineEndings(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = newSMTPClient
+
+	tests := []struct {
+		ext  []string
+		want string
+	}{
+		// net/smtp dot-stuffs the lines sent with DATA.
+		{nil, "\r\nline1\r\n..quit\r\nline3\r\n..\r\n...\r\n"},
+		// BDAT sends the data as is.
+		{[]string{"CHUNKING", "BINARYMIME"}, "\r\nline1\r\n.quit\r\nline3\r\n.\r\n..\r\n"},
+	}
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := serveSMTP(t, l, test.ext...)
+
+		d := NewDialer("127.0.0.1", l.Addr().(*net.TCPAddr).Port, "", "")
+		d.BinaryMIME = true
+		m := NewMessage(SetEncoding(Unencoded))
+		m.SetHeader("From", testFrom)
+		m.SetHeader("To", testTo1)
+		m.SetBody("text/plain", "line1\n.quit\r\nline3\n.\n..")
+		m.Attach("data.bin", SetCopyFunc(func(w io.Writer) error {
+			_, err := io.WriteString(w, "data")
+			return err
+		}))
+		if err := d.DialAndSend(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		data := (<-session).data
+		if !bytes.Contains(data, []byte(test.want)) {
+			t.Errorf("invalid body with extensions %q, got:\n%q\nwant it to contain:\n%q", test.ext, data, test.want)
+		}
+		if bytes.Contains(bytes.ReplaceAll(data, []byte("\r\n"), nil), []byte("\n")) {
+			t.Errorf("the data should not contain bare LF with extensions %q:\n%q", test.ext, data)
+		}
+	}
+}
+
+func TestDialerEnvelopeParams(t *testing.T) {
+	m := getTestMessage()
+	m.SetMailParam("X-TRACE", "abc")
+	m.SetMailParam("ENVID", "")
+	m.SetMailParam("x-trace", "def")
+	m.SetRcptParam("to1@EXAMPLE.com", "NOTIFY", "SUCCESS,FAILURE")
+	c := &mockClient{t: t, want: []string{
+		"Mail " + testFrom + " x-trace=def ENVID",
+		"Rcpt " + testTo1 + " NOTIFY=SUCCESS,FAILURE",
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+	}}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+		t.Error(err)
+	}
+
+	for _, param := range [][2]string{{"X TRACE", "abc"}, {"-X", ""}, {"X-TRACE", "a b"}, {"X-TRACE", "a=b"}, {"X-TRACE", "café"}} {
+		m := getTestMessage()
+		m.SetRcptParam(testTo2, param[0], param[1])
+		c := &mockClient{t: t}
+		if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err == nil {
+			t.Errorf("expected an error with the parameter %q=%q", param[0], param[1])
+		}
+	}
+
+	for _, key := range []string{"SMTPUTF8", "body", "AUTH", "BY", "MT-PRIORITY", "REQUIRETLS"} {
+		m := getTestMessage()
+		m.SetMailParam(key, "")
+		c := &mockClient{t: t}
+		if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err == nil {
+			t.Errorf("expected an error with the reserved parameter %q", key)
+		}
+	}
+
+	m = NewMessage()
+	m.SetRcptParam("Postmaster", "NOTIFY", "NEVER")
+	m.SetRcptParam("postmaster", "NOTIFY", "SUCCESS")
+	if p := m.rcptParams["Postmaster"]; len(p) != 1 || p[0].value != "NEVER" {
+		t.Errorf("an address without domain should be kept as is, got %v", m.rcptParams)
+	}
+}
+
+func TestXText(t *testing.T) {
+	tests := map[string]string{
+		"user@example.com":       "user@example.com",
+		"first+last@example.com": "first+2Blast@example.com",
+		"a=b c@example.com":      "a+3Db+20c@example.com",
+		"josé@example.com":       "jos+C3+A9@example.com",
+	}
+	for in, want := range tests {
+		if got := xtext(in); got != want {
+			t.Errorf("xtext(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDialerAuthSubmitter(t *testing.T) {
+	want := func(param string) []string {
+		return []string{
+			"Extension AUTH",
+			"Mail " + testFrom + " " + param,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+		}
+	}
+
+	m := getTestMessage()
+	m.SetAuthSubmitter("first+last@example.com")
+	c := &mockClient{t: t, want: want("AUTH=first+2Blast@example.com")}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+		t.Error(err)
+	}
+
+	m.SetAuthSubmitter("")
+	c = &mockClient{t: t, want: want("AUTH=<>")}
+	if err := Send(context.Background(), dialMockClients(t, &Dialer{}, c), m); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDialerValidate(t *testing.T) {
+	d := NewDialer(testHost, testPort, testUser, testPwd)
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		t.Error("Validate should not connect")
+		return nil, errors.New("unexpected dial")
+	}
+
+	if err := d.Validate(context.Background(), getTestMessage(), getTestMessage()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	m := getTestMessage()
+	m.SetHeader("From", "invalid address")
+	if err := d.Validate(context.Background(), getTestMessage(), m); err == nil || !strings.Contains(err.Error(), "Index:1") {
+		t.Errorf("expected an error with a malformed From address, got %v", err)
+	}
+
+	m = getTestMessage()
+	m.SetMailParam("X-TRACE", "a b")
+	if err := d.Validate(context.Background(), m); err == nil {
+		t.Error("expected an error with an invalid MAIL parameter")
+	}
+
+	m = getTestMessage()
+	m.Attach("missing.txt", SetCopyFunc(func(io.Writer) error {
+		return errors.New("kaboom")
+	}))
+	if err := d.Validate(context.Background(), m); err == nil || !strings.Contains(err.Error(), "kaboom") {
+		t.Errorf("expected the serialization error, got %v", err)
+	}
+
+	m = getTestMessage()
+	m.SetProgressFunc(func(written, total int64) {
+		t.Error("Validate should not report the progress")
+	})
+	m.AttachReader("note.txt", struct{ io.Reader }{strings.NewReader("one-shot content")})
+	if err := d.Validate(context.Background(), m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m.SetProgressFunc(nil)
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.StdEncoding.EncodeToString([]byte("one-shot content")); !strings.Contains(string(b), want) {
+		t.Errorf("the attachment was consumed by Validate:\n%s", b)
+	}
+
+	m = getTestMessage()
+	m.AttachReader("report", struct{ io.Reader }{strings.NewReader("%PDF-1.4\n%äüöß\n")}, SetContentTypeSniffing(true))
+	if err := d.Validate(context.Background(), m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, err := m.Bytes(); err != nil || !strings.Contains(string(b), "Content-Type: application/pdf; name=\"report\"\r\n") {
+		t.Errorf("Validate should not change the sniffed Content-Type: %v\n%s", err, b)
+	}
+
+	raw := NewMessage()
+	raw.SetRaw(map[string]string{"From": "from@example.com", "To": "to@example.com"}, struct{ io.Reader }{strings.NewReader("raw body")})
+	if err := d.Validate(context.Background(), raw); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, err := raw.Bytes(); err != nil || !strings.HasSuffix(string(b), "\r\n\r\nraw body") {
+		t.Errorf("the raw body was consumed by Validate: %q, %v", b, err)
+	}
+}
+
+func TestDialerConcurrentDial(t *testing.T) {
+	defer func(f func(net.Conn, string) (smtpClient, error)) { smtpNewClient = f }(smtpNewClient)
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return &mockClient{t: t, startTLS: true, want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension AUTH",
+			"Auth",
+			"Quit",
+			"Close",
+		}}, nil
+	}
+
+	d := NewDialer(testHost, testPort, testUser, testPwd)
+	d.DialProxy = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return testConn, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := d.Dial(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s.Close()
+		}()
+	}
+	wg.Wait()
+
+	if d.Auth != nil {
+		t.Errorf("Dial should not set the Auth of the Dialer, got %#v", d.Auth)
 	}
 }
@@ -0,0 +1,55 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Template renders messages from templates. Each template is optional, at
+// least one of Text and HTML must be set.
+type Template struct {
+	// Subject renders the Subject header field. Leading and trailing white
+	// space is removed.
+	Subject *texttemplate.Template
+	// Text renders the text/plain part.
+	Text *texttemplate.Template
+	// HTML renders the text/html part, it is an alternative to the text
+	// part when both are set.
+	HTML *htmltemplate.Template
+}
+
+// Message executes the templates with data and returns the rendered message.
+// The settings are applied to the returned message.
+func (t *Template) Message(data interface{}, settings ...MessageSetting) (*Message, error) {
+	if t.Text == nil && t.HTML == nil {
+		return nil, fmt.Errorf("gomail: template has no body")
+	}
+
+	m := NewMessage(settings...)
+	if t.Subject != nil {
+		var buf bytes.Buffer
+		if err := t.Subject.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("gomail: could not execute subject template: %w", err)
+		}
+		m.SetHeader("Subject", strings.TrimSpace(buf.String()))
+	}
+	if t.Text != nil {
+		var buf bytes.Buffer
+		if err := t.Text.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("gomail: could not execute text template: %w", err)
+		}
+		m.SetBody("text/plain", buf.String())
+	}
+	if t.HTML != nil {
+		var buf bytes.Buffer
+		if err := t.HTML.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("gomail: could not execute HTML template: %w", err)
+		}
+		m.AddAlternative("text/html", buf.String())
+	}
+
+	return m, nil
+}
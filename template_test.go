@@ -0,0 +1,79 @@
+package mail
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+)
+
+type templateData struct {
+	Name  string
+	Items []string
+}
+
+func TestTemplate(t *testing.T) {
+	tpl := &Template{
+		Subject: texttemplate.Must(texttemplate.New("subject").Parse("Order for {{.Name}}\n")),
+		Text:    texttemplate.Must(texttemplate.New("text").Parse("Hello {{.Name}}{{range .Items}}\n- {{.}}{{end}}")),
+		HTML:    htmltemplate.Must(htmltemplate.New("html").Parse("<p>Hello {{.Name}}</p><ul>{{range .Items}}<li>{{.}}</li>{{end}}</ul>")),
+	}
+	m, err := tpl.Message(templateData{Name: "<Bob>", Items: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBoundaryFunc(newTestBoundaryFunc())
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"Subject: Order for <Bob>\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Hello <Bob>\r\n" +
+			"- a\r\n" +
+			"- b\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<p>Hello &lt;Bob&gt;</p><ul><li>a</li><li>b</li></ul>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+	testMessage(t, m, 0, want)
+}
+
+func TestTemplateError(t *testing.T) {
+	tpl := &Template{
+		HTML: htmltemplate.Must(htmltemplate.New("html").Parse("{{.Missing}}")),
+	}
+	_, err := tpl.Message(templateData{})
+	if err == nil || !strings.Contains(err.Error(), "HTML template") {
+		t.Errorf("expected an HTML template error, got %v", err)
+	}
+
+	if _, err := new(Template).Message(nil); err == nil {
+		t.Error("expected an error without body template")
+	}
+
+	tpl = &Template{Text: texttemplate.Must(texttemplate.New("text").Parse("{{.Name}}"))}
+	m, err := tpl.Message(templateData{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	m.SetHeader("From", "from@example.com")
+	if _, err := m.WriteTo(&buf); err != nil || !strings.HasSuffix(buf.String(), "\r\n\r\nBob") {
+		t.Errorf("invalid text only message %q (%v)", buf.String(), err)
+	}
+}
@@ -1,42 +1,331 @@
 package mail
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"net/http"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // WriteTo implements io.WriterTo. It dumps the whole message into w.
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
-	mw := &messageWriter{w: w}
+	return m.writeTo(w, false)
+}
+
+// writeTo writes the message to w, the parts using the Auto encoding may be
+// sent as 8bit when allow8bit is set.
+func (m *Message) writeTo(w io.Writer, allow8bit bool) (int64, error) {
+	return m.write(w, messageWriter{allow8bit: allow8bit})
+}
+
+// write writes the message to w with a writer configured like mw, reporting
+// the progress to the function set with SetProgressFunc.
+func (m *Message) write(w io.Writer, mw messageWriter) (int64, error) {
+	if m.progress != nil {
+		w = &progressWriter{w: w, fn: m.progress, total: m.progressTotal(mw)}
+	}
+	mw.w = w
+	mw.writeMessage(m)
+	return mw.n, mw.err
+}
+
+// progressTotal returns the length of the message written by a writer
+// configured like mw, or -1 if the content of a part or a file would have to
+// be read: the functions given to SetBodyWriter or SetCopyFunc may only
+// produce their content once.
+func (m *Message) progressTotal(mw messageWriter) int64 {
+	if m.raw != nil {
+		return -1
+	}
+	for _, p := range m.parts {
+		if !p.static {
+			return -1
+		}
+	}
+	for _, files := range [][]*file{m.attachments, m.embedded} {
+		for _, f := range files {
+			switch f.Encoding {
+			case "", Auto, Base64:
+			default:
+				return -1
+			}
+			if f.size == nil || f.sniff {
+				return -1
+			}
+		}
+	}
+
+	mw.w = ioutil.Discard
+	mw.sizeOnly = true
+	mw.writeMessage(m)
+	if mw.err != nil {
+		return -1
+	}
+	return mw.n
+}
+
+// progressWriter reports the number of bytes written to w.
+type progressWriter struct {
+	w     io.Writer
+	fn    func(sent, total int64)
+	sent  int64
+	total int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.sent += int64(n)
+		w.fn(w.sent, w.total)
+	}
+	return n, err
+}
+
+// hasAutoPart reports whether a part of m uses the Auto encoding.
+func (m *Message) hasAutoPart() bool {
+	for _, p := range m.parts {
+		if p.encoding == Auto {
+			return true
+		}
+	}
+	return false
+}
+
+// eightBitMessage writes a message whose Auto encoded parts may be sent as
+// 8bit, it is used when the server supports the 8BITMIME extension.
+type eightBitMessage struct {
+	m *Message
+}
+
+func (e eightBitMessage) WriteTo(w io.Writer) (int64, error) {
+	return e.m.writeTo(w, true)
+}
+
+// binaryMessage writes a message whose files may be sent as binary, it is
+// used when the server supports the CHUNKING and BINARYMIME extensions.
+type binaryMessage struct {
+	m *Message
+}
+
+func (b binaryMessage) WriteTo(w io.Writer) (int64, error) {
+	return b.m.write(w, messageWriter{allow8bit: true, allowBinary: true})
+}
+
+// rawMessage is a serialized message, it can be written several times.
+type rawMessage []byte
+
+func (r rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r)
+	return int64(n), err
+}
+
+// Size returns the length in bytes of the message as written by WriteTo. The
+// content of the files added with Attach and Embed is not read, only their
+// size is. The other parts are serialized, but not stored, to compute their
+// encoded length. Apart from the generated Date and Message-ID header fields,
+// whose length may vary by a few bytes, the size is exact.
+//
+// The content given to AttachReader, EmbedReader and SetRaw is only read when
+// the reader implements io.Seeker, so that the message can still be sent.
+// Otherwise it is not counted and the size is a lower bound.
+func (m *Message) Size() (int64, error) {
+	mw := &messageWriter{w: ioutil.Discard, sizeOnly: true, skipOneShot: true}
 	mw.writeMessage(m)
 	return mw.n, mw.err
 }
 
+// Bytes returns the whole message as written by WriteTo.
+func (m *Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteToFile writes the whole message to the named file, for example to save
+// it as a .eml file. The file is created if needed and truncated otherwise.
+func (m *Message) WriteToFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("gomail: WriteToFile failed to create file: %w", err)
+	}
+	bw := bufio.NewWriter(f)
+	if _, err := m.WriteTo(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("gomail: WriteToFile failed to write file: %w", err)
+	}
+	return f.Close()
+}
+
 func (w *messageWriter) writeMessage(m *Message) {
+	if len(m.headerSigners) == 0 {
+		w.writeUnsigned(m)
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	sw := &messageWriter{w: buf, sizeOnly: w.sizeOnly, skipOneShot: w.skipOneShot, allow8bit: w.allow8bit, allowBinary: w.allowBinary}
+	sw.writeUnsigned(m)
+	if sw.err != nil {
+		w.err = sw.err
+		return
+	}
+	msg := buf.Bytes()
+	for _, s := range m.headerSigners {
+		var fields []byte
+		var err error
+		if ts, ok := s.(timedHeaderSigner); ok {
+			fields, err = ts.signHeaderAt(msg, m.now())
+		} else {
+			fields, err = s.SignHeader(msg)
+		}
+		if err != nil {
+			w.err = fmt.Errorf("gomail: message signature failed: %w", err)
+			return
+		}
+		msg = append(fields, msg...)
+	}
+	w.Write(msg)
+}
+
+// writeUnsigned writes the message without the fields of its header signers.
+func (w *messageWriter) writeUnsigned(m *Message) {
+	w.base64LineLen = m.base64LineLen
+	w.lineLength = m.lineLength
+	if m.raw != nil {
+		w.writeRaw(m)
+		return
+	}
+	fields := make([]headerField, 0, len(m.headerOrder)+4)
 	if _, ok := m.header["MIME-Version"]; !ok {
-		w.writeString("MIME-Version: 1.0\r\n")
+		fields = append(fields, headerField{"MIME-Version", []string{"1.0"}, false})
 	}
 	if _, ok := m.header["Date"]; !ok {
-		w.writeHeader("Date", m.FormatDate(now()))
+		fields = append(fields, headerField{"Date", []string{m.FormatDate(m.now())}, false})
+	}
+	if _, ok := m.header["Message-ID"]; !ok && !m.noMessageID {
+		id, err := m.generateMessageID()
+		if err != nil {
+			w.err = err
+			return
+		}
+		fields = append(fields, headerField{"Message-ID", []string{id}, false})
+	}
+	if err := m.checkSender(); err != nil {
+		w.err = err
+		return
+	}
+	if len(m.header["From"]) > 1 && len(m.header["Sender"]) == 0 {
+		fields = append(fields, headerField{"Sender", []string{m.header["From"][0]}, false})
+	}
+	for _, k := range m.headerOrder {
+		if v, ok := m.header[k]; ok {
+			fields = append(fields, headerField{k, v, m.repeated[k]})
+		}
+	}
+	w.writeFields(orderFields(fields, m.fieldOrder))
+
+	if len(m.transformers) == 0 {
+		w.writeContent(m)
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	cw := &messageWriter{w: buf, base64LineLen: m.base64LineLen, lineLength: m.lineLength, skipOneShot: w.skipOneShot, allow8bit: w.allow8bit}
+	cw.writeContent(m)
+	if cw.err != nil {
+		w.err = cw.err
+		return
+	}
+	entity := buf.Bytes()
+	for _, t := range m.transformers {
+		out := getBuffer()
+		defer putBuffer(out)
+		var err error
+		if tt, ok := t.(timedTransformer); ok {
+			err = tt.transformAt(out, entity, m.now())
+		} else {
+			err = t.Transform(out, entity)
+		}
+		if err != nil {
+			w.err = fmt.Errorf("gomail: message transformation failed: %w", err)
+			return
+		}
+		entity = out.Bytes()
+	}
+	w.Write(entity)
+}
+
+// writeRaw writes the header fields and the body set with SetRaw.
+func (w *messageWriter) writeRaw(m *Message) {
+	for _, k := range m.headerOrder {
+		v, ok := m.header[k]
+		if !ok || strings.EqualFold(k, "Bcc") {
+			continue
+		}
+		if err := checkHeader(k, v); err != nil {
+			w.err = err
+			return
+		}
+		for _, s := range v {
+			w.writeString(k + ": " + s + "\r\n")
+		}
+	}
+	w.writeString("\r\n")
+	if w.err != nil {
+		return
+	}
+	if w.skipOneShot && m.rawOneShot {
+		return
+	}
+	if err := m.raw(w); err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// writeContent writes the MIME entity of the message: its Content-* headers
+// and its body, but not the message headers.
+func (w *messageWriter) writeContent(m *Message) {
+	if m.report != nil {
+		w.writeReport(m)
+		return
+	}
+	if err := m.checkContentIDs(); err != nil {
+		w.err = err
+		return
 	}
-	w.writeHeaders(m.header)
 
 	if m.hasMixedPart() {
-		w.openMultipart("mixed", m.boundary)
+		w.openMultipart("mixed", w.nextBoundary(m))
 	}
 
 	if m.hasRelatedPart() {
-		w.openMultipart("related", m.boundary)
+		w.openMultipart("related", w.nextBoundary(m))
 	}
 
 	if m.hasAlternativePart() {
-		w.openMultipart("alternative", m.boundary)
+		w.openMultipart("alternative", w.nextBoundary(m))
 	}
 	for _, part := range m.parts {
 		w.writePart(part, m.charset)
@@ -56,6 +345,65 @@ func (w *messageWriter) writeMessage(m *Message) {
 	}
 }
 
+// writeReport writes the multipart/report entity of a message on which
+// SetDeliveryReport was called.
+func (w *messageWriter) writeReport(m *Message) {
+	if len(m.parts) == 0 || len(m.attachments) > 0 || len(m.embedded) > 0 {
+		w.err = errors.New("gomail: a delivery report requires a body and no attachments or embedded files")
+		return
+	}
+
+	w.openMultipart("report; report-type=delivery-status", w.nextBoundary(m))
+	if m.hasAlternativePart() {
+		w.openMultipart("alternative", w.nextBoundary(m))
+	}
+	for _, part := range m.parts {
+		w.writePart(part, m.charset)
+	}
+	if m.hasAlternativePart() {
+		w.closeMultipart()
+	}
+
+	w.writeHeaders(map[string][]string{"Content-Type": {"message/delivery-status"}})
+	w.writeBody(newCopier(m.report.status), Unencoded)
+
+	if returned := m.report.returned; len(returned) > 0 {
+		cte := "7bit"
+		if strings.IndexFunc(returned, func(r rune) bool { return r >= 0x80 }) != -1 {
+			cte = string(Unencoded)
+		}
+		w.writeHeaders(map[string][]string{
+			"Content-Type":              {m.report.returnedType},
+			"Content-Transfer-Encoding": {cte},
+		})
+		w.writeBody(newCopier(returned), Unencoded)
+	}
+	w.closeMultipart()
+}
+
+// generateMessageID returns a new unique message identifier as defined in
+// RFC 5322, section 3.6.4.
+func (m *Message) generateMessageID() (string, error) {
+	domain := m.messageIDDomain
+	if domain == "" {
+		if from := m.header["From"]; len(from) > 0 {
+			if addr, err := parseAddress(from[0]); err == nil {
+				domain = addr[strings.LastIndexByte(addr, '@')+1:]
+			}
+		}
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", fmt.Errorf("gomail: could not generate Message-ID: %w", err)
+	}
+
+	return fmt.Sprintf("<%d.%x@%s>", m.now().UnixNano(), b, domain), nil
+}
+
 func (m *Message) hasMixedPart() bool {
 	return (len(m.parts) > 0 && len(m.attachments) > 0) || len(m.attachments) > 1
 }
@@ -75,15 +423,67 @@ type messageWriter struct {
 	partWriter io.Writer
 	depth      uint8
 	err        error
+
+	base64LineLen int
+	boundaries    []string
+	// delimiters are the custom boundaries of the open multipart entities,
+	// they must not appear in the content.
+	delimiters [3]string
+	// sizeOnly is set when only the length of the message is needed, the
+	// content of base64 encoded files of known size is then not read.
+	sizeOnly bool
+	// skipOneShot is set to validate a message without consuming it, the
+	// content of the files that can only be read once is then skipped.
+	skipOneShot bool
+	// allow8bit is set when the parts using the Auto encoding may be sent
+	// as 8bit.
+	allow8bit bool
+	// allowBinary is set when the files using the default encoding may be
+	// sent as binary.
+	allowBinary bool
+	lineLength  LineLengthPolicy
+}
+
+// binaryEncoding is the transfer encoding of files sent with BDAT to servers
+// supporting the BINARYMIME extension, as defined in RFC 3030.
+const binaryEncoding Encoding = "binary"
+
+// nextBoundary returns the boundary of the next multipart entity of m. The
+// boundaries returned by the function set with SetBoundaryFunc must be unique
+// within the message.
+func (w *messageWriter) nextBoundary(m *Message) string {
+	if m.boundaryFunc == nil {
+		return m.boundary
+	}
+
+	b := m.boundaryFunc()
+	for _, used := range w.boundaries {
+		if b == used && w.err == nil {
+			w.err = fmt.Errorf("gomail: duplicate multipart boundary %q", b)
+		}
+	}
+	w.boundaries = append(w.boundaries, b)
+	return b
 }
 
 func (w *messageWriter) openMultipart(mimeType, boundary string) {
 	mw := multipart.NewWriter(w)
 	if boundary != "" {
+		if err := checkBoundary(boundary); err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
 		mw.SetBoundary(boundary)
 	}
-	contentType := "multipart/" + mimeType + ";\r\n boundary=" + mw.Boundary()
+	b := mw.Boundary()
+	if strings.ContainsAny(b, "()<>@,;:\\\"/[]?= ") {
+		b = `"` + b + `"`
+	}
+	contentType := "multipart/" + mimeType + ";\r\n boundary=" + b
 	w.writers[w.depth] = mw
+	w.delimiters[w.depth] = boundary
 
 	if w.depth == 0 {
 		w.writeHeader("Content-Type", contentType)
@@ -108,45 +508,356 @@ func (w *messageWriter) closeMultipart() {
 }
 
 func (w *messageWriter) writePart(p *part, charset string) {
+	if p.charset != "" {
+		charset = p.charset
+	}
+	enc, cte, copier := p.encoding, string(p.encoding), p.copier
+	if enc == Auto {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		var err error
+		cte, copier, err = autoEncoding(buf, p.copier, w.allow8bit)
+		if err != nil {
+			w.err = err
+			return
+		}
+		enc = Unencoded
+		if cte == string(QuotedPrintable) {
+			enc = QuotedPrintable
+		}
+	}
+
 	w.writeHeaders(map[string][]string{
 		"Content-Type":              {p.contentType + "; charset=" + charset},
-		"Content-Transfer-Encoding": {string(p.encoding)},
+		"Content-Transfer-Encoding": {cte},
 	})
-	w.writeBody(p.copier, p.encoding)
+	w.writeBody(copier, enc)
+}
+
+// maxLineLen5322 is the maximum length of a line, without the CRLF, allowed
+// by RFC 5322.
+const maxLineLen5322 = 998
+
+// autoEncoding buffers the content written by f in buf and returns the
+// transfer encoding it needs along with a function writing the buffered
+// content. The line endings of 7bit and 8bit content are normalized to CRLF.
+func autoEncoding(buf *bytes.Buffer, f func(io.Writer) error, allow8bit bool) (string, func(io.Writer) error, error) {
+	if err := f(buf); err != nil {
+		return "", nil, err
+	}
+	b := buf.Bytes()
+
+	cte := "7bit"
+	lineLen := 0
+	for i, c := range b {
+		switch {
+		case c == '\n':
+			lineLen = 0
+			continue
+		case c == '\r' && i+1 < len(b) && b[i+1] == '\n':
+			continue
+		case c == '\r', c == 0, c >= 0x80 && !allow8bit:
+			cte = string(QuotedPrintable)
+		case c >= 0x80:
+			cte = string(Unencoded)
+		}
+		if lineLen++; lineLen > maxLineLen5322 {
+			cte = string(QuotedPrintable)
+		}
+		if cte == string(QuotedPrintable) {
+			return cte, func(w io.Writer) error {
+				_, err := w.Write(b)
+				return err
+			}, nil
+		}
+	}
+
+	return cte, func(w io.Writer) error {
+		_, err := (&crlfWriter{w: w}).Write(b)
+		return err
+	}, nil
 }
 
 func (w *messageWriter) addFiles(files []*file, isAttachment bool) {
 	for _, f := range files {
-		if _, ok := f.Header["Content-Type"]; !ok {
-			mediaType := mime.TypeByExtension(filepath.Ext(f.Name))
-			if mediaType == "" {
-				mediaType = "application/octet-stream"
+		if w.addFile(f, isAttachment); w.err != nil {
+			return
+		}
+	}
+}
+
+func (w *messageWriter) addFile(f *file, isAttachment bool) {
+	copier := f.CopyFunc
+	if w.skipOneShot && f.oneShot {
+		copier = func(io.Writer) error { return nil }
+	}
+	name := f.name()
+	var contentType string
+	if _, ok := f.Header["Content-Type"]; !ok {
+		mediaType := f.mediaType
+		if mediaType == "" {
+			mediaType = mime.TypeByExtension(filepath.Ext(name))
+		}
+		sniff := f.sniff && (mediaType == "" || mediaType == "application/octet-stream")
+		if sniff && !(w.skipOneShot && f.oneShot) {
+			var cancel func()
+			var err error
+			mediaType, copier, cancel, err = sniffContentType(copier)
+			if err != nil {
+				w.err = err
+				return
 			}
-			f.setHeader("Content-Type", mediaType+`; name="`+f.Name+`"`)
+			defer cancel()
 		}
+		if mediaType == "" {
+			mediaType = "application/octet-stream"
+		}
+		if f.charset != "" {
+			if i := strings.IndexByte(mediaType, ';'); i != -1 {
+				mediaType = mediaType[:i]
+			}
+			mediaType += "; charset=" + f.charset
+		}
+		if sniff {
+			// The detected type depends on the content, it is not stored in
+			// the file header so that a write skipping the content, like
+			// Validate, does not change the message.
+			contentType = mediaType + fileParam("name", name)
+		} else {
+			f.setHeader("Content-Type", mediaType+fileParam("name", name))
+		}
+	}
 
-		if _, ok := f.Header["Content-Transfer-Encoding"]; !ok {
-			f.setHeader("Content-Transfer-Encoding", string(Base64))
+	disp := f.Disposition
+	if disp == "" {
+		if isAttachment {
+			disp = "attachment"
+		} else {
+			disp = "inline"
 		}
+	}
+	if _, ok := f.Header["Content-Disposition"]; !ok {
+		f.setHeader("Content-Disposition", disp+fileParam("filename", name))
+	}
 
-		if _, ok := f.Header["Content-Disposition"]; !ok {
-			var disp string
-			if isAttachment {
-				disp = "attachment"
-			} else {
-				disp = "inline"
-			}
-			f.setHeader("Content-Disposition", disp+`; filename="`+f.Name+`"`)
+	if !isAttachment || disp == "inline" {
+		if _, ok := f.Header["Content-ID"]; !ok {
+			f.setHeader("Content-ID", "<"+name+">")
 		}
+	}
 
-		if !isAttachment {
-			if _, ok := f.Header["Content-ID"]; !ok {
-				f.setHeader("Content-ID", "<"+f.Name+">")
+	enc := f.Encoding
+	h := f.Header
+	_, hasCTE := f.Header["Content-Transfer-Encoding"]
+	if enc == "" || enc == Auto {
+		enc = Base64
+		if w.allowBinary && !hasCTE {
+			enc = binaryEncoding
+		}
+		if !hasCTE {
+			// The chosen encoding depends on the transaction, so it is not
+			// stored in the file header.
+			h = withHeader(h, "Content-Transfer-Encoding", string(enc))
+		}
+	} else if !hasCTE {
+		if enc == Unencoded {
+			// The content must be read to know whether it is 7bit or
+			// 8bit, it is not stored in the file header because the
+			// content may change between two writes.
+			buf := getBuffer()
+			defer putBuffer(buf)
+			var err error
+			h, copier, err = unencodedFileHeader(buf, h, copier)
+			if err != nil {
+				w.err = err
+				return
 			}
+		} else {
+			f.setHeader("Content-Transfer-Encoding", string(enc))
+		}
+	}
+
+	// The length of base64 encoded and binary content only depends on the
+	// length of the content.
+	if w.sizeOnly && f.size != nil && (enc == Base64 || enc == binaryEncoding) {
+		n, err := f.size()
+		if err != nil {
+			w.err = err
+			return
+		}
+		copier = zeroCopier(n)
+	}
+
+	if contentType != "" {
+		h = withHeader(h, "Content-Type", contentType)
+	}
+	w.writeHeaders(h)
+	w.writeBody(copier, enc)
+}
+
+// sniffLen is the number of bytes used by http.DetectContentType.
+const sniffLen = 512
+
+// sniffContentType detects the media type of the content written by copier
+// from its first bytes. The content is streamed through a pipe, so only its
+// beginning is buffered, and the returned copier writes the whole content.
+// cancel must be called once the returned copier is not needed anymore.
+func sniffContentType(copier func(io.Writer) error) (mediaType string, replay func(io.Writer) error, cancel func(), err error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copier(pw))
+	}()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(pr, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		pr.Close()
+		return "", nil, nil, err
+	}
+	head = head[:n]
+
+	replay = func(w io.Writer) error {
+		if _, err := w.Write(head); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, pr)
+		return err
+	}
+	cancel = func() {
+		pr.Close()
+	}
+	return http.DetectContentType(head), replay, cancel, nil
+}
+
+// maxParamLen is the maximum length of a parameter value before it is split
+// into several parameters.
+const maxParamLen = 56
+
+// fileParam formats the key parameter of the Content-Type or
+// Content-Disposition header field of a file, including the leading
+// semicolon. As defined in RFC 2231, non-ASCII values are percent-encoded and
+// long values are split in numbered parameters on several lines.
+func fileParam(key, value string) string {
+	ascii := true
+	for i := 0; i < len(value); i++ {
+		if value[i] < ' ' || value[i] > '~' {
+			ascii = false
+			break
 		}
-		w.writeHeaders(f.Header)
-		w.writeBody(f.CopyFunc, Base64)
 	}
+
+	var segments []string
+	if ascii {
+		for len(value) > maxParamLen {
+			segments = append(segments, value[:maxParamLen])
+			value = value[maxParamLen:]
+		}
+		segments = append(segments, value)
+		if len(segments) == 1 {
+			param := key + "=" + quoteParam(value)
+			return paramSeparator(param) + param
+		}
+		for i, s := range segments {
+			segments[i] = key + "*" + strconv.Itoa(i) + "=" + quoteParam(s)
+		}
+		return ";\r\n " + strings.Join(segments, ";\r\n ")
+	}
+
+	const hex = "0123456789ABCDEF"
+	enc := "UTF-8''"
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if isAttrChar(b) {
+			enc += string(b)
+		} else {
+			enc += "%" + string(hex[b>>4]) + string(hex[b&0xf])
+		}
+		if len(enc) >= maxParamLen && i < len(value)-1 {
+			segments = append(segments, enc)
+			enc = ""
+		}
+	}
+	segments = append(segments, enc)
+	if len(segments) == 1 {
+		param := key + "*=" + enc
+		return paramSeparator(param) + param
+	}
+	for i, s := range segments {
+		segments[i] = key + "*" + strconv.Itoa(i) + "*=" + s
+	}
+	return ";\r\n " + strings.Join(segments, ";\r\n ")
+}
+
+// paramSeparator returns the separator written before a single parameter,
+// long parameters are written on their own line.
+func paramSeparator(param string) string {
+	if len(param) > maxParamLen/2 {
+		return ";\r\n "
+	}
+	return "; "
+}
+
+func quoteParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// isAttrChar reports whether b can be used unencoded in an RFC 2231 extended
+// parameter value.
+func isAttrChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) != -1
+}
+
+// zeroCopier returns a function writing n zero bytes.
+func zeroCopier(n int64) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.CopyN(w, zeroReader{}, n)
+		return err
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// unencodedFileHeader buffers the content written by copier in buf and returns
+// a copy of header with the 7bit or 8bit transfer encoding matching the
+// content and a function writing the buffered content.
+func unencodedFileHeader(buf *bytes.Buffer, header map[string][]string, copier func(io.Writer) error) (map[string][]string, func(io.Writer) error, error) {
+	if err := copier(buf); err != nil {
+		return nil, nil, err
+	}
+
+	cte := "7bit"
+	for _, b := range buf.Bytes() {
+		if b >= 0x80 {
+			cte = string(Unencoded)
+			break
+		}
+	}
+
+	return withHeader(header, "Content-Transfer-Encoding", cte), func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	}, nil
+}
+
+// withHeader returns a copy of header with field set to value.
+func withHeader(header map[string][]string, field, value string) map[string][]string {
+	h := make(map[string][]string, len(header)+1)
+	for k, v := range header {
+		h[k] = v
+	}
+	h[field] = []string{value}
+	return h
 }
 
 func (w *messageWriter) Write(p []byte) (int, error) {
@@ -183,8 +894,9 @@ func (w *messageWriter) writeHeader(k string, v ...string) {
 	charsLeft := 76 - len(k) - len(": ")
 
 	for i, s := range v {
-		// If the line is already too long, insert a newline right away.
-		if charsLeft < 1 {
+		// If the line is already too long or the first word of the value
+		// does not fit, insert a newline right away.
+		if charsLeft < 1 || (i != 0 && firstWordLen(s) > charsLeft-2) {
 			if i == 0 {
 				w.writeString("\r\n ")
 			} else {
@@ -211,6 +923,43 @@ func (w *messageWriter) writeHeader(k string, v ...string) {
 	w.writeString("\r\n")
 }
 
+// checkHeader returns an error if a header field could be used to inject
+// other header fields: its name must only contain printable US-ASCII
+// characters except colon, and the line breaks of its values must fold the
+// line, that is CRLF must be followed by a space or a tab.
+func checkHeader(k string, v []string) error {
+	if k == "" {
+		return errors.New("gomail: empty header field name")
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] <= ' ' || k[i] > '~' || k[i] == ':' {
+			return fmt.Errorf("gomail: invalid header field name %q", k)
+		}
+	}
+
+	for _, s := range v {
+		for i := 0; i < len(s); i++ {
+			switch s[i] {
+			case '\r':
+				if i+2 >= len(s) || s[i+1] != '\n' || (s[i+2] != ' ' && s[i+2] != '\t') {
+					return fmt.Errorf("gomail: invalid line break in header field %q", k)
+				}
+				i++
+			case '\n':
+				return fmt.Errorf("gomail: invalid line break in header field %q", k)
+			}
+		}
+	}
+	return nil
+}
+
+func firstWordLen(s string) int {
+	if i := strings.IndexAny(s, " \n"); i != -1 {
+		return i
+	}
+	return len(s)
+}
+
 func (w *messageWriter) writeLine(s string, charsLeft int) string {
 	// If there is already a newline before the limit. Write the line.
 	if i := strings.IndexByte(s, '\n'); i != -1 && i < charsLeft {
@@ -218,7 +967,7 @@ func (w *messageWriter) writeLine(s string, charsLeft int) string {
 		return s[i+1:]
 	}
 
-	for i := charsLeft - 1; i >= 0; i-- {
+	for i := charsLeft; i >= 0; i-- {
 		if s[i] == ' ' {
 			w.writeString(s[:i])
 			w.writeString("\r\n ")
@@ -226,6 +975,17 @@ func (w *messageWriter) writeLine(s string, charsLeft int) string {
 		}
 	}
 
+	// The first word is too long, split it if it is an encoded-word.
+	i := strings.IndexByte(s, ' ')
+	if i == -1 {
+		i = len(s)
+	}
+	if first, rest, ok := splitEncodedWord(s[:i], charsLeft); ok {
+		w.writeString(first)
+		w.writeString("\r\n ")
+		return rest + s[i:]
+	}
+
 	// We could not insert a newline cleanly so look for a space or a newline
 	// even if it is after the limit.
 	for i := 75; i < len(s); i++ {
@@ -245,13 +1005,80 @@ func (w *messageWriter) writeLine(s string, charsLeft int) string {
 	return ""
 }
 
+type headerField struct {
+	key    string
+	values []string
+	// repeated fields are written on a line per value.
+	repeated bool
+}
+
+// orderFields moves the fields listed in order first, the other fields keep
+// their relative order.
+func orderFields(fields []headerField, order []string) []headerField {
+	if len(order) == 0 {
+		return fields
+	}
+	sorted := make([]headerField, 0, len(fields))
+	done := make([]bool, len(fields))
+	for _, k := range order {
+		for i, f := range fields {
+			if !done[i] && strings.EqualFold(f.key, k) {
+				sorted = append(sorted, f)
+				done[i] = true
+			}
+		}
+	}
+	for i, f := range fields {
+		if !done[i] {
+			sorted = append(sorted, f)
+		}
+	}
+	return sorted
+}
+
+// writeFields writes the message header fields in the given order.
+func (w *messageWriter) writeFields(fields []headerField) {
+	for _, f := range fields {
+		if err := checkHeader(f.key, f.values); err != nil {
+			w.err = err
+			return
+		}
+	}
+	for _, f := range fields {
+		switch {
+		case strings.EqualFold(f.key, "Bcc"):
+		case f.repeated:
+			for _, v := range f.values {
+				w.writeHeader(f.key, v)
+			}
+		default:
+			w.writeHeader(f.key, f.values...)
+		}
+	}
+}
+
 func (w *messageWriter) writeHeaders(h map[string][]string) {
+	for k, v := range h {
+		if err := checkHeader(k, v); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+	if w.err != nil {
+		return
+	}
+
 	if w.depth == 0 {
-		for k, v := range h {
-			if k != "Bcc" {
-				w.writeHeader(k, v...)
+		// Sort the fields so the output is reproducible.
+		keys := make([]string, 0, len(h))
+		for k := range h {
+			if !strings.EqualFold(k, "Bcc") {
+				keys = append(keys, k)
 			}
 		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			w.writeHeader(k, h[k]...)
+		}
 	} else {
 		w.createPart(h)
 	}
@@ -265,53 +1092,278 @@ func (w *messageWriter) writeBody(f func(io.Writer) error, enc Encoding) {
 	var subWriter io.Writer
 	if w.depth == 0 {
 		w.writeString("\r\n")
-		subWriter = w.w
+		subWriter = w
 	} else {
 		subWriter = w.partWriter
 	}
 
-	if enc == Base64 {
-		wc := base64.NewEncoder(base64.StdEncoding, newBase64LineWriter(subWriter))
-		w.err = f(wc)
-		wc.Close()
-	} else if enc == Unencoded {
+	if c := w.newBoundaryChecker(subWriter); c != nil {
+		subWriter = c
+	}
+
+	var wc io.WriteCloser
+	switch enc {
+	case Base64:
+		if w.base64LineLen > 0 {
+			subWriter = newBase64LineWriter(subWriter, w.base64LineLen)
+		}
+		wc = base64.NewEncoder(base64.StdEncoding, subWriter)
+	case Unencoded:
+		if w.lineLength != LineLengthIgnore {
+			subWriter = &lineLengthWriter{w: subWriter, wrap: w.lineLength == LineLengthWrap}
+		}
+		// Unlike DATA, BDAT does not normalize the line endings.
+		w.err = f(&crlfWriter{w: subWriter})
+		return
+	case binaryEncoding:
 		w.err = f(subWriter)
+		return
+	default:
+		wc = newQPWriter(subWriter)
+	}
+	w.err = f(wc)
+	if err := wc.Close(); w.err == nil {
+		w.err = err
+	}
+}
+
+// newBoundaryChecker returns a writer failing when a custom boundary of an open
+// multipart entity starts a line, or nil if no custom boundary is used.
+func (w *messageWriter) newBoundaryChecker(dst io.Writer) io.Writer {
+	var delims [][]byte
+	maxLen := 0
+	for _, b := range w.delimiters[:w.depth] {
+		if b != "" {
+			d := []byte("\n--" + b)
+			delims = append(delims, d)
+			if len(d) > maxLen {
+				maxLen = len(d)
+			}
+		}
+	}
+	if delims == nil {
+		return nil
+	}
+	// The content starts on a new line.
+	return &boundaryChecker{w: dst, delims: delims, tail: []byte("\n"), maxTail: maxLen - 1}
+}
+
+type boundaryChecker struct {
+	w       io.Writer
+	delims  [][]byte
+	tail    []byte
+	maxTail int
+}
+
+func (c *boundaryChecker) Write(p []byte) (int, error) {
+	seam := p
+	if len(seam) > c.maxTail {
+		seam = seam[:c.maxTail]
+	}
+	seam = append(append([]byte(nil), c.tail...), seam...)
+	for _, d := range c.delims {
+		if bytes.Contains(seam, d) || bytes.Contains(p, d) {
+			return 0, fmt.Errorf("gomail: multipart boundary %q appears in the content", d[3:])
+		}
+	}
+
+	if len(p) >= c.maxTail {
+		c.tail = append(c.tail[:0], p[len(p)-c.maxTail:]...)
 	} else {
-		wc := newQPWriter(subWriter)
-		w.err = f(wc)
-		wc.Close()
+		c.tail = append(c.tail, p...)
+		c.tail = append(c.tail[:0], c.tail[len(c.tail)-min(len(c.tail), c.maxTail):]...)
 	}
+	return c.w.Write(p)
+}
+
+// writeMultipartSigned writes a multipart/signed entity as defined in RFC 1847
+// made of the given entity followed by a signature part with header h and the
+// content written by sig.
+func writeMultipartSigned(w io.Writer, entity []byte, protocol, micalg, h string, sig func(io.Writer) error) error {
+	boundary := multipart.NewWriter(nil).Boundary()
+
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: multipart/signed;\r\n" +
+		" protocol=\"" + protocol + "\";\r\n" +
+		" micalg=" + micalg + ";\r\n" +
+		" boundary=" + boundary + "\r\n\r\n")
+	buf.WriteString("--" + boundary + "\r\n")
+	buf.Write(entity)
+	buf.WriteString("\r\n--" + boundary + "\r\n")
+	buf.WriteString(h + "\r\n")
+	if err := sig(&buf); err != nil {
+		return err
+	}
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// crlfWriter converts bare LF and bare CR line endings to CRLF.
+type crlfWriter struct {
+	w io.Writer
+	// cr is set when the last byte written was a CR, the LF of a CRLF may
+	// come with the next write.
+	cr bool
+}
+
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if p[0] == '\n' && w.cr {
+			w.cr = false
+			n++
+			p = p[1:]
+			continue
+		}
+		i := bytes.IndexAny(p, "\r\n")
+		if i == -1 {
+			m, err := w.w.Write(p)
+			w.cr = false
+			return n + m, err
+		}
+		m, err := w.w.Write(p[:i])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if _, err := w.w.Write(crlf); err != nil {
+			return n, err
+		}
+		n++
+		w.cr = p[i] == '\r'
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// lineLengthWriter applies a LineLengthPolicy to content with CRLF line
+// endings.
+type lineLengthWriter struct {
+	w    io.Writer
+	wrap bool
+	// n is the length of the current line.
+	n int
+}
+
+func (w *lineLengthWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Find the longest prefix of p fitting in the current line.
+		i := 0
+		for ; i < len(p); i++ {
+			c := p[i]
+			if c == '\r' || c == '\n' {
+				w.n = 0
+				continue
+			}
+			if w.n+utf8SeqLen(c) > maxLineLen5322 {
+				break
+			}
+			w.n++
+		}
+		m, err := w.w.Write(p[:i])
+		written += m
+		if err != nil || i == len(p) {
+			return written, err
+		}
+		if !w.wrap {
+			return written, fmt.Errorf("gomail: line longer than %d octets in unencoded content", maxLineLen5322)
+		}
+		if _, err := w.w.Write(crlf); err != nil {
+			return written, err
+		}
+		w.n = 0
+		p = p[i:]
+	}
+	return written, nil
+}
+
+// utf8SeqLen returns the length of the UTF-8 sequence starting with c, so
+// lineLengthWriter does not split characters. It returns 1 for continuation
+// bytes and invalid bytes.
+func utf8SeqLen(c byte) int {
+	switch {
+	case c >= 0xF8:
+		return 1
+	case c >= 0xF0:
+		return 4
+	case c >= 0xE0:
+		return 3
+	case c >= 0xC0:
+		return 2
+	}
+	return 1
 }
 
 // As required by RFC 2045, 6.7. (page 21) for quoted-printable, and
 // RFC 2045, 6.8. (page 25) for base64.
 const maxLineLen = 76
 
-// base64LineWriter limits text encoded in base64 to 76 characters per line
+// base64LineWriter limits text encoded in base64 to maxLen characters per
+// line, 76 by default.
 type base64LineWriter struct {
 	w       io.Writer
 	lineLen int
+	maxLen  int
 }
 
-func newBase64LineWriter(w io.Writer) *base64LineWriter {
-	return &base64LineWriter{w: w}
+func newBase64LineWriter(w io.Writer, maxLen int) *base64LineWriter {
+	return &base64LineWriter{w: w, maxLen: maxLen}
 }
 
+// Write never buffers: each chunk handed over by the base64 encoder is written
+// through to the underlying writer immediately, so attachments are streamed
+// instead of being held in memory.
 func (w *base64LineWriter) Write(p []byte) (int, error) {
 	n := 0
-	for len(p)+w.lineLen > maxLineLen {
-		w.w.Write(p[:maxLineLen-w.lineLen])
-		w.w.Write([]byte("\r\n"))
-		p = p[maxLineLen-w.lineLen:]
-		n += maxLineLen - w.lineLen
+	for len(p)+w.lineLen > w.maxLen {
+		if _, err := w.w.Write(p[:w.maxLen-w.lineLen]); err != nil {
+			return n, err
+		}
+		if _, err := w.w.Write(crlf); err != nil {
+			return n, err
+		}
+		p = p[w.maxLen-w.lineLen:]
+		n += w.maxLen - w.lineLen
 		w.lineLen = 0
 	}
 
-	w.w.Write(p)
+	if _, err := w.w.Write(p); err != nil {
+		return n, err
+	}
 	w.lineLen += len(p)
 
 	return n + len(p), nil
 }
 
+var crlf = []byte("\r\n")
+
+// bufferPool holds the buffers used while a message is written, so writing
+// many messages does not allocate new buffers each time.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// maxPooledBufferSize is the capacity above which buffers are not returned to
+// the pool, so a single large message does not keep its memory allocated.
+const maxPooledBufferSize = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
 // Stubbed out for testing.
-var now = time.Now
+var (
+	now        = time.Now
+	randReader = rand.Reader
+)